@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dbungert/omnienv/internal/omnienv"
+)
+
+func printStatus(out io.Writer, status omnienv.Status) {
+	instanceType := "container"
+	if status.VM {
+		instanceType = "virtual-machine"
+	}
+	fmt.Fprintf(out, "instance: %s\n", status.Name)
+	fmt.Fprintf(out, "type: %s\n", instanceType)
+	fmt.Fprintf(out, "state: %s\n", status.State)
+	if status.LaunchStep != "" {
+		fmt.Fprintf(out, "launch: incomplete at step %s\n", status.LaunchStep)
+	}
+	switch {
+	case status.Idle == nil:
+	case status.Idle.StopAt.IsZero():
+		fmt.Fprintln(out, "idle stop: in use")
+	default:
+		left := max(status.Idle.StopAt.Sub(timeNow()), 0).Round(time.Second)
+		fmt.Fprintf(out, "idle stop: in %s\n", left)
+	}
+}
+
+func status(ctx context.Context, app omnienv.App) error {
+	status, err := app.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get status: %w", err)
+	}
+	printStatus(stdout, status)
+	return nil
+}
+
+func snapshot(ctx context.Context, app omnienv.App, params []string) error {
+	if len(params) > 1 {
+		return errors.New("snapshot takes at most one name")
+	}
+
+	if app.Opts.Snapshot.Delete {
+		if len(params) == 0 {
+			return errors.New("snapshot --delete requires a name")
+		}
+		return app.DeleteSnapshot(ctx, params[0])
+	}
+
+	name := timeNow().Format("20060102-150405")
+	if len(params) == 1 {
+		name = params[0]
+	}
+	if err := app.Snapshot(ctx, name); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "created snapshot %s\n", name)
+	return nil
+}
+
+func printSnapshots(out io.Writer, snapshots []omnienv.Snapshot) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tCREATED")
+	for _, snapshot := range snapshots {
+		created := snapshot.Created.Local().Format(time.DateTime)
+		fmt.Fprintf(w, "%s\t%s\n", snapshot.Name, created)
+	}
+	w.Flush()
+}
+
+func snapshots(ctx context.Context, app omnienv.App) error {
+	snapshots, err := app.Snapshots(ctx)
+	if err != nil {
+		return err
+	}
+	printSnapshots(stdout, snapshots)
+	return nil
+}
+
+func restore(ctx context.Context, app omnienv.App, params []string) error {
+	if len(params) != 1 {
+		return errors.New("restore requires a snapshot name")
+	}
+	return app.Restore(ctx, params[0])
+}
+
+func clone(ctx context.Context, app omnienv.App) error {
+	name, err := app.Clone(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "created %s\n", name)
+	return nil
+}
+
+func export(ctx context.Context, app omnienv.App) error {
+	if err := app.Export(ctx); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "exported %s to %s\n", app.Name(), app.Opts.Export.Output)
+	return nil
+}
+
+func importArchive(ctx context.Context, app omnienv.App, params []string) error {
+	if len(params) != 1 {
+		return errors.New("import requires an archive")
+	}
+	name, err := app.Import(ctx, params[0])
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "created %s\n", name)
+	return nil
+}
+
+func printImages(out io.Writer, images []omnienv.Image) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ALIAS\tFINGERPRINT\tCREATED\tSOURCE")
+	for _, image := range images {
+		alias := strings.Join(image.Aliases, ",")
+		created := image.Created.Local().Format(time.DateTime)
+		fingerprint := image.Fingerprint[:min(12, len(image.Fingerprint))]
+		source := image.Properties["omnienv.source"]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", alias, fingerprint, created, source)
+	}
+	w.Flush()
+}
+
+func publish(ctx context.Context, app omnienv.App) error {
+	if app.Opts.Publish.List {
+		images, err := app.PublishedImages(ctx)
+		if err != nil {
+			return err
+		}
+		printImages(stdout, images)
+		return nil
+	}
+
+	if err := app.Publish(ctx); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "published %s as %s\n", app.Name(), app.Opts.Publish.Alias)
+	return nil
+}
+
+func printOutdated(out io.Writer, outdated []omnienv.Outdated) {
+	if len(outdated) == 0 {
+		fmt.Fprintln(out, "all environments use the latest image")
+		return
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tIMAGE\tBUILT FROM\tLATEST")
+	for _, entry := range outdated {
+		fmt.Fprintf(
+			w, "%s\t%s\t%s\t%s\n", entry.Instance, entry.Image,
+			entry.Fingerprint[:min(12, len(entry.Fingerprint))],
+			entry.Latest[:min(12, len(entry.Latest))],
+		)
+	}
+	w.Flush()
+}
+
+func outdated(ctx context.Context, app omnienv.App) error {
+	outdated, err := app.OutdatedInstances(ctx)
+	if err != nil {
+		return err
+	}
+	printOutdated(stdout, outdated)
+	return nil
+}
+
+func forward(ctx context.Context, app omnienv.App, params []string) error {
+	if len(params) == 0 {
+		return errors.New("forward requires at least one port")
+	}
+	ports := make([]omnienv.Port, 0, len(params))
+	for _, param := range params {
+		port, err := omnienv.ParsePort(param)
+		if err != nil {
+			return err
+		}
+		ports = append(ports, port)
+	}
+	return app.Forward(ctx, ports)
+}
+
+// sessionName is the session named by params, or the default.
+func sessionName(command string, params []string) (string, error) {
+	switch len(params) {
+	case 0:
+		return omnienv.DefaultSession, nil
+	case 1:
+		return params[0], nil
+	default:
+		return "", fmt.Errorf("%s takes at most one session name", command)
+	}
+}
+
+// newSession starts a session running params, or a shell.  The name is
+// given by --name rather than positionally, so that it cannot be mistaken
+// for the command.
+func newSession(ctx context.Context, app omnienv.App, params []string) error {
+	name := app.Opts.Session.New.Name
+	if name == "" {
+		name = omnienv.DefaultSession
+	}
+	app.Opts.Params = params
+	if err := app.NewSession(ctx, name, app.Opts.Session.New.Detach); err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+	return nil
+}
+
+func attachSession(ctx context.Context, app omnienv.App, params []string) error {
+	name, err := sessionName("attach", params)
+	if err != nil {
+		return err
+	}
+	return app.AttachSession(ctx, name)
+}
+
+func printSessions(out io.Writer, sessions []omnienv.Session) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTARTED\tATTACHED\tDIRECTORY\tCOMMAND")
+	for _, session := range sessions {
+		started := session.Started.Local().Format(time.DateTime)
+		attached := "no"
+		if session.Attached {
+			attached = "yes"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			session.Name, started, attached, session.Dir, session.Command)
+	}
+	w.Flush()
+}
+
+func sessions(ctx context.Context, app omnienv.App) error {
+	sessions, err := app.Sessions(ctx)
+	if err != nil {
+		return err
+	}
+	printSessions(stdout, sessions)
+	return nil
+}
+
+func killSession(ctx context.Context, app omnienv.App, params []string) error {
+	if len(params) != 1 {
+		return errors.New("session kill requires a session name")
+	}
+	return app.KillSession(ctx, params[0])
+}
+
+func printHistory(out io.Writer, history omnienv.History) {
+	format := func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return t.Local().Format(time.DateTime)
+	}
+	fmt.Fprintf(out, "instance: %s\n", history.Instance)
+	fmt.Fprintf(out, "launched: %s\n", format(history.Launched))
+	if history.ConfigHash != "" {
+		fmt.Fprintf(out, "config hash: %s\n", history.ConfigHash)
+	}
+	fmt.Fprintf(out, "last shell: %s\n", format(history.LastShell))
+	if history.LastExit != nil {
+		fmt.Fprintf(out, "last exit status: %d\n", *history.LastExit)
+	}
+	if len(history.Steps) == 0 {
+		return
+	}
+	fmt.Fprintln(out, "launch steps:")
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, step := range history.Steps {
+		result := "ok"
+		if step.Error != "" {
+			result = "failed: " + step.Error
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n",
+			step.Name, format(step.Started), step.Duration.Round(time.Millisecond), result)
+	}
+	w.Flush()
+}
+
+func history(app omnienv.App) error {
+	history, err := app.History()
+	if err != nil {
+		return err
+	}
+	printHistory(stdout, history)
+	return nil
+}
+
+// validateConfig reports every problem in the config file on stderr, one
+// per line, so that editors and CI can pick them up.
+func validateConfig(params []string) error {
+	if len(params) > 1 {
+		return errors.New("config validate takes at most one file")
+	}
+	path := ""
+	if len(params) == 1 {
+		path = params[0]
+	}
+	path, err := omnienv.ValidateConfig(path)
+	if errors.Is(err, omnienv.ErrCfgNotFound) {
+		return err
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return fmt.Errorf("%s is invalid", path)
+	}
+	fmt.Fprintf(stdout, "%s is valid\n", path)
+	return nil
+}
+
+func configSchema() error {
+	data, err := omnienv.ConfigSchema()
+	if err != nil {
+		return err
+	}
+	_, err = stdout.Write(data)
+	return err
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dbungert/omnienv/internal/omnienv"
+	"github.com/stretchr/testify/assert"
+)
+
+var printStatusTests = []struct {
+	summary string
+	status  omnienv.Status
+
+	expected string
+}{{
+	summary: "launched",
+	status:  omnienv.Status{Name: "l-s", State: "RUNNING"},
+	expected: `instance: l-s
+type: container
+state: RUNNING
+`,
+}, {
+	summary: "incomplete",
+	status: omnienv.Status{
+		Name: "l-s", State: "STOPPED", VM: true, LaunchStep: "cloud-init",
+	},
+	expected: `instance: l-s
+type: virtual-machine
+state: STOPPED
+launch: incomplete at step cloud-init
+`,
+}, {
+	summary: "idle watcher, in use",
+	status: omnienv.Status{
+		Name: "l-s", State: "RUNNING", Idle: &omnienv.IdleState{PID: 42},
+	},
+	expected: `instance: l-s
+type: container
+state: RUNNING
+idle stop: in use
+`,
+}, {
+	summary: "idle watcher, counting down",
+	status: omnienv.Status{
+		Name: "l-s", State: "RUNNING", Idle: &omnienv.IdleState{
+			PID: 42, StopAt: time.Date(2025, 1, 2, 3, 16, 5, 400, time.Local),
+		},
+	},
+	expected: `instance: l-s
+type: container
+state: RUNNING
+idle stop: in 12m0s
+`,
+}}
+
+func TestPrintStatus(t *testing.T) {
+	origNow := timeNow
+	timeNow = func() time.Time { return time.Date(2025, 1, 2, 3, 4, 5, 0, time.Local) }
+	defer func() { timeNow = origNow }()
+	for _, test := range printStatusTests {
+		buf := &bytes.Buffer{}
+		printStatus(buf, test.status)
+		assert.Equal(t, test.expected, buf.String(), test.summary)
+	}
+}
+
+func TestPrintSnapshots(t *testing.T) {
+	created := time.Date(2025, 1, 2, 3, 4, 5, 0, time.Local)
+	buf := &bytes.Buffer{}
+	printSnapshots(buf, []omnienv.Snapshot{
+		{Name: "before-upgrade", Created: created},
+		{Name: "a", Created: created},
+	})
+	expected := `NAME            CREATED
+before-upgrade  2025-01-02 03:04:05
+a               2025-01-02 03:04:05
+`
+	assert.Equal(t, expected, buf.String())
+}
+
+var snapshotArgsTests = []struct {
+	summary string
+	delete  bool
+	params  []string
+
+	errMsg string
+}{{
+	summary: "too many",
+	params:  []string{"a", "b"},
+	errMsg:  "snapshot takes at most one name",
+}, {
+	summary: "delete without name",
+	delete:  true,
+	errMsg:  "snapshot --delete requires a name",
+}}
+
+func TestSnapshotArgs(t *testing.T) {
+	for _, test := range snapshotArgsTests {
+		app := omnienv.App{}
+		app.Opts.Snapshot.Delete = test.delete
+		err := snapshot(context.Background(), app, test.params)
+		assert.ErrorContains(t, err, test.errMsg, test.summary)
+	}
+}
+
+func TestRestoreArgs(t *testing.T) {
+	err := restore(context.Background(), omnienv.App{}, nil)
+	assert.ErrorContains(t, err, "restore requires a snapshot name")
+}
+
+type fakeBackend struct {
+	omnienv.Backend
+	created []string
+}
+
+func (fake *fakeBackend) ListSnapshots(context.Context, string) ([]omnienv.Snapshot, error) {
+	return nil, nil
+}
+
+func (fake *fakeBackend) CreateSnapshot(_ context.Context, instance, snapshot string) error {
+	fake.created = append(fake.created, instance+"/"+snapshot)
+	return nil
+}
+
+func TestSnapshotDefaultName(t *testing.T) {
+	origNow, origStdout := timeNow, stdout
+	buf := &bytes.Buffer{}
+	timeNow = func() time.Time { return time.Date(2025, 1, 2, 3, 4, 5, 0, time.Local) }
+	stdout = buf
+	defer func() { timeNow, stdout = origNow, origStdout }()
+	// an lxc that knows of no owner of the instance
+	bin := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(bin, "lxc"), []byte("#!/bin/sh\n"), 0755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	fake := &fakeBackend{}
+	app := omnienv.App{
+		Config:  omnienv.Config{Label: "l", System: omnienv.NewSystem("s")},
+		Backend: fake,
+	}
+	assert.Nil(t, snapshot(context.Background(), app, nil))
+	assert.Equal(t, []string{"l-s/omnienv-20250102-030405"}, fake.created)
+	assert.Equal(t, "created snapshot 20250102-030405\n", buf.String())
+}
+
+func TestPrintImages(t *testing.T) {
+	created := time.Date(2025, 1, 2, 3, 4, 5, 0, time.Local)
+	buf := &bytes.Buffer{}
+	printImages(buf, []omnienv.Image{{
+		Fingerprint: "0123456789abcdef0123",
+		Aliases:     []string{"team/noble-go"},
+		Properties:  map[string]string{"omnienv.source": "go-noble"},
+		Created:     created,
+	}})
+	expected := `ALIAS          FINGERPRINT   CREATED              SOURCE
+team/noble-go  0123456789ab  2025-01-02 03:04:05  go-noble
+`
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestPrintOutdated(t *testing.T) {
+	buf := &bytes.Buffer{}
+	printOutdated(buf, []omnienv.Outdated{{
+		Instance:    "l-noble",
+		Image:       "ubuntu-daily:noble",
+		Fingerprint: "0123456789abcdef",
+		Latest:      "fedcba9876543210",
+	}})
+	expected := `INSTANCE  IMAGE               BUILT FROM    LATEST
+l-noble   ubuntu-daily:noble  0123456789ab  fedcba987654
+`
+	assert.Equal(t, expected, buf.String())
+
+	buf.Reset()
+	printOutdated(buf, nil)
+	assert.Equal(t, "all environments use the latest image\n", buf.String())
+}
+
+var forwardArgsTests = []struct {
+	summary string
+	params  []string
+
+	errMsg string
+}{{
+	summary: "none",
+	errMsg:  "forward requires at least one port",
+}, {
+	summary: "invalid",
+	params:  []string{"80", "http"},
+	errMsg:  `invalid port "http"`,
+}}
+
+func TestForwardArgs(t *testing.T) {
+	for _, test := range forwardArgsTests {
+		err := forward(context.Background(), omnienv.App{}, test.params)
+		assert.ErrorContains(t, err, test.errMsg, test.summary)
+	}
+}
+
+func TestPrintSessions(t *testing.T) {
+	started := time.Date(2025, 1, 2, 3, 4, 5, 0, time.Local)
+	buf := &bytes.Buffer{}
+	printSessions(buf, []omnienv.Session{{
+		Name: "main", Command: "shell", Dir: "/src/proj", Started: started, Attached: true,
+	}, {
+		Name: "build", Command: "make -j8", Dir: "/src/proj/sub", Started: started,
+	}})
+	expected := `NAME   STARTED              ATTACHED  DIRECTORY      COMMAND
+main   2025-01-02 03:04:05  yes       /src/proj      shell
+build  2025-01-02 03:04:05  no        /src/proj/sub  make -j8
+`
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestSessionName(t *testing.T) {
+	name, err := sessionName("attach", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, omnienv.DefaultSession, name)
+
+	name, err = sessionName("attach", []string{"build"})
+	assert.Nil(t, err)
+	assert.Equal(t, "build", name)
+
+	_, err = sessionName("attach", []string{"a", "b"})
+	assert.ErrorContains(t, err, "attach takes at most one session name")
+
+	err = killSession(context.Background(), omnienv.App{}, nil)
+	assert.ErrorContains(t, err, "session kill requires a session name")
+}
+
+func TestPrintHistory(t *testing.T) {
+	launched := time.Date(2025, 1, 2, 3, 4, 5, 0, time.Local)
+	status := 2
+	buf := &bytes.Buffer{}
+	printHistory(buf, omnienv.History{
+		Instance:   "l-s",
+		Launched:   launched,
+		ConfigHash: "0123456789abcdef",
+		LastExit:   &status,
+		Steps: []omnienv.StepLog{
+			{Name: "create", Started: launched, Duration: 2 * time.Second},
+			{Name: "cloud-init", Started: launched, Duration: time.Minute, Error: "timed out"},
+		},
+	})
+	expected := `instance: l-s
+launched: 2025-01-02 03:04:05
+config hash: 0123456789abcdef
+last shell: never
+last exit status: 2
+launch steps:
+  create      2025-01-02 03:04:05  2s    ok
+  cloud-init  2025-01-02 03:04:05  1m0s  failed: timed out
+`
+	assert.Equal(t, expected, buf.String())
+
+	buf.Reset()
+	printHistory(buf, omnienv.History{Instance: "l-s"})
+	assert.Equal(t, "instance: l-s\nlaunched: never\nlast shell: never\n", buf.String())
+}
+
+func TestValidateConfig(t *testing.T) {
+	origStdout, origStderr := stdout, stderr
+	outBuf, errBuf := &bytes.Buffer{}, &bytes.Buffer{}
+	stdout, stderr = outBuf, errBuf
+	defer func() { stdout, stderr = origStdout, origStderr }()
+
+	path := filepath.Join(t.TempDir(), ".omnienv.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte("sytem: noble\nbackend: docker\n"), 0o644))
+	assert.EqualError(t, validateConfig([]string{path}), path+" is invalid")
+	assert.Equal(t, path+`:1:1: unknown field "sytem", did you mean "system"?`+"\n"+
+		path+`:2:10: invalid backend "docker", expected lxd`+"\n", errBuf.String())
+
+	assert.Nil(t, os.WriteFile(path, []byte("system: noble\n"), 0o644))
+	assert.Nil(t, validateConfig([]string{path}))
+	assert.Equal(t, path+" is valid\n", outBuf.String())
+
+	assert.ErrorContains(t, validateConfig([]string{"a", "b"}), "at most one file")
+}
+
+func TestConfigSchema(t *testing.T) {
+	origStdout := stdout
+	buf := &bytes.Buffer{}
+	stdout = buf
+	defer func() { stdout = origStdout }()
+
+	assert.Nil(t, configSchema())
+	expected, err := omnienv.ConfigSchema()
+	assert.Nil(t, err)
+	assert.Equal(t, string(expected), buf.String())
+}
@@ -3,6 +3,13 @@ package main
 import (
 	"io"
 	"os"
+	"time"
+
+	"github.com/dbungert/omnienv/internal/omnienv"
 )
 
+var stdin io.Reader = os.Stdin
+var stdout io.Writer = os.Stdout
 var stderr io.Writer = os.Stderr
+var timeNow = time.Now
+var stdinTerminal = func() bool { return omnienv.Terminal(os.Stdin) }
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
 	"runtime/debug"
+	"syscall"
 
 	"github.com/dbungert/omnienv/internal/omnienv"
 )
@@ -27,20 +31,87 @@ func Run() error {
 	setupLogging(opts.Verbose)
 	slog.Debug("cmdline", "opts", opts)
 
+	// these concern the config file itself, so run without loading it first
+	switch opts.Command {
+	case "config validate":
+		return validateConfig(opts.Params)
+	case "config schema":
+		return configSchema()
+	}
+
 	cfg, err := omnienv.GetConfig()
 	if err != nil {
 		return fmt.Errorf("fatal error: %w", err)
 	}
 
-	app := omnienv.App{Config: cfg, Opts: opts}
+	ctx, stop := signal.NotifyContext(
+		context.Background(), os.Interrupt, syscall.SIGTERM,
+	)
+	defer stop()
+	// once interrupted, restore default handling so that a second
+	// interrupt, such as while answering a prompt, exits immediately
+	context.AfterFunc(ctx, stop)
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	app := omnienv.App{Config: cfg, Opts: opts, Confirm: confirm}
+
+	switch opts.Command {
+	case "status":
+		return status(ctx, app)
+	case "snapshot":
+		return snapshot(ctx, app, opts.Params)
+	case "snapshots":
+		return snapshots(ctx, app)
+	case "restore":
+		return restore(ctx, app, opts.Params)
+	case "clone":
+		return clone(ctx, app)
+	case "export":
+		return export(ctx, app)
+	case "import":
+		return importArchive(ctx, app, opts.Params)
+	case "publish":
+		return publish(ctx, app)
+	case "images pull":
+		return app.PullImage(ctx)
+	case "images outdated":
+		return outdated(ctx, app)
+	case "forward":
+		return forward(ctx, app, opts.Params)
+	case "session attach", "attach":
+		return attachSession(ctx, app, opts.Params)
+	case "session list":
+		return sessions(ctx, app)
+	case "session kill":
+		return killSession(ctx, app, opts.Params)
+	case "idle-watch":
+		return app.IdleWatch(ctx)
+	case "history":
+		return history(app)
+	case "sync":
+		return app.Sync(ctx)
+	}
 
-	if opts.Launch {
-		if err := app.Launch(); err != nil {
-			return fmt.Errorf("failed to launch: %w", err)
+	if err := app.EnsureLaunched(ctx); err != nil {
+		return fmt.Errorf("failed to launch: %w", err)
+	}
+
+	if opts.Command == "session new" {
+		return newSession(ctx, app, opts.Params)
+	}
+
+	if opts.Command == "exec" {
+		if err := app.Exec(ctx); err != nil {
+			return fmt.Errorf("failed to run command: %w", err)
 		}
+		return nil
 	}
 
-	if err := app.Shell(); err != nil {
+	if err := app.Shell(ctx); err != nil {
 		return fmt.Errorf("failed to create shell: %w", err)
 	}
 
@@ -48,7 +119,14 @@ func Run() error {
 }
 
 func main() {
-	if err := Run(); err != nil {
+	err := Run()
+	var exitErr *omnienv.ExitCodeError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr):
+		// the command in the environment failed, pass on its exit code
+		os.Exit(exitErr.Code)
+	default:
 		slog.Error("fatal error", "error", err)
 		os.Exit(1)
 	}
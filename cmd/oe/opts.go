@@ -1,6 +1,8 @@
 package main
 
 import (
+	"strings"
+
 	"github.com/dbungert/omnienv/internal/omnienv"
 	"github.com/jessevdk/go-flags"
 )
@@ -13,11 +15,17 @@ func GetOpts(args []string) (omnienv.Opts, error) {
 		flags.HelpFlag|flags.PrintErrors|flags.PassDoubleDash|flags.PassAfterNonOption,
 	)
 	parser.Usage = "[OPTIONS]"
+	parser.SubcommandsOptional = true
 
 	params, err := parser.ParseArgs(args)
 	if err != nil {
 		return omnienv.Opts{}, err
 	}
+	var names []string
+	for cmd := parser.Active; cmd != nil; cmd = cmd.Active {
+		names = append(names, cmd.Name)
+	}
+	opts.Command = strings.Join(names, " ")
 	opts.Params = params
 	return opts, nil
 }
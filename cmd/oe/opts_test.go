@@ -2,6 +2,7 @@ package main
 
 import (
 	"testing"
+	"time"
 
 	"github.com/dbungert/omnienv/internal/omnienv"
 	"github.com/stretchr/testify/assert"
@@ -19,7 +20,23 @@ var argsTests = []struct {
 }, {
 	summary:   "launch",
 	argsInput: []string{"--launch"},
-	opts:      omnienv.Opts{Launch: true},
+	opts:      omnienv.Opts{Launch: omnienv.LaunchMissing},
+}, {
+	summary:   "auto launch",
+	argsInput: []string{"--auto-launch"},
+	opts:      omnienv.Opts{AutoLaunch: omnienv.AutoLaunchTrue},
+}, {
+	summary:   "auto launch prompt",
+	argsInput: []string{"--auto-launch=prompt"},
+	opts:      omnienv.Opts{AutoLaunch: omnienv.AutoLaunchPrompt},
+}, {
+	summary:   "launch always",
+	argsInput: []string{"--launch=always"},
+	opts:      omnienv.Opts{Launch: omnienv.LaunchAlways},
+}, {
+	summary:   "launch never",
+	argsInput: []string{"--launch=never", "make"},
+	opts:      omnienv.Opts{Launch: omnienv.LaunchNever, Params: []string{"make"}},
 }, {
 	summary:   "verbose",
 	argsInput: []string{"--verbose"},
@@ -36,6 +53,10 @@ var argsTests = []struct {
 	summary:   "system + param",
 	argsInput: []string{"--system", "foo", "bar"},
 	opts:      omnienv.Opts{System: "foo", Params: []string{"bar"}},
+}, {
+	summary:   "timeout",
+	argsInput: []string{"--timeout", "90s"},
+	opts:      omnienv.Opts{Timeout: 90 * time.Second},
 }, {
 	summary:   "version",
 	argsInput: []string{"--version"},
@@ -44,6 +65,128 @@ var argsTests = []struct {
 	summary:   "pass after unrecognized",
 	argsInput: []string{"bash", "--help"},
 	opts:      omnienv.Opts{Params: []string{"bash", "--help"}},
+}, {
+	summary:   "launch resume",
+	argsInput: []string{"--launch", "--resume", "--rollback-on-failure"},
+	opts: omnienv.Opts{
+		Launch: omnienv.LaunchMissing, Resume: true, RollbackOnFailure: true,
+	},
+}, {
+	summary:   "status command",
+	argsInput: []string{"-v", "status"},
+	opts:      omnienv.Opts{Verbose: true, Command: "status"},
+}, {
+	summary:   "snapshot",
+	argsInput: []string{"snapshot", "before-upgrade"},
+	opts:      omnienv.Opts{Command: "snapshot", Params: []string{"before-upgrade"}},
+}, {
+	summary:   "snapshot delete",
+	argsInput: []string{"snapshot", "--delete", "old"},
+	opts: func() omnienv.Opts {
+		opts := omnienv.Opts{Command: "snapshot", Params: []string{"old"}}
+		opts.Snapshot.Delete = true
+		return opts
+	}(),
+}, {
+	summary:   "restore",
+	argsInput: []string{"restore", "before-upgrade"},
+	opts:      omnienv.Opts{Command: "restore", Params: []string{"before-upgrade"}},
+}, {
+	summary:   "clone",
+	argsInput: []string{"clone", "--to-label", "wt2", "--snapshot", "base"},
+	opts: omnienv.Opts{
+		Command: "clone",
+		Clone:   omnienv.CloneOpts{ToLabel: "wt2", Snapshot: "base"},
+	},
+}, {
+	summary:   "export",
+	argsInput: []string{"export", "--snapshot", "base", "-o", "env.tar.zst"},
+	opts: omnienv.Opts{
+		Command: "export",
+		Export:  omnienv.ExportOpts{Snapshot: "base", Output: "env.tar.zst"},
+	},
+}, {
+	summary:   "import",
+	argsInput: []string{"import", "env.tar.zst"},
+	opts:      omnienv.Opts{Command: "import", Params: []string{"env.tar.zst"}},
+}, {
+	summary:   "publish",
+	argsInput: []string{"publish", "--alias", "team/noble-go"},
+	opts: omnienv.Opts{
+		Command: "publish",
+		Publish: omnienv.PublishOpts{Alias: "team/noble-go"},
+	},
+}, {
+	summary:   "publish list",
+	argsInput: []string{"publish", "--list"},
+	opts: omnienv.Opts{
+		Command: "publish",
+		Publish: omnienv.PublishOpts{List: true},
+	},
+}, {
+	summary:   "images pull",
+	argsInput: []string{"images", "pull"},
+	opts:      omnienv.Opts{Command: "images pull"},
+}, {
+	summary:   "images outdated",
+	argsInput: []string{"images", "outdated"},
+	opts:      omnienv.Opts{Command: "images outdated"},
+}, {
+	summary:   "forward",
+	argsInput: []string{"forward", "5432", "3000:80/tcp"},
+	opts:      omnienv.Opts{Command: "forward", Params: []string{"5432", "3000:80/tcp"}},
+}, {
+	summary:   "env",
+	argsInput: []string{"-e", "CI=true", "--env", "GOFLAGS", "--", "make"},
+	opts: omnienv.Opts{
+		Env:    []string{"CI=true", "GOFLAGS"},
+		Params: []string{"make"},
+	},
+}, {
+	summary:   "exec",
+	argsInput: []string{"exec", "--", "wc", "-l"},
+	opts:      omnienv.Opts{Command: "exec", Params: []string{"wc", "-l"}},
+}, {
+	summary:   "translate paths",
+	argsInput: []string{"--translate-paths", "exec", "--", "go", "vet", "/src/proj/..."},
+	opts: omnienv.Opts{
+		TranslatePaths: true,
+		Command:        "exec",
+		Params:         []string{"go", "vet", "/src/proj/..."},
+	},
+}, {
+	summary:   "session new",
+	argsInput: []string{"session", "new", "-d", "--name", "build", "--", "make", "-j8"},
+	opts: func() omnienv.Opts {
+		opts := omnienv.Opts{Command: "session new", Params: []string{"make", "-j8"}}
+		opts.Session.New.Detach = true
+		opts.Session.New.Name = "build"
+		return opts
+	}(),
+}, {
+	summary:   "session new command without name",
+	argsInput: []string{"session", "new", "--", "make", "-j8"},
+	opts:      omnienv.Opts{Command: "session new", Params: []string{"make", "-j8"}},
+}, {
+	summary:   "attach",
+	argsInput: []string{"attach", "build"},
+	opts:      omnienv.Opts{Command: "attach", Params: []string{"build"}},
+}, {
+	summary:   "session list",
+	argsInput: []string{"session", "list"},
+	opts:      omnienv.Opts{Command: "session list"},
+}, {
+	summary:   "config validate",
+	argsInput: []string{"config", "validate", "x.yaml"},
+	opts:      omnienv.Opts{Command: "config validate", Params: []string{"x.yaml"}},
+}, {
+	summary:   "config schema",
+	argsInput: []string{"config", "schema"},
+	opts:      omnienv.Opts{Command: "config schema"},
+}, {
+	summary:   "command name after double dash",
+	argsInput: []string{"--", "status"},
+	opts:      omnienv.Opts{Params: []string{"status"}},
 }, {
 	summary:   "pass after double dash",
 	argsInput: []string{"--", "bash", "--help"},
@@ -66,3 +209,18 @@ func TestBadArgs(t *testing.T) {
 	_, err := GetOpts([]string{"--invalid"})
 	assert.NotNil(t, err)
 }
+
+func TestBadLaunchMode(t *testing.T) {
+	_, err := GetOpts([]string{"--launch=sometimes"})
+	assert.NotNil(t, err)
+}
+
+func TestExportNeedsOutput(t *testing.T) {
+	_, err := GetOpts([]string{"export"})
+	assert.NotNil(t, err)
+}
+
+func TestImagesNeedsSubcommand(t *testing.T) {
+	_, err := GetOpts([]string{"images"})
+	assert.NotNil(t, err)
+}
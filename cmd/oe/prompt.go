@@ -0,0 +1,20 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+)
+
+// confirm asks a yes/no question, defaulting to no.  Without a terminal
+// the answer is no, rather than taking it from input meant for the
+// command.
+func confirm(question string) bool {
+	if !stdinTerminal() {
+		return false
+	}
+	fmt.Fprintf(stderr, "%s [y/N] ", question)
+	line, _ := bufio.NewReader(stdin).ReadString('\n')
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "y" || answer == "yes"
+}
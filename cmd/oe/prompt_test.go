@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var confirmTests = []struct {
+	summary string
+	input   string
+	answer  bool
+}{{
+	summary: "yes",
+	input:   "yes\n",
+	answer:  true,
+}, {
+	summary: "y with whitespace",
+	input:   " Y \n",
+	answer:  true,
+}, {
+	summary: "no",
+	input:   "n\n",
+	answer:  false,
+}, {
+	summary: "default",
+	input:   "\n",
+	answer:  false,
+}, {
+	summary: "eof",
+	input:   "",
+	answer:  false,
+}}
+
+func TestConfirm(t *testing.T) {
+	origTerminal := stdinTerminal
+	stdinTerminal = func() bool { return true }
+	defer func() { stdinTerminal = origTerminal }()
+	for _, test := range confirmTests {
+		buf := &bytes.Buffer{}
+		origStdin, origStderr := stdin, stderr
+		stdin, stderr = strings.NewReader(test.input), buf
+		answer := confirm("Proceed?")
+		stdin, stderr = origStdin, origStderr
+
+		assert.Equal(t, test.answer, answer, test.summary)
+		assert.Equal(t, "Proceed? [y/N] ", buf.String(), test.summary)
+	}
+}
+
+func TestConfirmNoTerminal(t *testing.T) {
+	origTerminal, origStdin, origStderr := stdinTerminal, stdin, stderr
+	input := strings.NewReader("yes\n")
+	stdinTerminal, stdin, stderr = func() bool { return false }, input, &bytes.Buffer{}
+	defer func() { stdinTerminal, stdin, stderr = origTerminal, origStdin, origStderr }()
+	assert.False(t, confirm("Proceed?"))
+	assert.Equal(t, 4, input.Len())
+}
@@ -1,21 +1,33 @@
 package omnienv
 
 import (
-	"bytes"
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
-	"os/exec"
 	"strings"
 	"time"
 
 	"al.essio.dev/pkg/shellescape"
 )
 
+var ErrInstanceNotFound = errors.New("instance not found")
+
 type App struct {
 	Config Config
 	Opts   Opts
+	// Backend defaults to lxd when nil.
+	Backend Backend
+	// Confirm asks the user a yes/no question.  When nil, the answer is
+	// always no.
+	Confirm func(question string) bool
+}
+
+func (app App) confirm(question string) bool {
+	return app.Confirm != nil && app.Confirm(question)
 }
 
 func (app App) launchImage() string {
@@ -32,42 +44,52 @@ func (app App) system() string {
 	return app.Config.System.Name
 }
 
-func (app App) name() string {
-	return fmt.Sprintf("%s-%s", app.Config.Label, app.system())
+// Name is the instance name, derived from the Label and system, and with
+// NamingHashed a hash of the project directory.  Characters LXD does not
+// allow in a name are replaced.
+func (app App) Name() string {
+	if app.Config.Naming == NamingHashed {
+		return buildName(
+			app.Config.Label, app.system(), dirHash(app.Config.projectDir()),
+		)
+	}
+	return buildName(app.Config.Label, app.system())
 }
 
-func (app App) start() error {
-	args := []string{"lxc", "start", app.name()}
-	slog.Debug("run", "command", args)
-	if err := run(args...); err != nil {
+func (app App) start(ctx context.Context) error {
+	args := []string{"lxc", "start", app.Name()}
+	if err := run(ctx, args...); err != nil {
 		return fmt.Errorf("failed to start instance: %w", err)
 	}
 	return nil
 }
 
-func (app App) StartIfNeeded() error {
-	cmd := command("lxc", "info", app.name())
-	slog.Debug("run", "command", cmd.Args)
-	out, err := cmd.Output()
+// StartIfNeeded starts the instance if it is stopped, waiting for any
+// start or launch of it by another process to finish first.
+func (app App) StartIfNeeded(ctx context.Context) error {
+	unlock, err := app.lock(ctx, "start")
 	if err != nil {
-		return fmt.Errorf("failed to get instance info: %w", err)
+		return err
 	}
+	defer unlock()
+	return app.startIfNeeded(ctx)
+}
 
-	var status string
-	for _, line := range strings.Split(string(out), "\n") {
-		if after, found := strings.CutPrefix(line, "Status: "); found {
-			status = after
-			break
-		}
+func (app App) startIfNeeded(ctx context.Context) error {
+	fields, err := app.info(ctx)
+	if err != nil {
+		return err
 	}
+
+	status := fields["Status"]
 	if status == "" {
-		return fmt.Errorf("could not determine status of instance %s", app.name())
+		return fmt.Errorf("could not determine status of instance %s", app.Name())
 	}
 
 	slog.Debug("startIfNeeded", "instanceStatus", status)
 	switch status {
 	case "STOPPED":
-		return app.start()
+		return app.start(ctx)
 	case "RUNNING":
 		return nil
 	default:
@@ -75,66 +97,26 @@ func (app App) StartIfNeeded() error {
 	}
 }
 
-func (app App) isVM() (bool, error) {
-	cmd := command("lxc", "info", app.name())
-	slog.Debug("run", "command", cmd.Args)
-	out, err := cmd.Output()
+func (app App) isVM(ctx context.Context) (bool, error) {
+	fields, err := app.info(ctx)
 	if err != nil {
-		return false, fmt.Errorf("failed to get instance info: %w", err)
+		return false, err
 	}
 
-	for _, line := range strings.Split(string(out), "\n") {
-		if after, found := strings.CutPrefix(line, "Type: "); found {
-			return after == "virtual-machine", nil
-		}
+	instanceType, found := fields["Type"]
+	if !found {
+		return false, fmt.Errorf("could not determine type of instance %s", app.Name())
 	}
-	return false, fmt.Errorf("could not determine type of instance %s", app.name())
+	return instanceType == "virtual-machine", nil
 }
 
-func (app App) Wait() error {
-	vm, err := app.isVM()
-	if err != nil {
-		return err
-	}
-	if !vm {
-		return nil
-	}
-
-	fmt.Print("Waiting")
-	for i := 0; ; i++ {
-		err := runDevNull(
-			"lxc", "exec", app.name(), "--", "/bin/true",
-		)
-		if err == nil {
-			fmt.Println()
-			return nil
-		}
-
-		exitError, ok := err.(*exec.ExitError)
-		if !ok {
-			return err
-		}
-
-		if ec := exitError.ExitCode(); ec != 255 {
-			return fmt.Errorf("strange exit code %d", ec)
-		}
-
-		if i >= 300 {
-			return fmt.Errorf("timed out waiting for %s to become reachable", app.name())
-		}
-
-		timeSleep(time.Second)
-		fmt.Print(".")
-	}
-}
-
-func (app App) lxcExec(args ...string) error {
-	cmd := append([]string{"lxc", "exec", app.name(), "--"}, args...)
-	return run(cmd...)
+func (app App) lxcExec(ctx context.Context, args ...string) error {
+	cmd := append([]string{"lxc", "exec", app.Name(), "--"}, args...)
+	return run(ctx, cmd...)
 }
 
 func (app App) lxcOutput(ctx context.Context, args ...string) (string, error) {
-	cmd := append([]string{"lxc", "exec", app.name(), "--"}, args...)
+	cmd := append([]string{"lxc", "exec", app.Name(), "--"}, args...)
 	cc := commandContext(ctx, cmd[0], cmd[1:]...)
 	slog.Debug("run", "command", cc.Args)
 	out, err := cc.Output()
@@ -144,7 +126,7 @@ func (app App) lxcOutput(ctx context.Context, args ...string) (string, error) {
 	return strings.TrimSpace(string(out)), nil
 }
 
-func (app App) isUbuntuJammy() (bool, error) {
+func (app App) isUbuntuJammy(ctx context.Context) (bool, error) {
 	// LP: #1878225 - cloud-init status --wait appears to never resolve, as
 	// other things earlier in the chain aren't finalized.  Per the LP,
 	// there are problems having snapd seeded complete, and this is
@@ -152,7 +134,7 @@ func (app App) isUbuntuJammy() (bool, error) {
 	// in subsequent releases.  Only Jammy appears affected among the
 	// tested images.
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
 	out, err := app.lxcOutput(ctx, "lsb_release", "-a")
@@ -173,8 +155,8 @@ func (app App) isUbuntuJammy() (bool, error) {
 	return distrib == "Ubuntu" && release == "22.04", nil
 }
 
-func (app App) lp1878225Quirk() error {
-	affected, err := app.isUbuntuJammy()
+func (app App) lp1878225Quirk(ctx context.Context) error {
+	affected, err := app.isUbuntuJammy(ctx)
 	if err != nil {
 		return err
 	}
@@ -195,91 +177,227 @@ func (app App) lp1878225Quirk() error {
 	[ -e /run/dbus/system_bus_socket ]
 	`
 
-	if err := app.lxcExec("sh", "-c", script); err != nil {
+	if err := app.lxcExec(ctx, "sh", "-c", script); err != nil {
 		return fmt.Errorf("bus wait failure: %w", err)
 	}
 
 	// the actual workaround
-	if err := app.lxcExec("systemctl", "stop", "snapd.seeded.service"); err != nil {
+	if err := app.lxcExec(ctx, "systemctl", "stop", "snapd.seeded.service"); err != nil {
 		return fmt.Errorf("seeded stop failure: %w", err)
 	}
 
 	return nil
 }
 
-func (app App) Launch() error {
-	args := []string{"lxc", "launch", app.launchImage(), app.name()}
-	if app.Config.isVM() {
-		args = append(args, "--vm")
+// Delete removes the instance, stopping it first if needed.
+func (app App) Delete(ctx context.Context) error {
+	if err := run(ctx, "lxc", "delete", "--force", app.Name()); err != nil {
+		return fmt.Errorf("failed to delete instance: %w", err)
 	}
+	return nil
+}
 
-	cmd := command(args[0], args[1:]...)
-	slog.Debug("run", "command", args)
-	cmd.Stdout = os.Stdout
-	user := CurrentUserInfo()
-	cmd.Stdin = bytes.NewReader([]byte(app.Config.lxdLaunchConfig(user)))
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to create instance: %w", err)
+// sudoLogin runs the script as the user in a login shell.  sudo --login
+// passes the command to the login shell with most, but depending on the
+// version not all, special characters escaped.  So the script is passed
+// encoded, to be decoded by a snippet that has no characters in need of
+// escaping, and is then parsed just once.
+func (app App) sudoLogin(script string) []string {
+	encoded := base64.StdEncoding.EncodeToString([]byte(script))
+	return []string{
+		"sudo", "--login", "--user", "user",
+		"sh", "-c", "eval \"`echo " + encoded + " | base64 -d`\"",
 	}
+}
 
-	if err := app.Wait(); err != nil {
-		return fmt.Errorf("failed to wait for instance: %w", err)
+func (app App) autoLaunchMode() string {
+	if app.Opts.AutoLaunch != "" {
+		return app.Opts.AutoLaunch
 	}
+	return app.Config.AutoLaunch
+}
 
-	use_pty := []string{
-		"sh", "-c", "echo 'Defaults use_pty' > /etc/sudoers.d/use_pty",
-	}
-	if err := app.lxcExec(use_pty...); err != nil {
-		return fmt.Errorf("use_pty setup failure: %w", err)
+// autoLaunch launches a missing instance, as permitted by the AutoLaunch
+// setting.
+func (app App) autoLaunch(ctx context.Context, notFound error) error {
+	switch app.autoLaunchMode() {
+	case AutoLaunchTrue:
+	case AutoLaunchPrompt:
+		question := fmt.Sprintf("Instance %s does not exist, launch it now?", app.Name())
+		if !app.confirm(question) {
+			return fmt.Errorf("failed to start instance: %w", notFound)
+		}
+	default:
+		return fmt.Errorf(
+			"failed to start instance: %w, create it with --launch", notFound,
+		)
 	}
 
-	if err := app.lp1878225Quirk(); err != nil {
-		return fmt.Errorf("LP #1878225 workaround failure: %w", err)
+	unlock, err := app.lock(ctx, "launch")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// another process may have launched it while we waited
+	exists, err := app.Exists(ctx)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return app.startIfNeeded(ctx)
 	}
 
-	if err := app.lxcExec("cloud-init", "status", "--wait"); err != nil {
-		return fmt.Errorf("cloud-init failure: %w", err)
+	slog.Info("launching missing instance", "instance", app.Name())
+	if err := app.launch(ctx); err != nil {
+		return fmt.Errorf("failed to launch: %w", err)
 	}
 	return nil
 }
 
-func (app App) sudoLogin(script string) []string {
-	return []string{
-		"sudo", "--login", "--user", "user",
-		"sh", "-c", script,
+// enter starts the instance if needed, and waits for it to be ready for
+// a shell or command.  The instance must belong to the project, so that
+// that of another project is not even started.
+func (app App) enter(ctx context.Context) error {
+	err := app.checkOwner(ctx)
+	if err == nil {
+		err = app.StartIfNeeded(ctx)
+		if err != nil && !errors.Is(err, ErrInstanceNotFound) {
+			return fmt.Errorf("failed to start instance: %w", err)
+		}
+	}
+	switch {
+	case errors.Is(err, ErrInstanceNotFound):
+		if err := app.autoLaunch(ctx, err); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	default:
+		app.warnDrift(ctx)
+	}
+
+	if err := app.Wait(ctx); err != nil {
+		return fmt.Errorf("failed to wait for instance: %w", err)
+	}
+
+	if err := app.ensureWorkdir(ctx); err != nil {
+		return err
 	}
+	if err := app.ensurePorts(ctx); err != nil {
+		return err
+	}
+	app.warnStaleImage(ctx)
+	app.ensureIdleWatch()
+	return nil
 }
 
-func (app App) Shell() error {
-	if err := app.StartIfNeeded(); err != nil {
-		return fmt.Errorf("failed to start instance: %w", err)
+// commandScript changes to dest and starts the shell, or runs params if
+// any, after the exports.  Every value is quoted, so that the script is
+// safe to parse once.
+func commandScript(dest, exports string, params []string) string {
+	script := "cd " + shellescape.Quote(dest)
+	if exports != "" {
+		script = exports + " && " + script
+	}
+	if len(params) > 0 {
+		return script + " && exec " + shellescape.QuoteCommand(params)
 	}
+	return script + ` && exec "$SHELL"`
+}
 
-	if err := app.Wait(); err != nil {
-		return fmt.Errorf("failed to wait for instance: %w", err)
+// script is run as the user in the instance, starting the shell, or
+// running Params, in the directory matching the current one.
+func (app App) script() (string, error) {
+	exports, err := app.envScript()
+	if err != nil {
+		return "", err
 	}
 
-	// determine where we are relative to RootDir, then adjust that
-	// subdirectory against /project, and cd to that
-	dest := "/project"
 	wd, err := os.Getwd()
 	if err != nil {
-		return fmt.Errorf("getting working directory: %w", err)
+		return "", fmt.Errorf("getting working directory: %w", err)
+	}
+	return commandScript(app.guestDir(wd), exports, app.params()), nil
+}
+
+// Shell opens a shell in the instance, or runs Params.
+// Without a terminal on both stdin and stdout this is the same as Exec, as
+// it is when running Params with paths translated, so that paths in their
+// output can be translated back.
+func (app App) Shell(ctx context.Context) error {
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+		slog.Debug("no terminal, running without a pty")
+		return app.exec(ctx)
+	}
+	if app.translatePaths() && len(app.Opts.Params) > 0 {
+		slog.Debug("translating paths, running without a pty")
+		return app.exec(ctx)
+	}
+
+	release, err := app.markActive(ctx)
+	if err != nil {
+		return err
 	}
-	if after, found := strings.CutPrefix(wd, app.Config.RootDir); found {
-		dest = fmt.Sprintf("%s%s", dest, after)
+	defer release()
+	if err := app.enter(ctx); err != nil {
+		return err
 	}
+	script, err := app.script()
+	if err != nil {
+		return err
+	}
+	app.recordShell()
+	ctx, stop := userContext(ctx)
+	defer stop()
+	err = exitCode(app.lxcExec(ctx, app.sudoLogin(script)...))
+	app.recordExit(err)
+	if err != nil {
+		return fmt.Errorf("failed to lxc exec: %w", err)
+	}
+	return nil
+}
 
-	script := fmt.Sprintf(`cd "%s" && exec $SHELL`, dest)
-	if len(app.Opts.Params) > 0 {
-		script = fmt.Sprintf(
-			`%s -c "%s"`, script,
-			shellescape.QuoteCommand(app.Opts.Params),
-		)
+// Exec runs Params in the instance without a pty, so that stdout and
+// stderr are kept separate and stdin may be piped in.  If the command
+// fails, the error is an *ExitCodeError with its exit code.
+func (app App) Exec(ctx context.Context) error {
+	if len(app.Opts.Params) == 0 {
+		return errors.New("exec requires a command")
 	}
+	return app.exec(ctx)
+}
 
-	if err := app.lxcExec(app.sudoLogin(script)...); err != nil {
+func (app App) exec(ctx context.Context) error {
+	release, err := app.markActive(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := app.enter(ctx); err != nil {
+		return err
+	}
+	script, err := app.script()
+	if err != nil {
+		return err
+	}
+	args := append(
+		[]string{"lxc", "exec", app.Name(), "--mode", "non-interactive", "--"},
+		app.sudoLogin(script)...,
+	)
+	var stdout, stderr io.Writer = os.Stdout, os.Stderr
+	if app.translatePaths() {
+		outFilter := newPathFilter(stdout, app.mounts())
+		errFilter := newPathFilter(stderr, app.mounts())
+		defer outFilter.Close()
+		defer errFilter.Close()
+		stdout, stderr = outFilter, errFilter
+	}
+	app.recordShell()
+	ctx, stop := userContext(ctx)
+	defer stop()
+	err = exitCode(runTo(ctx, stdout, stderr, args...))
+	app.recordExit(err)
+	if err != nil {
 		return fmt.Errorf("failed to lxc exec: %w", err)
 	}
 	return nil
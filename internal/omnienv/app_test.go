@@ -2,11 +2,15 @@ package omnienv
 
 import (
 	"context"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
-	"time"
+	"unicode"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var nameTests = []struct {
@@ -42,7 +46,7 @@ func TestName(t *testing.T) {
 	for _, test := range nameTests {
 		app := App{Config: test.config, Opts: test.opts}
 		assert.Equal(t, test.system, app.system(), test.summary)
-		assert.Equal(t, test.name, app.name(), test.summary)
+		assert.Equal(t, test.name, app.Name(), test.summary)
 		assert.Equal(t, test.launchImage, app.launchImage(), test.summary)
 	}
 }
@@ -70,10 +74,10 @@ var startIfNeededTests = []struct {
 
 func TestStartIfNeeded(t *testing.T) {
 	for _, test := range startIfNeededTests {
-		restoreCmd := Patch(&command, func(_ string, _ ...string) *exec.Cmd {
+		restoreCmd := Patch(&commandContext, func(_ context.Context, _ string, _ ...string) *exec.Cmd {
 			return test.cmd
 		})
-		err := App{Config: Config{Label: "l", System: NewSystem("s")}}.StartIfNeeded()
+		err := App{Config: Config{Label: "l", System: NewSystem("s")}}.StartIfNeeded(context.Background())
 		restoreCmd()
 		if test.errMsg != "" {
 			assert.ErrorContains(t, err, test.errMsg, test.summary)
@@ -85,7 +89,7 @@ func TestStartIfNeeded(t *testing.T) {
 
 func TestStartIfNeededStopped(t *testing.T) {
 	callCount := 0
-	restoreCmd := Patch(&command, func(_ string, _ ...string) *exec.Cmd {
+	restoreCmd := Patch(&commandContext, func(_ context.Context, _ string, _ ...string) *exec.Cmd {
 		callCount++
 		if callCount == 1 {
 			return exec.Command("/bin/echo", "Status: STOPPED")
@@ -94,7 +98,7 @@ func TestStartIfNeededStopped(t *testing.T) {
 	})
 	defer restoreCmd()
 	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
-	assert.Nil(t, app.StartIfNeeded())
+	assert.Nil(t, app.StartIfNeeded(context.Background()))
 }
 
 var isVMTests = []struct {
@@ -122,10 +126,10 @@ var isVMTests = []struct {
 
 func TestIsVM(t *testing.T) {
 	for _, test := range isVMTests {
-		restoreCmd := Patch(&command, func(_ string, _ ...string) *exec.Cmd {
+		restoreCmd := Patch(&commandContext, func(_ context.Context, _ string, _ ...string) *exec.Cmd {
 			return test.cmd
 		})
-		vm, err := App{Config: Config{Label: "l", System: NewSystem("s")}}.isVM()
+		vm, err := App{Config: Config{Label: "l", System: NewSystem("s")}}.isVM(context.Background())
 		restoreCmd()
 		if test.errMsg != "" {
 			assert.ErrorContains(t, err, test.errMsg, test.summary)
@@ -136,95 +140,6 @@ func TestIsVM(t *testing.T) {
 	}
 }
 
-func TestWaitNotVM(t *testing.T) {
-	restoreCmd := Patch(&command, func(_ string, _ ...string) *exec.Cmd {
-		return exec.Command("/bin/echo", "Type: container")
-	})
-	defer restoreCmd()
-	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
-	assert.Nil(t, app.Wait())
-}
-
-func TestWaitVMExecOk(t *testing.T) {
-	callCount := 0
-	restoreCmd := Patch(&command, func(_ string, _ ...string) *exec.Cmd {
-		callCount++
-		if callCount == 1 {
-			return exec.Command("/bin/echo", "Type: virtual-machine")
-		}
-		return exec.Command("/bin/true")
-	})
-	defer restoreCmd()
-	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
-	assert.Nil(t, app.Wait())
-}
-
-func TestWaitVMExecFailsNonExitError(t *testing.T) {
-	callCount := 0
-	restoreCmd := Patch(&command, func(_ string, _ ...string) *exec.Cmd {
-		callCount++
-		if callCount == 1 {
-			return exec.Command("/bin/echo", "Type: virtual-machine")
-		}
-		return exec.Command("/nonexistent-binary")
-	})
-	defer restoreCmd()
-	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
-	err := app.Wait()
-	assert.Error(t, err)
-}
-
-func TestWaitVMStrangeExitCode(t *testing.T) {
-	callCount := 0
-	restoreCmd := Patch(&command, func(_ string, _ ...string) *exec.Cmd {
-		callCount++
-		if callCount == 1 {
-			return exec.Command("/bin/echo", "Type: virtual-machine")
-		}
-		return exec.Command("/bin/false")
-	})
-	defer restoreCmd()
-	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
-	err := app.Wait()
-	assert.ErrorContains(t, err, "strange exit code 1")
-}
-
-func TestWaitVMTimeout(t *testing.T) {
-	callCount := 0
-	restoreCmd := Patch(&command, func(_ string, _ ...string) *exec.Cmd {
-		callCount++
-		if callCount == 1 {
-			return exec.Command("/bin/echo", "Type: virtual-machine")
-		}
-		return exec.Command("/bin/sh", "-c", "exit 255")
-	})
-	defer restoreCmd()
-	restoreSleep := Patch(&timeSleep, func(_ time.Duration) {})
-	defer restoreSleep()
-	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
-	err := app.Wait()
-	assert.ErrorContains(t, err, "timed out waiting")
-}
-
-func TestWaitVMEventualSuccess(t *testing.T) {
-	callCount := 0
-	restoreCmd := Patch(&command, func(_ string, _ ...string) *exec.Cmd {
-		callCount++
-		if callCount == 1 {
-			return exec.Command("/bin/echo", "Type: virtual-machine")
-		}
-		if callCount < 5 {
-			return exec.Command("/bin/sh", "-c", "exit 255")
-		}
-		return exec.Command("/bin/true")
-	})
-	defer restoreCmd()
-	restoreSleep := Patch(&timeSleep, func(_ time.Duration) {})
-	defer restoreSleep()
-	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
-	assert.Nil(t, app.Wait())
-}
-
 var isUbuntuJammyTests = []struct {
 	summary string
 	cmd     *exec.Cmd
@@ -256,7 +171,7 @@ func TestIsUbuntuJammy(t *testing.T) {
 		restoreCmdCtx := Patch(&commandContext, func(_ context.Context, _ string, _ ...string) *exec.Cmd {
 			return test.cmd
 		})
-		jammy, err := App{Config: Config{Label: "l", System: NewSystem("s")}}.isUbuntuJammy()
+		jammy, err := App{Config: Config{Label: "l", System: NewSystem("s")}}.isUbuntuJammy(context.Background())
 		restoreCmdCtx()
 		assert.Nil(t, err, test.summary)
 		assert.Equal(t, test.want, jammy, test.summary)
@@ -264,219 +179,179 @@ func TestIsUbuntuJammy(t *testing.T) {
 }
 
 func TestShellContainerOk(t *testing.T) {
-	cmdCallCount := 0
-	restoreCmd := Patch(&command, func(_ string, _ ...string) *exec.Cmd {
-		cmdCallCount++
-		switch cmdCallCount {
-		case 1:
-			return exec.Command("/bin/echo", "Status: RUNNING") // StartIfNeeded
-		case 2:
-			return exec.Command("/bin/echo", "Type: container") // Wait → isVM
-		case 3:
-			return exec.Command("/bin/true") // lxcExec
-		default:
-			return exec.Command("/bin/true")
-		}
-	})
+	defer patchTerminal(true)()
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/true"),                    // checkOwner
+		exec.Command("/bin/echo", "Status: RUNNING"), // StartIfNeeded
+		exec.Command("/bin/true"),                    // warnDrift
+		exec.Command("/bin/echo", "Type: container"), // Wait → isVM
+		exec.Command("/bin/true"),                    // Wait → user probe
+		exec.Command("/bin/echo", "{}"),              // ensurePorts
+		exec.Command("/bin/true"),                    // lxcExec
+	)
 	defer restoreCmd()
 	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
-	assert.Nil(t, app.Shell())
+	assert.Nil(t, app.Shell(context.Background()))
+	assert.Len(t, *calls, 7)
 }
 
 func TestShellStartIfNeededFails(t *testing.T) {
-	restoreCmd := Patch(&command, func(_ string, _ ...string) *exec.Cmd {
-		return exec.Command("/bin/false")
-	})
+	defer patchTerminal(true)()
+	restoreCmd, _ := patchCommands(exec.Command("/bin/false"))
 	defer restoreCmd()
 	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
-	err := app.Shell()
+	err := app.Shell(context.Background())
 	assert.ErrorContains(t, err, "failed to start instance")
 }
 
 func TestShellWaitFails(t *testing.T) {
-	cmdCallCount := 0
-	restoreCmd := Patch(&command, func(_ string, _ ...string) *exec.Cmd {
-		cmdCallCount++
-		if cmdCallCount == 1 {
-			return exec.Command("/bin/echo", "Status: RUNNING") // StartIfNeeded
-		}
-		return exec.Command("/bin/false") // Wait → isVM
-	})
+	defer patchTerminal(true)()
+	restoreCmd, _ := patchCommands(
+		exec.Command("/bin/true"),                    // checkOwner
+		exec.Command("/bin/echo", "Status: RUNNING"), // StartIfNeeded
+		exec.Command("/bin/true"),                    // warnDrift
+		exec.Command("/bin/false"),                   // Wait → isVM
+	)
 	defer restoreCmd()
 	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
-	err := app.Shell()
+	err := app.Shell(context.Background())
 	assert.ErrorContains(t, err, "failed to wait for instance")
 }
 
-func TestShellLxcExecFails(t *testing.T) {
-	cmdCallCount := 0
-	restoreCmd := Patch(&command, func(_ string, _ ...string) *exec.Cmd {
-		cmdCallCount++
-		switch cmdCallCount {
-		case 1:
-			return exec.Command("/bin/echo", "Status: RUNNING") // StartIfNeeded
-		case 2:
-			return exec.Command("/bin/echo", "Type: container") // Wait → isVM
-		case 3:
-			return exec.Command("/bin/false") // lxcExec
-		default:
-			return exec.Command("/bin/true")
-		}
-	})
-	defer restoreCmd()
-	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
-	err := app.Shell()
-	assert.ErrorContains(t, err, "failed to lxc exec")
-}
-
-func TestLaunchContainerOk(t *testing.T) {
-	cmdCallCount := 0
-	restoreCmd := Patch(&command, func(_ string, _ ...string) *exec.Cmd {
-		cmdCallCount++
-		switch cmdCallCount {
-		case 1:
-			return exec.Command("/bin/true") // lxc launch
-		case 2:
-			return exec.Command("/bin/echo", "Type: container") // lxc info
-		case 3:
-			return exec.Command("/bin/true") // lxc exec use_pty
-		case 4:
-			return exec.Command("/bin/true") // lxc exec cloud-init
-		default:
-			return exec.Command("/bin/true")
-		}
-	})
-	defer restoreCmd()
+var autoLaunchTests = []struct {
+	summary string
+	config  string
+	opts    string
+	answer  bool
 
-	restoreCmdCtx := Patch(&commandContext, func(_ context.Context, _ string, _ ...string) *exec.Cmd {
-		return exec.Command("/bin/echo", "Debian")
-	})
-	defer restoreCmdCtx()
+	launched bool
+	errMsg   string
+}{{
+	summary: "default",
+	errMsg:  "instance not found, create it with --launch",
+}, {
+	summary: "config false",
+	config:  AutoLaunchFalse,
+	errMsg:  "instance not found, create it with --launch",
+}, {
+	summary:  "config true",
+	config:   AutoLaunchTrue,
+	launched: true,
+}, {
+	summary: "opts override config",
+	config:  AutoLaunchTrue,
+	opts:    AutoLaunchFalse,
+	errMsg:  "create it with --launch",
+}, {
+	summary: "prompt declined",
+	opts:    AutoLaunchPrompt,
+	answer:  false,
+	errMsg:  "failed to start instance: instance not found",
+}, {
+	summary:  "prompt accepted",
+	opts:     AutoLaunchPrompt,
+	answer:   true,
+	launched: true,
+}}
 
-	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
-	assert.Nil(t, app.Launch())
+func TestShellAutoLaunch(t *testing.T) {
+	defer patchTerminal(true)()
+	for _, test := range autoLaunchTests {
+		restoreCmd, calls := patchCommands(
+			exec.Command("/bin/false"), // StartIfNeeded → lxc info
+			exec.Command("/bin/true"),  // lxc list
+			exec.Command("/bin/true"),  // autoLaunch → lxc list
+			exec.Command("/bin/false"), // lxc launch
+		)
+		app := App{
+			Config:  Config{Label: "l", System: NewSystem("s"), AutoLaunch: test.config},
+			Opts:    Opts{AutoLaunch: test.opts},
+			Confirm: func(string) bool { return test.answer },
+		}
+		err := app.Shell(context.Background())
+		restoreCmd()
+		if test.launched {
+			assert.ErrorContains(t, err, "failed to launch: failed to create instance", test.summary)
+			require.Len(t, *calls, 5, test.summary)
+			assert.Equal(t, "launch", (*calls)[3][1], test.summary)
+		} else {
+			assert.ErrorIs(t, err, ErrInstanceNotFound, test.summary)
+			assert.ErrorContains(t, err, test.errMsg, test.summary)
+			assert.Len(t, *calls, 2, test.summary)
+		}
+	}
 }
 
-func TestLaunchLaunchFails(t *testing.T) {
-	restoreCmd := Patch(&command, func(_ string, _ ...string) *exec.Cmd {
-		return exec.Command("/bin/false")
-	})
+func TestShellAutoLaunchedElsewhere(t *testing.T) {
+	defer patchTerminal(true)()
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/false"),                   // StartIfNeeded → lxc info
+		exec.Command("/bin/true"),                    // lxc list
+		exec.Command("/bin/echo", "l-s"),             // autoLaunch → lxc list
+		exec.Command("/bin/echo", "Status: STOPPED"), // startIfNeeded
+		exec.Command("/bin/true"),                    // lxc start
+		exec.Command("/bin/echo", "Type: container"), // Wait → isVM
+		exec.Command("/bin/true"),                    // Wait → user probe
+		exec.Command("/bin/echo", "{}"),              // ensurePorts
+		exec.Command("/bin/true"),                    // lxc exec
+	)
 	defer restoreCmd()
-
-	restoreCmdCtx := Patch(&commandContext, func(_ context.Context, _ string, _ ...string) *exec.Cmd {
-		return exec.Command("/bin/echo", "Debian")
-	})
-	defer restoreCmdCtx()
-
-	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
-	err := app.Launch()
-	assert.ErrorContains(t, err, "failed to create instance")
+	app := App{Config: Config{
+		Label: "l", System: NewSystem("s"), AutoLaunch: AutoLaunchTrue,
+	}}
+	assert.Nil(t, app.Shell(context.Background()))
+	require.Len(t, *calls, 9)
+	assert.Equal(t, []string{"lxc", "start", "l-s"}, (*calls)[4])
 }
 
-func TestLaunchWaitFails(t *testing.T) {
-	cmdCallCount := 0
-	restoreCmd := Patch(&command, func(_ string, _ ...string) *exec.Cmd {
-		cmdCallCount++
-		if cmdCallCount == 1 {
-			return exec.Command("/bin/true") // lxc launch
-		}
-		return exec.Command("/bin/false") // lxc info
-	})
+func TestShellLxcExecFails(t *testing.T) {
+	defer patchTerminal(true)()
+	restoreCmd, _ := patchCommands(
+		exec.Command("/bin/true"),                    // checkOwner
+		exec.Command("/bin/echo", "Status: RUNNING"), // StartIfNeeded
+		exec.Command("/bin/true"),                    // warnDrift
+		exec.Command("/bin/echo", "Type: container"), // Wait → isVM
+		exec.Command("/bin/true"),                    // Wait → user probe
+		exec.Command("/bin/echo", "{}"),              // ensurePorts
+		exec.Command("/bin/false"),                   // lxcExec
+	)
 	defer restoreCmd()
-
-	restoreCmdCtx := Patch(&commandContext, func(_ context.Context, _ string, _ ...string) *exec.Cmd {
-		return exec.Command("/bin/echo", "Debian")
-	})
-	defer restoreCmdCtx()
-
 	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
-	err := app.Launch()
-	assert.ErrorContains(t, err, "failed to wait for instance")
+	err := app.Shell(context.Background())
+	assert.ErrorContains(t, err, "failed to lxc exec")
 }
 
-func TestLaunchUsePtyFails(t *testing.T) {
-	cmdCallCount := 0
-	restoreCmd := Patch(&command, func(_ string, _ ...string) *exec.Cmd {
-		cmdCallCount++
-		switch cmdCallCount {
-		case 1:
-			return exec.Command("/bin/true") // lxc launch
-		case 2:
-			return exec.Command("/bin/echo", "Type: container") // lxc info
-		case 3:
-			return exec.Command("/bin/false") // lxc exec use_pty
-		default:
-			return exec.Command("/bin/true")
-		}
-	})
+func TestShellCancelled(t *testing.T) {
+	defer patchTerminal(true)()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/true"),                    // checkOwner
+		exec.Command("/bin/echo", "Status: RUNNING"), // StartIfNeeded
+		exec.Command("/bin/true"),                    // warnDrift
+		exec.Command("/bin/echo", "Type: container"), // Wait → isVM
+		exec.Command("/bin/false"),                   // Wait → user probe
+	)
 	defer restoreCmd()
-
-	restoreCmdCtx := Patch(&commandContext, func(_ context.Context, _ string, _ ...string) *exec.Cmd {
-		return exec.Command("/bin/echo", "Debian")
-	})
-	defer restoreCmdCtx()
-
 	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
-	err := app.Launch()
-	assert.ErrorContains(t, err, "use_pty setup failure")
+	err := app.Shell(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Len(t, *calls, 5)
 }
 
-func TestLaunchCloudInitFails(t *testing.T) {
-	cmdCallCount := 0
-	restoreCmd := Patch(&command, func(_ string, _ ...string) *exec.Cmd {
-		cmdCallCount++
-		switch cmdCallCount {
-		case 1:
-			return exec.Command("/bin/true") // lxc launch
-		case 2:
-			return exec.Command("/bin/echo", "Type: container") // lxc info
-		case 3:
-			return exec.Command("/bin/true") // lxc exec use_pty
-		case 4:
-			return exec.Command("/bin/false") // lxc exec cloud-init
-		default:
-			return exec.Command("/bin/true")
-		}
-	})
+func TestDelete(t *testing.T) {
+	restoreCmd, calls := patchCommands(exec.Command("/bin/true"))
 	defer restoreCmd()
-
-	restoreCmdCtx := Patch(&commandContext, func(_ context.Context, _ string, _ ...string) *exec.Cmd {
-		return exec.Command("/bin/echo", "Debian")
-	})
-	defer restoreCmdCtx()
-
 	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
-	err := app.Launch()
-	assert.ErrorContains(t, err, "cloud-init failure")
+	assert.Nil(t, app.Delete(context.Background()))
+	assert.Equal(t, [][]string{{"lxc", "delete", "--force", "l-s"}}, *calls)
 }
 
-func TestLaunchQuirkFails(t *testing.T) {
-	restoreCmdCtx := Patch(&commandContext, func(_ context.Context, _ string, _ ...string) *exec.Cmd {
-		return exec.Command("/bin/printf", "Distributor ID: Ubuntu\nRelease: 22.04")
-	})
-	defer restoreCmdCtx()
-
-	cmdCallCount := 0
-	restoreCmd := Patch(&command, func(_ string, _ ...string) *exec.Cmd {
-		cmdCallCount++
-		switch cmdCallCount {
-		case 1:
-			return exec.Command("/bin/true") // lxc launch
-		case 2:
-			return exec.Command("/bin/echo", "Type: container") // lxc info
-		case 3:
-			return exec.Command("/bin/true") // lxc exec use_pty
-		case 4:
-			return exec.Command("/bin/false") // lxc exec bus wait (quirk)
-		default:
-			return exec.Command("/bin/true")
-		}
-	})
+func TestDeleteFails(t *testing.T) {
+	restoreCmd, _ := patchCommands(exec.Command("/bin/false"))
 	defer restoreCmd()
-
 	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
-	err := app.Launch()
-	assert.ErrorContains(t, err, "LP #1878225 workaround failure")
+	assert.ErrorContains(t, app.Delete(context.Background()), "failed to delete instance")
 }
 
 var sudoLoginTests = []struct {
@@ -486,15 +361,21 @@ var sudoLoginTests = []struct {
 
 	expected []string
 }{{
-	summary:  "simple shell",
-	script:   "echo hi",
-	app:      App{Config: Config{Label: "l", System: NewSystem("s")}},
-	expected: []string{"sudo", "--login", "--user", "user", "sh", "-c", "echo hi"},
+	summary: "simple shell",
+	script:  "echo hi",
+	app:     App{Config: Config{Label: "l", System: NewSystem("s")}},
+	expected: []string{
+		"sudo", "--login", "--user", "user",
+		"sh", "-c", "eval \"`echo ZWNobyBoaQ== | base64 -d`\"",
+	},
 }, {
-	summary:  "cd command",
-	script:   `cd "/project" && exec $SHELL`,
-	app:      App{Config: Config{Label: "l", System: NewSystem("s")}},
-	expected: []string{"sudo", "--login", "--user", "user", "sh", "-c", `cd "/project" && exec $SHELL`},
+	summary: "cd command",
+	script:  `cd '/project' && exec "$SHELL"`,
+	app:     App{Config: Config{Label: "l", System: NewSystem("s")}},
+	expected: []string{
+		"sudo", "--login", "--user", "user",
+		"sh", "-c", "eval \"`echo Y2QgJy9wcm9qZWN0JyAmJiBleGVjICIkU0hFTEwi | base64 -d`\"",
+	},
 }}
 
 func TestSudoLogin(t *testing.T) {
@@ -503,63 +384,174 @@ func TestSudoLogin(t *testing.T) {
 	}
 }
 
+// sudoEscape is how sudo --login passes a command to the login shell,
+// with a backslash before each character other than letters, digits, _,
+// - and, if not escapeDollar, $.
+func sudoEscape(args []string, escapeDollar bool) string {
+	var escaped []string
+	for _, arg := range args {
+		var b strings.Builder
+		for _, r := range arg {
+			special := !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '-'
+			if special && (r != '$' || escapeDollar) {
+				b.WriteRune('\\')
+			}
+			b.WriteRune(r)
+		}
+		escaped = append(escaped, b.String())
+	}
+	return strings.Join(escaped, " ")
+}
+
+var hostileArgs = []string{
+	"", " ", "a b", "\t", "a\nb", `"`, `'`, `\`, `\n`, "`id`", "$(id)",
+	"$HOME", "${HOME}", "$", "*", "?", "[a]", "~", "~user", "-n", "-e",
+	"--", "%s", "!x", ";exit 1", "&& false", "| cat", "> x", "< x", "#",
+	`'"'"'`, `"$@"`, "é ünicode", "\x01 and \x7f",
+}
+
+var hostileDirs = []string{
+	"plain", "with space", `dq"uote`, "sq'uote", "$dollar", "`tick`",
+	"back\\slash", "new\nline", "-dash", "*star",
+}
+
+func TestCommandScriptExact(t *testing.T) {
+	// print the directory, an exported variable, then each argument,
+	// separated by NUL
+	printer := []string{"sh", "-c", `printf '%s\0' "$PWD" "$OE_V" "$@"`, "sh"}
+	env := App{Config: Config{Env: map[string]string{"OE_V": "$v `v` 'v' \"v\""}}}
+	exports, err := env.envScript()
+	assert.Nil(t, err)
+
+	for _, name := range hostileDirs {
+		dest := filepath.Join(t.TempDir(), name)
+		assert.Nil(t, os.Mkdir(dest, 0750), name)
+		script := commandScript(dest, exports, append(printer, hostileArgs...))
+		argv := App{}.sudoLogin(script)[4:]
+		assert.NotContains(t, strings.Join(argv, " "), "$", name)
+
+		for _, escapeDollar := range []bool{false, true} {
+			out, err := exec.Command("sh", "-c", sudoEscape(argv, escapeDollar)).Output()
+			assert.Nil(t, err, name)
+			got := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+			want := append([]string{dest, env.Config.Env["OE_V"]}, hostileArgs...)
+			assert.Equal(t, want, got, name)
+		}
+	}
+}
+
 func TestLp1878225QuirkNotJammy(t *testing.T) {
-	restoreCmdCtx := Patch(&commandContext, func(_ context.Context, _ string, _ ...string) *exec.Cmd {
-		return exec.Command("/bin/echo", "Debian")
-	})
-	defer restoreCmdCtx()
+	restoreCmd, _ := patchCommands(exec.Command("/bin/echo", "Debian"))
+	defer restoreCmd()
 	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
-	assert.Nil(t, app.lp1878225Quirk())
+	assert.Nil(t, app.lp1878225Quirk(context.Background()))
 }
 
 func TestLp1878225QuirkBusWaitFails(t *testing.T) {
-	restoreCmdCtx := Patch(&commandContext, func(_ context.Context, _ string, _ ...string) *exec.Cmd {
-		return exec.Command("/bin/printf", "Distributor ID: Ubuntu\nRelease: 22.04")
-	})
-	defer restoreCmdCtx()
-
-	restoreCmd := Patch(&command, func(_ string, _ ...string) *exec.Cmd {
-		return exec.Command("/bin/false")
-	})
+	restoreCmd, _ := patchCommands(
+		exec.Command("/bin/printf", "Distributor ID: Ubuntu\nRelease: 22.04"),
+		exec.Command("/bin/false"),
+	)
 	defer restoreCmd()
 
 	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
-	err := app.lp1878225Quirk()
+	err := app.lp1878225Quirk(context.Background())
 	assert.ErrorContains(t, err, "bus wait failure")
 }
 
 func TestLp1878225QuirkSeededStopFails(t *testing.T) {
-	restoreCmdCtx := Patch(&commandContext, func(_ context.Context, _ string, _ ...string) *exec.Cmd {
-		return exec.Command("/bin/printf", "Distributor ID: Ubuntu\nRelease: 22.04")
-	})
-	defer restoreCmdCtx()
-
-	cmdCallCount := 0
-	restoreCmd := Patch(&command, func(_ string, _ ...string) *exec.Cmd {
-		cmdCallCount++
-		if cmdCallCount == 1 {
-			return exec.Command("/bin/true")
-		}
-		return exec.Command("/bin/false")
-	})
+	restoreCmd, _ := patchCommands(
+		exec.Command("/bin/printf", "Distributor ID: Ubuntu\nRelease: 22.04"),
+		exec.Command("/bin/true"),
+		exec.Command("/bin/false"),
+	)
 	defer restoreCmd()
 
 	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
-	err := app.lp1878225Quirk()
+	err := app.lp1878225Quirk(context.Background())
 	assert.ErrorContains(t, err, "seeded stop failure")
 }
 
 func TestLp1878225QuirkJammyOk(t *testing.T) {
-	restoreCmdCtx := Patch(&commandContext, func(_ context.Context, _ string, _ ...string) *exec.Cmd {
-		return exec.Command("/bin/printf", "Distributor ID: Ubuntu\nRelease: 22.04")
-	})
-	defer restoreCmdCtx()
+	restoreCmd, _ := patchCommands(
+		exec.Command("/bin/printf", "Distributor ID: Ubuntu\nRelease: 22.04"),
+	)
+	defer restoreCmd()
 
-	restoreCmd := Patch(&command, func(_ string, _ ...string) *exec.Cmd {
-		return exec.Command("/bin/true")
-	})
+	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+	assert.Nil(t, app.lp1878225Quirk(context.Background()))
+}
+
+func TestShellNoTerminal(t *testing.T) {
+	defer patchTerminal(false)()
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/true"),                    // checkOwner
+		exec.Command("/bin/echo", "Status: RUNNING"), // StartIfNeeded
+		exec.Command("/bin/true"),                    // warnDrift
+		exec.Command("/bin/echo", "Type: container"), // Wait → isVM
+		exec.Command("/bin/true"),                    // Wait → user probe
+		exec.Command("/bin/echo", "{}"),              // ensurePorts
+		exec.Command("/bin/true"),                    // lxc exec
+	)
+	defer restoreCmd()
+	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+	assert.Nil(t, app.Shell(context.Background()))
+	require.Len(t, *calls, 7)
+	assert.Equal(t,
+		[]string{"lxc", "exec", "l-s", "--mode", "non-interactive", "--"},
+		(*calls)[6][:6],
+	)
+}
+
+func TestShellTranslatePaths(t *testing.T) {
+	defer patchTerminal(true)()
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/true"),                    // checkOwner
+		exec.Command("/bin/echo", "Status: RUNNING"), // StartIfNeeded
+		exec.Command("/bin/true"),                    // warnDrift
+		exec.Command("/bin/echo", "Type: container"), // Wait → isVM
+		exec.Command("/bin/true"),                    // Wait → user probe
+		exec.Command("/bin/echo", "{}"),              // ensurePorts
+		exec.Command("/bin/true"),                    // lxc exec
+	)
 	defer restoreCmd()
+	app := App{
+		Config: Config{Label: "l", System: NewSystem("s")},
+		Opts:   Opts{Params: []string{"make"}, TranslatePaths: true},
+	}
+	assert.Nil(t, app.Shell(context.Background()))
+	require.Len(t, *calls, 7)
+	assert.Equal(t, "non-interactive", (*calls)[6][4])
+}
 
+func TestExec(t *testing.T) {
+	defer patchTerminal(true)()
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/true"),                    // checkOwner
+		exec.Command("/bin/echo", "Status: RUNNING"), // StartIfNeeded
+		exec.Command("/bin/true"),                    // warnDrift
+		exec.Command("/bin/echo", "Type: container"), // Wait → isVM
+		exec.Command("/bin/true"),                    // Wait → user probe
+		exec.Command("/bin/echo", "{}"),              // ensurePorts
+		exec.Command("sh", "-c", "exit 42"),          // lxc exec
+	)
+	defer restoreCmd()
+	app := App{
+		Config: Config{Label: "l", System: NewSystem("s")},
+		Opts:   Opts{Params: []string{"false"}},
+	}
+	err := app.Exec(context.Background())
+	var exitErr *ExitCodeError
+	require.ErrorAs(t, err, &exitErr)
+	assert.Equal(t, 42, exitErr.Code)
+	require.Len(t, *calls, 7)
+	assert.Equal(t, "non-interactive", (*calls)[6][4])
+}
+
+func TestExecNoCommand(t *testing.T) {
+	restoreCmd, calls := patchCommands()
+	defer restoreCmd()
 	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
-	assert.Nil(t, app.lp1878225Quirk())
+	assert.ErrorContains(t, app.Exec(context.Background()), "exec requires a command")
+	assert.Empty(t, *calls)
 }
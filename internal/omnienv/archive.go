@@ -0,0 +1,314 @@
+package omnienv
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// An exported environment is a plain tar archive holding the manifest
+// followed by the LXD backup of the instance, which is already zstd
+// compressed.
+const (
+	manifestEntry = "manifest.yaml"
+	instanceEntry = "instance.tar.zst"
+)
+
+// metaKeys are the instance metadata carried in the manifest.
+var metaKeys = []string{imageKey, launchStepKey, rootDirKey}
+
+// Manifest describes an exported environment: the resolved config it was
+// created with, and the omnienv metadata recorded on the instance.
+type Manifest struct {
+	Instance string
+	// Config has the system and image the instance was created with, and
+	// the directory of the project it was exported from.
+	Config   Config
+	Snapshot string `yaml:",omitempty"`
+	Meta     map[string]string
+}
+
+func (app App) manifest(ctx context.Context, snapshot string) (Manifest, error) {
+	cfg := app.Config
+	cfg.System = System{Name: app.system(), Image: app.launchImage()}
+	cfg.RootDir = cfg.projectDir()
+	manifest := Manifest{
+		Instance: app.Name(),
+		Config:   cfg,
+		Snapshot: snapshot,
+		Meta:     map[string]string{},
+	}
+	for _, key := range metaKeys {
+		value, err := app.getMeta(ctx, key)
+		if err != nil {
+			return Manifest{}, err
+		}
+		if value != "" {
+			manifest.Meta[key] = value
+		}
+	}
+	// the image the instance was actually created from
+	if image := manifest.Meta[imageKey]; image != "" {
+		manifest.Config.System.Image = image
+	}
+	return manifest, nil
+}
+
+// exportSource copies the snapshot, if any, to a temporary instance as LXD
+// exports whole instances only.  The returned func deletes that copy.
+func (app App) exportSource(ctx context.Context, snapshot string) (string, func(), error) {
+	if snapshot == "" {
+		return app.Name(), func() {}, nil
+	}
+
+	source := buildName(app.Name(), "export")
+	err := runQuiet(
+		ctx, "lxc", "copy", app.Name()+"/"+snapshot, source, "--instance-only",
+	)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to copy snapshot: %w", err)
+	}
+	cleanup := func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+		defer cancel()
+		if err := runQuiet(ctx, "lxc", "delete", "--force", source); err != nil {
+			slog.Warn("failed to delete temporary instance", "instance", source, "error", err)
+		}
+	}
+	return source, cleanup, nil
+}
+
+func writeArchive(path string, manifest Manifest, backup string) (err error) {
+	data, err := yaml.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(backup) //gosec:disable G304
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(path) //gosec:disable G304
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	tw := tar.NewWriter(out)
+	now := timeNow()
+	header := &tar.Header{
+		Name: manifestEntry, Mode: 0644, Size: int64(len(data)), ModTime: now,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+	header = &tar.Header{
+		Name: instanceEntry, Mode: 0644, Size: info.Size(), ModTime: now,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, in); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// Export writes the instance, or one of its snapshots, as directed by
+// Opts.Export, to an archive that Import can recreate it from.
+func (app App) Export(ctx context.Context) error {
+	opts := app.Opts.Export
+	if err := app.checkOwner(ctx); err != nil {
+		return err
+	}
+	snapshot := ""
+	if opts.Snapshot != "" {
+		var err error
+		if snapshot, err = app.existingSnapshot(ctx, opts.Snapshot); err != nil {
+			return err
+		}
+	}
+
+	manifest, err := app.manifest(ctx, snapshot)
+	if err != nil {
+		return err
+	}
+
+	// stage the backup next to the output, as it may be too large for /tmp
+	output, err := filepath.Abs(opts.Output)
+	if err != nil {
+		return err
+	}
+	staging, err := os.MkdirTemp(filepath.Dir(output), ".oe-export-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	source, cleanup, err := app.exportSource(ctx, snapshot)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	backup := filepath.Join(staging, instanceEntry)
+	if err := app.backend().ExportInstance(ctx, source, backup); err != nil {
+		return fmt.Errorf("failed to export instance: %w", err)
+	}
+	if err := writeArchive(output, manifest, backup); err != nil {
+		return fmt.Errorf("failed to write %s: %w", opts.Output, err)
+	}
+	return nil
+}
+
+// readArchive returns the manifest of the archive at path, and writes the
+// instance backup it holds to backup.
+func readArchive(path, backup string) (Manifest, error) {
+	in, err := os.Open(path) //gosec:disable G304
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer in.Close()
+
+	var manifest *Manifest
+	found := false
+	tr := tar.NewReader(in)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return Manifest{}, err
+		}
+
+		switch header.Name {
+		case manifestEntry:
+			manifest = &Manifest{}
+			if err := yaml.NewDecoder(tr).Decode(manifest); err != nil {
+				return Manifest{}, fmt.Errorf("invalid manifest: %w", err)
+			}
+		case instanceEntry:
+			out, err := os.Create(backup) //gosec:disable G304
+			if err != nil {
+				return Manifest{}, err
+			}
+			_, err = io.Copy(out, tr)
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return Manifest{}, err
+			}
+			found = true
+		}
+	}
+
+	if manifest == nil || !found {
+		return Manifest{}, errors.New("not an omnienv archive")
+	}
+	return *manifest, nil
+}
+
+// Import recreates the environment in the archive at path as the instance
+// of this project, with the workdir mount pointed at RootDir, the current
+// user mapped in and the forwarded ports of the exporter dropped, and
+// returns the name of the instance.
+func (app App) Import(ctx context.Context, path string) (string, error) {
+	exists, err := app.Exists(ctx)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return "", fmt.Errorf("instance %s already exists", app.Name())
+	}
+
+	staging, err := os.MkdirTemp("", "oe-import-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(staging)
+
+	backup := filepath.Join(staging, instanceEntry)
+	manifest, err := readArchive(path, backup)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	slog.Debug("import", "manifest", manifest)
+	if manifest.Config.System.Name != app.system() {
+		slog.Warn(
+			"archive is of a different system",
+			"archive", manifest.Config.System.Name, "config", app.system(),
+		)
+	}
+	if manifest.Config.Virtualization != app.Config.Virtualization {
+		slog.Warn(
+			"archive is of a different virtualization",
+			"archive", manifest.Config.Virtualization, "config", app.Config.Virtualization,
+		)
+	}
+
+	if err := app.backend().ImportInstance(ctx, backup, app.Name()); err != nil {
+		return "", fmt.Errorf("failed to import instance: %w", err)
+	}
+	// the host ports stay with the exporter, this project forwards its own
+	if err := app.removeForwarding(ctx); err != nil {
+		return "", err
+	}
+
+	err = runQuiet(
+		ctx, "lxc", "config", "device", "set", app.Name(), "workdir",
+		"source="+app.Config.RootDir,
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to update workdir: %w", err)
+	}
+	err = runQuiet(
+		ctx, "lxc", "config", "set", app.Name(),
+		"raw.idmap="+CurrentUserInfo().idmap(),
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to update idmap: %w", err)
+	}
+	// the metadata of the exported instance carries over, but for the
+	// project directory, which is this project's
+	meta := maps.Clone(manifest.Meta)
+	delete(meta, rootDirKey)
+	if len(meta) > 0 {
+		if err := app.setMetas(ctx, meta); err != nil {
+			return "", err
+		}
+	}
+	// the instance runs the image it was exported from
+	if manifest.Config.System.Image != "" {
+		app.Config.System.Image = manifest.Config.System.Image
+	}
+	if err := app.recordConfig(ctx); err != nil {
+		return "", err
+	}
+	return app.Name(), nil
+}
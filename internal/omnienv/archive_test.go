@@ -0,0 +1,204 @@
+package omnienv
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+// tarEntries lists the names of the entries of the tar archive.
+func tarEntries(t *testing.T, path string) []string {
+	in, err := os.Open(path)
+	assert.Nil(t, err)
+	defer in.Close()
+	var names []string
+	tr := tar.NewReader(in)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, header.Name)
+	}
+	return names
+}
+
+func TestExportImport(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "env.tar")
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/echo", "/src/l"),         // checkOwner
+		exec.Command("/bin/echo", "ubuntu-daily:s"), // get image
+		exec.Command("/bin/echo", "done"),           // get launch-step
+		exec.Command("/bin/echo", "/src/l"),         // get root-dir
+	)
+	fake := &fakeBackend{}
+	app := testApp(fake)
+	app.Opts.Export.Output = output
+	err := app.Export(context.Background())
+	restoreCmd()
+	assert.Nil(t, err)
+	assert.Len(t, *calls, 4)
+	assert.Equal(t, []string{"export l-s"}, fake.calls)
+	assert.Equal(t, []string{manifestEntry, instanceEntry}, tarEntries(t, output))
+	// the staging directory is cleaned up
+	entries, err := os.ReadDir(filepath.Dir(output))
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+
+	restoreCmd, calls = patchCommands(
+		exec.Command("/bin/true"), // lxc list
+		exec.Command("/bin/true"), // workdir
+		exec.Command("/bin/true"), // idmap
+		exec.Command("/bin/true"), // metadata
+		exec.Command("/bin/true"), // record root-dir and config
+	)
+	// the exporter's forwarded ports came along
+	importer := &fakeBackend{devices: map[string]Port{
+		"oe-port-tcp-8080": {Host: 8080, Guest: 8080, Proto: "tcp"},
+	}}
+	app = App{
+		Config: Config{
+			Label: "c", System: NewSystem("s"), RootDir: "/home/c/l",
+			Virtualization: "container",
+		},
+		Backend: importer,
+	}
+	name, err := app.Import(context.Background(), output)
+	restoreCmd()
+	assert.Nil(t, err)
+	assert.Equal(t, "c-s", name)
+	assert.Equal(t, []string{
+		"import c-s", "devices c-s", "remove c-s oe-port-tcp-8080", "devices c-s",
+	}, importer.calls)
+	assert.Empty(t, importer.devices)
+	assert.Equal(t, "backup of l-s", importer.imported)
+	user := CurrentUserInfo()
+	require.Len(t, *calls, 5)
+	assert.Equal(t, [][]string{
+		{"lxc", "list", "--format", "csv", "--columns", "n", "^c-s$"},
+		{"lxc", "config", "device", "set", "c-s", "workdir", "source=/home/c/l"},
+		{"lxc", "config", "set", "c-s", fmt.Sprintf(
+			"raw.idmap=uid %d 1000\ngid %d 1000", user.UID, user.GID,
+		)},
+		{"lxc", "config", "set", "c-s",
+			"user.omnienv.image=ubuntu-daily:s", "user.omnienv.launch-step=done"},
+	}, (*calls)[:4])
+
+	// recorded as launched for this project, so that shells do not warn
+	// of the changed mount and idmap
+	app.Config.System.Image = "ubuntu-daily:s"
+	launched, err := yaml.Marshal(app.launchedConfig())
+	assert.Nil(t, err)
+	hash, err := app.configHash()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"lxc", "config", "set", "c-s",
+		"user.omnienv.config=" + string(launched),
+		"user.omnienv.config-hash=" + hash,
+		"user.omnienv.root-dir=/home/c/l",
+	}, (*calls)[4])
+}
+
+func TestReadArchiveManifest(t *testing.T) {
+	dir := t.TempDir()
+	backup := filepath.Join(dir, "backup")
+	assert.Nil(t, os.WriteFile(backup, []byte("data"), 0600))
+	manifest := Manifest{
+		Instance: "l-s",
+		Config: Config{
+			Label: "l", System: System{Name: "s", Image: "ubuntu:s"},
+			RootDir: "/src/l", Virtualization: "vm",
+			Ports:   []Port{{Host: 8080, Guest: 80, Proto: "tcp"}},
+			Env:     map[string]string{"CI": "true"},
+			PassEnv: []string{"GOFLAGS"},
+			Ready: Ready{Timeout: time.Minute, Probes: []Probe{
+				{Kind: "user"}, {Kind: "command", Command: "true"}, {Kind: "port", Port: 22},
+			}},
+		},
+		Snapshot: "omnienv-base",
+		Meta:     map[string]string{"image": "ubuntu:s"},
+	}
+	archive := filepath.Join(dir, "env.tar")
+	assert.Nil(t, writeArchive(archive, manifest, backup))
+
+	read, err := readArchive(archive, filepath.Join(dir, "extracted"))
+	assert.Nil(t, err)
+	assert.Equal(t, manifest, read)
+	data, err := os.ReadFile(filepath.Join(dir, "extracted"))
+	assert.Nil(t, err)
+	assert.Equal(t, "data", string(data))
+}
+
+func TestReadArchiveInvalid(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "empty.tar")
+	out, err := os.Create(archive)
+	assert.Nil(t, err)
+	assert.Nil(t, tar.NewWriter(out).Close())
+	assert.Nil(t, out.Close())
+
+	_, err = readArchive(archive, filepath.Join(dir, "extracted"))
+	assert.ErrorContains(t, err, "not an omnienv archive")
+}
+
+func TestExportSnapshot(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "env.tar")
+	restoreCmd, calls := patchCommands()
+	fake := &fakeBackend{snapshots: []Snapshot{{Name: "omnienv-base"}}}
+	app := testApp(fake)
+	app.Opts.Export.Output = output
+	app.Opts.Export.Snapshot = "base"
+	err := app.Export(context.Background())
+	restoreCmd()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"list l-s", "export l-s-export"}, fake.calls)
+	require.Len(t, *calls, 6)
+	assert.Equal(t, []string{
+		"lxc", "copy", "l-s/omnienv-base", "l-s-export", "--instance-only",
+	}, (*calls)[4])
+	assert.Equal(t, []string{"lxc", "delete", "--force", "l-s-export"}, (*calls)[5])
+}
+
+func TestExportFails(t *testing.T) {
+	dir := t.TempDir()
+	restoreCmd, _ := patchCommands()
+	fake := &fakeBackend{err: errors.New("boom")}
+	app := testApp(fake)
+	app.Opts.Export.Output = filepath.Join(dir, "env.tar")
+	err := app.Export(context.Background())
+	restoreCmd()
+	assert.ErrorContains(t, err, "failed to export instance: boom")
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestExportMissingSnapshot(t *testing.T) {
+	restoreCmd, _ := patchCommands()
+	defer restoreCmd()
+	fake := &fakeBackend{}
+	app := testApp(fake)
+	app.Opts.Export.Output = filepath.Join(t.TempDir(), "env.tar")
+	app.Opts.Export.Snapshot = "nope"
+	err := app.Export(context.Background())
+	assert.ErrorIs(t, err, ErrSnapshotNotFound)
+}
+
+func TestImportExists(t *testing.T) {
+	restoreCmd, _ := patchCommands(exec.Command("/bin/echo", "l-s"))
+	defer restoreCmd()
+	fake := &fakeBackend{}
+	_, err := testApp(fake).Import(context.Background(), "env.tar")
+	assert.ErrorContains(t, err, "instance l-s already exists")
+	assert.Empty(t, fake.calls)
+}
@@ -0,0 +1,72 @@
+package omnienv
+
+import (
+	"context"
+	"time"
+)
+
+// Snapshot is a point in time copy of an instance.
+type Snapshot struct {
+	Name    string
+	Created time.Time
+}
+
+// Image is an image in the local image store.
+type Image struct {
+	Fingerprint string
+	Aliases     []string
+	Properties  map[string]string
+	Created     time.Time
+}
+
+// Instance is an instance known to the backend, with its config keys.
+type Instance struct {
+	Name string
+	// Type is "container" or "virtual-machine".
+	Type   string
+	Config map[string]string
+}
+
+func (instance Instance) isVM() bool {
+	return instance.Type == "virtual-machine"
+}
+
+// Backend performs instance operations that App does not drive through
+// the lxc client directly.  Only lxd is implemented.
+type Backend interface {
+	CreateSnapshot(ctx context.Context, instance, snapshot string) error
+	ListSnapshots(ctx context.Context, instance string) ([]Snapshot, error)
+	RestoreSnapshot(ctx context.Context, instance, snapshot string) error
+	DeleteSnapshot(ctx context.Context, instance, snapshot string) error
+	// ExportInstance writes a backup of the instance, without its
+	// snapshots, to the file at path.
+	ExportInstance(ctx context.Context, instance, path string) error
+	// ImportInstance creates the instance from a backup written by
+	// ExportInstance.
+	ImportInstance(ctx context.Context, path, instance string) error
+	// PublishImage creates a local image from the stopped instance,
+	// replacing any image already using the alias.
+	PublishImage(ctx context.Context, instance, alias string, properties map[string]string) error
+	ListImages(ctx context.Context) ([]Image, error)
+	// GetImage describes the image in the local image store.
+	GetImage(ctx context.Context, fingerprint string) (Image, error)
+	// PullImage copies a remote image to the local image store.
+	PullImage(ctx context.Context, image string, vm bool) error
+	// RemoteFingerprint is the fingerprint the image currently resolves
+	// to on its remote, for VMs if vm is set, otherwise for containers.
+	RemoteFingerprint(ctx context.Context, image string, vm bool) (string, error)
+	ListInstances(ctx context.Context) ([]Instance, error)
+	// ProxyDevices returns the port forwarding devices of the instance,
+	// by device name.
+	ProxyDevices(ctx context.Context, instance string) (map[string]Port, error)
+	// AddProxyDevice forwards the port from localhost on the host.
+	AddProxyDevice(ctx context.Context, instance, device string, port Port) error
+	RemoveDevice(ctx context.Context, instance, device string) error
+}
+
+func (app App) backend() Backend {
+	if app.Backend == nil {
+		return lxd{}
+	}
+	return app.Backend
+}
@@ -0,0 +1,117 @@
+package omnienv
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The project directory an instance was created for is recorded in
+// instance metadata under this key.
+const rootDirKey = "root-dir"
+
+// cloneTarget is the App for the environment Clone would create.
+func (app App) cloneTarget() (App, error) {
+	opts := app.Opts.Clone
+	target := App{Config: app.Config, Backend: app.Backend, Confirm: app.Confirm}
+	target.Config.System.Name = app.system()
+
+	if opts.ToLabel != "" {
+		target.Config.Label = opts.ToLabel
+	}
+	if opts.ToSystem != "" {
+		target.Config.System = NewSystem(opts.ToSystem)
+	}
+	if opts.ToDir != "" {
+		dir, err := filepath.Abs(opts.ToDir)
+		if err != nil {
+			return App{}, err
+		}
+		info, err := os.Stat(dir)
+		if err != nil {
+			return App{}, err
+		}
+		if !info.IsDir() {
+			return App{}, fmt.Errorf("%s is not a directory", dir)
+		}
+		target.Config.RootDir = dir
+		target.Config.mainDir = ""
+	}
+
+	if target.Name() == app.Name() {
+		return App{}, fmt.Errorf(
+			"clone of %s needs a different label or system", app.Name(),
+		)
+	}
+	return target, nil
+}
+
+// Clone copies the instance, or one of its snapshots, to a new instance as
+// directed by Opts.Clone, and returns the name of the copy.  The copy
+// keeps the operating system of the original, even if given a different
+// system name.
+func (app App) Clone(ctx context.Context) (string, error) {
+	target, err := app.cloneTarget()
+	if err != nil {
+		return "", err
+	}
+	if err := app.checkOwner(ctx); err != nil {
+		return "", err
+	}
+
+	source := app.Name()
+	if app.Opts.Clone.Snapshot != "" {
+		snapshot, err := app.existingSnapshot(ctx, app.Opts.Clone.Snapshot)
+		if err != nil {
+			return "", err
+		}
+		source += "/" + snapshot
+	}
+
+	exists, err := target.Exists(ctx)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return "", fmt.Errorf("instance %s already exists", target.Name())
+	}
+
+	if err := runQuiet(ctx, "lxc", "copy", source, target.Name()); err != nil {
+		return "", fmt.Errorf("failed to copy instance: %w", err)
+	}
+	// the host ports stay with the original, the copy forwards its own
+	// configured ports on its first shell
+	if err := target.removeForwarding(ctx); err != nil {
+		return "", err
+	}
+
+	if target.Config.RootDir != app.Config.RootDir {
+		err := runQuiet(
+			ctx, "lxc", "config", "device", "set", target.Name(), "workdir",
+			"source="+target.Config.RootDir,
+		)
+		if err != nil {
+			return "", fmt.Errorf("failed to update workdir: %w", err)
+		}
+	}
+
+	// the copy runs the image of the original, whatever its system name
+	image, err := target.getMeta(ctx, imageKey)
+	if err != nil {
+		return "", err
+	}
+	if image == "" {
+		// launched by an older version, which did not record it
+		image = app.launchImage()
+		if err := target.setMeta(ctx, imageKey, image); err != nil {
+			return "", err
+		}
+	}
+	target.Config.System.Image = image
+
+	if err := target.recordConfig(ctx); err != nil {
+		return "", err
+	}
+	return target.Name(), nil
+}
@@ -0,0 +1,246 @@
+package omnienv
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloneTarget(t *testing.T) {
+	tempdir := t.TempDir()
+
+	app := testApp(&fakeBackend{})
+	app.Opts.Clone = CloneOpts{ToLabel: "wt2", ToDir: tempdir}
+	target, err := app.cloneTarget()
+	assert.Nil(t, err)
+	assert.Equal(t, "wt2-s", target.Name())
+	assert.Equal(t, tempdir, target.Config.RootDir)
+
+	app.Opts.Clone = CloneOpts{ToSystem: "noble"}
+	target, err = app.cloneTarget()
+	assert.Nil(t, err)
+	assert.Equal(t, "l-noble", target.Name())
+	assert.Equal(t, "/src/l", target.Config.RootDir)
+}
+
+func TestCloneTargetSystemOverride(t *testing.T) {
+	app := testApp(&fakeBackend{})
+	app.Opts.Clone = CloneOpts{ToLabel: "x"}
+	app.Opts.System = "jammy"
+	target, err := app.cloneTarget()
+	assert.Nil(t, err)
+	assert.Equal(t, "x-jammy", target.Name())
+}
+
+var cloneTargetErrorTests = []struct {
+	summary string
+	opts    CloneOpts
+	errMsg  string
+}{{
+	summary: "same name",
+	opts:    CloneOpts{ToLabel: "l"},
+	errMsg:  "clone of l-s needs a different label or system",
+}, {
+	summary: "missing dir",
+	opts:    CloneOpts{ToLabel: "x", ToDir: "/nonexistent/dir"},
+	errMsg:  "no such file or directory",
+}, {
+	summary: "not a dir",
+	opts:    CloneOpts{ToLabel: "x", ToDir: "/etc/hostname"},
+	errMsg:  "is not a directory",
+}}
+
+func TestCloneTargetErrors(t *testing.T) {
+	for _, test := range cloneTargetErrorTests {
+		app := testApp(&fakeBackend{})
+		app.Opts.Clone = test.opts
+		_, err := app.cloneTarget()
+		assert.ErrorContains(t, err, test.errMsg, test.summary)
+	}
+}
+
+func TestClone(t *testing.T) {
+	tempdir := t.TempDir()
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/true"),                   // checkOwner
+		exec.Command("/bin/true"),                   // lxc list
+		exec.Command("/bin/true"),                   // lxc copy
+		exec.Command("/bin/true"),                   // lxc config device set
+		exec.Command("/bin/echo", "ubuntu-daily:s"), // get image
+		exec.Command("/bin/true"),                   // record root-dir and config
+	)
+	defer restoreCmd()
+
+	app := testApp(&fakeBackend{})
+	app.Opts.Clone = CloneOpts{ToLabel: "wt2", ToDir: tempdir}
+	name, err := app.Clone(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "wt2-s", name)
+	require.Len(t, *calls, 6)
+	assert.Equal(t, [][]string{
+		{"lxc", "config", "get", "l-s", "user.omnienv.root-dir"},
+		{"lxc", "list", "--format", "csv", "--columns", "n", "^wt2-s$"},
+		{"lxc", "copy", "l-s", "wt2-s"},
+		{"lxc", "config", "device", "set", "wt2-s", "workdir", "source=" + tempdir},
+		{"lxc", "config", "get", "wt2-s", "user.omnienv.image"},
+	}, (*calls)[:5])
+	target, err := app.cloneTarget()
+	assert.Nil(t, err)
+	target.Config.System.Image = "ubuntu-daily:s"
+	hash, err := target.configHash()
+	assert.Nil(t, err)
+	record := (*calls)[5]
+	assert.Equal(t, []string{"lxc", "config", "set", "wt2-s"}, record[:4])
+	assert.True(t, strings.HasPrefix(record[4], "user.omnienv.config=system: s\n"), record[4])
+	assert.Equal(t, []string{
+		"user.omnienv.config-hash=" + hash,
+		"user.omnienv.root-dir=" + tempdir,
+	}, record[5:])
+}
+
+func TestCloneFromSnapshotSameDir(t *testing.T) {
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/true"),                   // checkOwner
+		exec.Command("/bin/true"),                   // lxc list
+		exec.Command("/bin/true"),                   // lxc copy
+		exec.Command("/bin/echo", "ubuntu-daily:s"), // get image
+		exec.Command("/bin/true"),                   // record root-dir and config
+	)
+	defer restoreCmd()
+
+	app := testApp(&fakeBackend{snapshots: []Snapshot{{Name: "omnienv-base"}}})
+	app.Opts.Clone = CloneOpts{ToSystem: "noble", Snapshot: "base"}
+	name, err := app.Clone(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "l-noble", name)
+	require.Len(t, *calls, 5)
+	assert.Equal(t, []string{"lxc", "copy", "l-s/omnienv-base", "l-noble"}, (*calls)[2])
+	// recorded as the image the copy runs, not one for the new system
+	assert.True(t, strings.HasPrefix((*calls)[4][4],
+		"user.omnienv.config=system: noble\nimage: ubuntu-daily:s\n"), (*calls)[4][4])
+}
+
+func TestCloneImageUnrecorded(t *testing.T) {
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/true"), // checkOwner
+		exec.Command("/bin/true"), // lxc list
+		exec.Command("/bin/true"), // lxc copy
+		exec.Command("/bin/true"), // get image
+		exec.Command("/bin/true"), // record image
+		exec.Command("/bin/true"), // record root-dir and config
+	)
+	defer restoreCmd()
+
+	app := testApp(&fakeBackend{})
+	app.Opts.Clone = CloneOpts{ToSystem: "noble"}
+	_, err := app.Clone(context.Background())
+	assert.Nil(t, err)
+	require.Len(t, *calls, 6)
+	assert.Equal(t,
+		[]string{"lxc", "config", "set", "l-noble", "user.omnienv.image=ubuntu-daily:s"},
+		(*calls)[4],
+	)
+}
+
+func TestCloneRemovesForwarding(t *testing.T) {
+	restoreCmd, _ := patchCommands(
+		exec.Command("/bin/true"),                   // checkOwner
+		exec.Command("/bin/true"),                   // lxc list
+		exec.Command("/bin/true"),                   // lxc copy
+		exec.Command("/bin/echo", "ubuntu-daily:s"), // get image
+		exec.Command("/bin/true"),                   // record root-dir and config
+	)
+	defer restoreCmd()
+
+	fake := &fakeBackend{devices: map[string]Port{
+		"oe-port-tcp-8080":    {Host: 8080, Guest: 8080, Proto: "tcp"},
+		"oe-forward-tcp-5432": {Host: 5432, Guest: 5432, Proto: "tcp"},
+		"other":               {Host: 80, Guest: 80, Proto: "tcp"},
+	}}
+	app := testApp(fake)
+	app.Opts.Clone = CloneOpts{ToSystem: "noble"}
+	_, err := app.Clone(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]Port{"other": {Host: 80, Guest: 80, Proto: "tcp"}}, fake.devices)
+	assert.Contains(t, fake.calls, "remove l-noble oe-port-tcp-8080")
+	assert.Contains(t, fake.calls, "remove l-noble oe-forward-tcp-5432")
+}
+
+func TestCloneRemoveForwardingFails(t *testing.T) {
+	restoreCmd, _ := patchCommands(
+		exec.Command("/bin/true"), // checkOwner
+		exec.Command("/bin/true"), // lxc list
+		exec.Command("/bin/true"), // lxc copy
+	)
+	defer restoreCmd()
+
+	app := testApp(&fakeBackend{err: errors.New("boom")})
+	app.Opts.Clone = CloneOpts{ToSystem: "noble"}
+	_, err := app.Clone(context.Background())
+	assert.ErrorContains(t, err, "failed to list proxy devices: boom")
+}
+
+func TestCloneSnapshotNotFound(t *testing.T) {
+	restoreCmd, _ := patchCommands()
+	defer restoreCmd()
+	app := testApp(&fakeBackend{})
+	app.Opts.Clone = CloneOpts{ToSystem: "noble", Snapshot: "base"}
+	_, err := app.Clone(context.Background())
+	assert.ErrorIs(t, err, ErrSnapshotNotFound)
+}
+
+func TestCloneOtherProject(t *testing.T) {
+	restoreCmd, calls := patchCommands(exec.Command("/bin/echo", "/src/other/l"))
+	defer restoreCmd()
+	app := testApp(&fakeBackend{})
+	app.Opts.Clone = CloneOpts{ToSystem: "noble"}
+	_, err := app.Clone(context.Background())
+	assert.ErrorIs(t, err, ErrNameCollision)
+	assert.Len(t, *calls, 1)
+}
+
+func TestCloneTargetExists(t *testing.T) {
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/true"),            // checkOwner
+		exec.Command("/bin/echo", "l-noble"), // lxc list
+	)
+	defer restoreCmd()
+	app := testApp(&fakeBackend{})
+	app.Opts.Clone = CloneOpts{ToSystem: "noble"}
+	_, err := app.Clone(context.Background())
+	assert.ErrorContains(t, err, "instance l-noble already exists")
+	assert.Len(t, *calls, 2)
+}
+
+func TestCloneCopyFails(t *testing.T) {
+	restoreCmd, _ := patchCommands(
+		exec.Command("/bin/true"),  // checkOwner
+		exec.Command("/bin/true"),  // lxc list
+		exec.Command("/bin/false"), // lxc copy
+	)
+	defer restoreCmd()
+	app := testApp(&fakeBackend{})
+	app.Opts.Clone = CloneOpts{ToSystem: "noble"}
+	_, err := app.Clone(context.Background())
+	assert.ErrorContains(t, err, "failed to copy instance")
+}
+
+func TestCloneDeviceFails(t *testing.T) {
+	restoreCmd, _ := patchCommands(
+		exec.Command("/bin/true"),  // checkOwner
+		exec.Command("/bin/true"),  // lxc list
+		exec.Command("/bin/true"),  // lxc copy
+		exec.Command("/bin/false"), // lxc config device set
+	)
+	defer restoreCmd()
+	app := testApp(&fakeBackend{})
+	app.Opts.Clone = CloneOpts{ToLabel: "x", ToDir: os.TempDir()}
+	_, err := app.Clone(context.Background())
+	assert.ErrorContains(t, err, "failed to update workdir")
+}
@@ -1,11 +1,14 @@
 package omnienv
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"strconv"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -14,6 +17,13 @@ var cfgName = ".omnienv.yaml"
 
 var ErrCfgNotFound = errors.New("Config not found")
 
+// Values for Config.AutoLaunch and Opts.AutoLaunch.
+const (
+	AutoLaunchTrue   = "true"
+	AutoLaunchPrompt = "prompt"
+	AutoLaunchFalse  = "false"
+)
+
 type System struct {
 	Name  string
 	Image string
@@ -30,36 +40,52 @@ func (sys System) LaunchImage() string {
 	return sys.Image
 }
 
-func (sys *System) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	// if string, unmarshal to Name and done
-	var err error
-	var name string
-	if err = unmarshal(&name); err == nil {
+func (sys *System) UnmarshalYAML(node *yaml.Node) error {
+	return collectable(sys.unmarshal(node))
+}
+
+func (sys *System) unmarshal(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		// if string, unmarshal to Name and done
+		var name string
+		if err := node.Decode(&name); err != nil {
+			return err
+		}
 		*sys = NewSystem(name)
 		return nil
-	}
-
-	type systemImage struct {
-		Image string
-	}
-
-	// if map with single key, unmarshal key to Name and set Image
-	var dict map[string]systemImage
-	if err = unmarshal(&dict); err == nil {
-		switch len(dict) {
+	case yaml.MappingNode:
+		// if map with single key, unmarshal key to Name and set Image
+		switch len(node.Content) {
 		case 0:
-			return errors.New("empty system map")
-		case 1:
-			for name, img := range dict {
-				*sys = System{Name: name, Image: img.Image}
-			}
-			return nil
+			return nodeError(node, "empty system map")
+		case 2:
 		default:
-			return errors.New("multiple system keys, expected one")
+			return nodeError(node, "multiple system keys, expected one")
+		}
+		value := node.Content[1]
+		if err := checkFields(value, "image"); err != nil {
+			return err
 		}
+		var img struct {
+			Image string
+		}
+		if err := value.Decode(&img); err != nil {
+			return err
+		}
+		*sys = System{Name: node.Content[0].Value, Image: img.Image}
+		return nil
+	default:
+		return nodeError(node, "expected a system name or a map of one to its image")
 	}
+}
 
-	return err
+// MarshalYAML writes the system in the form UnmarshalYAML reads.
+func (sys System) MarshalYAML() (any, error) {
+	if sys.Image == "" {
+		return sys.Name, nil
+	}
+	return map[string]map[string]string{sys.Name: {"image": sys.Image}}, nil
 }
 
 type Config struct {
@@ -80,6 +106,48 @@ type Config struct {
 	Backend string
 	// Virtualization chooses between "container" (default) and "vm".
 	Virtualization string
+	// Ready configures the probes used to decide the instance is usable.
+	Ready Ready
+	// AutoLaunch decides what a shell does when the instance does not
+	// exist: "true" launches it, "prompt" asks first, and "false"
+	// (default) fails.
+	AutoLaunch string `yaml:"auto_launch"`
+	// SnapshotBeforeProvision takes a snapshot of the freshly created
+	// instance, before it first boots and is provisioned.
+	SnapshotBeforeProvision bool `yaml:"snapshot_before_provision"`
+	// Env sets environment variables in shells and commands.
+	Env map[string]string
+	// PassEnv names host environment variables, or glob patterns of
+	// them, passed to shells and commands.
+	PassEnv []string `yaml:"pass_env"`
+	// TranslatePaths rewrites absolute host paths in the arguments of
+	// commands to their place in the instance, and paths in their output
+	// back to the host.  Such commands always run without a pty.
+	TranslatePaths bool `yaml:"translate_paths"`
+	// Ports are forwarded from localhost on the host to the instance.
+	Ports []Port
+	// StaleImageDays, when set, warns on shell if the instance was created
+	// from an image older than this many days.
+	StaleImageDays int `yaml:"stale_image_days"`
+	// IdleStop, when set, stops the instance once no shells or sessions
+	// have used it for this long.
+	IdleStop time.Duration `yaml:"idle_stop"`
+	// IgnoreDrift silences the warning given when the config no longer
+	// matches the one the instance was launched with.
+	IgnoreDrift bool `yaml:"ignore_drift"`
+	// Worktrees chooses how linked git worktrees of the project map to
+	// instances.  "shared" uses one instance for all worktrees, mounting
+	// the current one at /project, and "separate" uses one per worktree.
+	// When unset, each worktree is treated as an unrelated project.
+	Worktrees string
+	// Naming chooses how instance names are formed.  "plain" (default)
+	// uses Label and System, and "hashed" adds a short hash of the
+	// project directory so that unrelated projects with the same Label
+	// get separate instances.
+	Naming string
+
+	// mainDir is the main worktree when Worktrees is "shared".
+	mainDir string
 
 	// unsupported keys that are unmarshalled for warning purposes
 	Project string
@@ -149,8 +217,8 @@ func loadConfig(path string) (Config, error) {
 		return Config{}, err
 	}
 
-	cfg := Config{}
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
+	cfg, err := parseConfig(path, data)
+	if err != nil {
 		return Config{}, err
 	}
 
@@ -158,10 +226,17 @@ func loadConfig(path string) (Config, error) {
 		cfg.RootDir = filepath.Dir(path)
 	}
 
-	if cfg.Label == "" {
+	labelSet := cfg.Label != ""
+	if !labelSet {
 		cfg.Label = filepath.Base(cfg.RootDir)
 	}
 
+	if cfg.Worktrees != "" {
+		if err := cfg.applyWorktrees(labelSet); err != nil {
+			return Config{}, err
+		}
+	}
+
 	if cfg.System.Name == "" {
 		cfg.System = NewSystem(os.Getenv("DEFAULT_SERIES"))
 	}
@@ -193,3 +268,13 @@ func GetConfig() (Config, error) {
 
 	return loadConfig(cfgPath)
 }
+
+// hashYAML is a short hash of the YAML form of value.
+func hashYAML(value any) (string, error) {
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:16], nil
+}
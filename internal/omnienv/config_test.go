@@ -175,6 +175,28 @@ func TestNotLoadCfgUnreadable(t *testing.T) {
 	assert.NotNil(t, err)
 }
 
+func TestLoadCfgAutoLaunch(t *testing.T) {
+	tempdir := t.TempDir()
+	filename := tempdir + "/" + cfgName
+	assert.Nil(t, os.WriteFile(filename, []byte("auto_launch: prompt"), 0644))
+	cfg, err := loadConfig(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, AutoLaunchPrompt, cfg.AutoLaunch)
+
+	assert.Nil(t, os.WriteFile(filename, []byte("auto_launch: true"), 0644))
+	cfg, err = loadConfig(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, AutoLaunchTrue, cfg.AutoLaunch)
+}
+
+func TestNotLoadCfgAutoLaunch(t *testing.T) {
+	tempdir := t.TempDir()
+	filename := tempdir + "/" + cfgName
+	assert.Nil(t, os.WriteFile(filename, []byte("auto_launch: maybe"), 0644))
+	_, err := loadConfig(filename)
+	assert.ErrorContains(t, err, `invalid auto_launch "maybe"`)
+}
+
 func TestNotLoadCfgUnmarshalable(t *testing.T) {
 	tempdir := t.TempDir()
 	data := []byte(`{`)
@@ -0,0 +1,149 @@
+package omnienv
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The part of the config fixed at launch is recorded in instance metadata
+// under configKey, with its hash under configHashKey.
+const (
+	configKey     = "config"
+	configHashKey = "config-hash"
+)
+
+// launchedConfig is the normalized part of the config that is fixed once
+// the instance is created.  Settings applied on every shell, such as ports
+// and env, are left out.
+type launchedConfig struct {
+	System         string
+	Image          string
+	Virtualization string
+	LXDConfig      string `yaml:"lxd_config"`
+}
+
+func (app App) launchedConfig() launchedConfig {
+	cfg := app.Config
+	// worktrees sharing the instance remount /project on every shell
+	cfg.RootDir = cfg.projectDir()
+	return launchedConfig{
+		System:         app.system(),
+		Image:          app.launchImage(),
+		Virtualization: cfg.Virtualization,
+		// trimmed, as metadata values are read back trimmed
+		LXDConfig: strings.TrimSpace(cfg.lxdLaunchConfig(CurrentUserInfo())),
+	}
+}
+
+// configHash identifies the launched config.  It is recorded on the
+// instance, in its history and on images published from it, so that all
+// three can be compared.
+func (app App) configHash() (string, error) {
+	return hashYAML(app.launchedConfig())
+}
+
+// changes names the fields that differ between the configs.
+func (lc launchedConfig) changes(other launchedConfig) []string {
+	var changed []string
+	if lc.System != other.System {
+		changed = append(changed, "system")
+	}
+	if lc.Image != other.Image {
+		changed = append(changed, "image")
+	}
+	if lc.Virtualization != other.Virtualization {
+		changed = append(changed, "virtualization")
+	}
+	if lc.LXDConfig != other.LXDConfig {
+		changed = append(changed, "lxd config")
+	}
+	return changed
+}
+
+// recordConfig records the project directory and the launched config on
+// the instance.
+func (app App) recordConfig(ctx context.Context) error {
+	data, err := yaml.Marshal(app.launchedConfig())
+	if err != nil {
+		return err
+	}
+	hash, err := app.configHash()
+	if err != nil {
+		return err
+	}
+	return app.setMetas(ctx, map[string]string{
+		rootDirKey:    app.Config.projectDir(),
+		configKey:     string(data),
+		configHashKey: hash,
+	})
+}
+
+// Sync records the current config as the one the instance matches, to
+// silence the drift warning for changes that need no rebuild.
+func (app App) Sync(ctx context.Context) error {
+	exists, err := app.Exists(ctx)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrInstanceNotFound, app.Name())
+	}
+	if err := app.checkOwner(ctx); err != nil {
+		return err
+	}
+	return app.recordConfig(ctx)
+}
+
+// drift names the fields of the config that changed since the instance
+// was launched.  Instances launched by older versions have no config
+// recorded, and never drift.
+func (app App) drift(ctx context.Context) ([]string, error) {
+	recorded, err := app.getMeta(ctx, configHashKey)
+	if err != nil || recorded == "" {
+		return nil, err
+	}
+	hash, err := app.configHash()
+	if err != nil || hash == recorded {
+		return nil, err
+	}
+
+	data, err := app.getMeta(ctx, configKey)
+	if err != nil {
+		return nil, err
+	}
+	previous := launchedConfig{}
+	if err := yaml.Unmarshal([]byte(data), &previous); err != nil {
+		return nil, fmt.Errorf("invalid recorded config: %w", err)
+	}
+	changed := previous.changes(app.launchedConfig())
+	if len(changed) == 0 {
+		// the hash differs in what the fields do not show
+		changed = []string{"config"}
+	}
+	return changed, nil
+}
+
+// warnDrift warns if the config changed since the instance was launched,
+// unless Config.IgnoreDrift is set.
+func (app App) warnDrift(ctx context.Context) {
+	if app.Config.IgnoreDrift {
+		return
+	}
+	changed, err := app.drift(ctx)
+	if err != nil {
+		slog.Debug("failed to check config drift", "error", err)
+		return
+	}
+	if len(changed) == 0 {
+		return
+	}
+	slog.Warn(
+		"config changed since launch, rebuild with --launch=always, "+
+			"keep the environment with oe sync, or set ignore_drift: true",
+		"instance", app.Name(), "changed", strings.Join(changed, ", "),
+	)
+}
@@ -0,0 +1,132 @@
+package omnienv
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func recordedConfig(t *testing.T, update func(*launchedConfig)) string {
+	launched := testApp(nil).launchedConfig()
+	update(&launched)
+	data, err := yaml.Marshal(launched)
+	assert.Nil(t, err)
+	return string(data)
+}
+
+func TestDrift(t *testing.T) {
+	hash, err := testApp(nil).configHash()
+	assert.Nil(t, err)
+
+	tests := []struct {
+		summary string
+		cmds    []*exec.Cmd
+
+		changed []string
+		errMsg  string
+	}{{
+		summary: "nothing recorded",
+		cmds:    []*exec.Cmd{exec.Command("/bin/true")},
+	}, {
+		summary: "unchanged",
+		cmds:    []*exec.Cmd{exec.Command("/bin/echo", hash)},
+	}, {
+		summary: "changed",
+		cmds: []*exec.Cmd{
+			exec.Command("/bin/echo", "0123456789abcdef"),
+			exec.Command("/bin/echo", recordedConfig(t, func(lc *launchedConfig) {
+				lc.Image = "ubuntu:s"
+				lc.Virtualization = "vm"
+			})),
+		},
+		changed: []string{"image", "virtualization"},
+	}, {
+		summary: "changed beyond the fields",
+		cmds: []*exec.Cmd{
+			exec.Command("/bin/echo", "0123456789abcdef"),
+			exec.Command("/bin/echo", recordedConfig(t, func(*launchedConfig) {})),
+		},
+		changed: []string{"config"},
+	}, {
+		summary: "invalid",
+		cmds: []*exec.Cmd{
+			exec.Command("/bin/echo", "0123456789abcdef"),
+			exec.Command("/bin/echo", "system: [a"),
+		},
+		errMsg: "invalid recorded config",
+	}, {
+		summary: "get fails",
+		cmds:    []*exec.Cmd{exec.Command("/bin/false")},
+		errMsg:  "failed to get config-hash",
+	}}
+	for _, test := range tests {
+		restoreCmd, calls := patchCommands(test.cmds...)
+		changed, err := testApp(nil).drift(context.Background())
+		restoreCmd()
+		if test.errMsg != "" {
+			assert.ErrorContains(t, err, test.errMsg, test.summary)
+		} else {
+			assert.Nil(t, err, test.summary)
+			assert.Equal(t, test.changed, changed, test.summary)
+		}
+		require.NotEmpty(t, *calls, test.summary)
+		assert.Equal(t,
+			[]string{"lxc", "config", "get", "l-s", "user.omnienv.config-hash"},
+			(*calls)[0], test.summary,
+		)
+	}
+}
+
+func TestWarnDrift(t *testing.T) {
+	config := recordedConfig(t, func(lc *launchedConfig) { lc.System = "r" })
+	restoreCmd, _ := patchCommands(
+		exec.Command("/bin/echo", "0123456789abcdef"),
+		exec.Command("/bin/echo", config),
+	)
+	defer restoreCmd()
+	logs := patchLog(t)
+	testApp(nil).warnDrift(context.Background())
+	assert.Contains(t, logs.String(), "config changed since launch")
+	assert.Contains(t, logs.String(), "changed=system")
+}
+
+func TestWarnDriftIgnored(t *testing.T) {
+	restoreCmd, calls := patchCommands()
+	defer restoreCmd()
+	app := testApp(nil)
+	app.Config.IgnoreDrift = true
+	app.warnDrift(context.Background())
+	assert.Empty(t, *calls)
+}
+
+func TestLaunchedConfigWorktree(t *testing.T) {
+	// worktrees sharing an instance see the same launched config
+	main, worktree := testApp(nil), testApp(nil)
+	worktree.Config.RootDir = "/src/l-feature"
+	worktree.Config.mainDir = "/src/l"
+	assert.Equal(t, main.launchedConfig(), worktree.launchedConfig())
+}
+
+func TestSync(t *testing.T) {
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/echo", "l-s"), // lxc list
+		exec.Command("/bin/true"),        // checkOwner
+		exec.Command("/bin/true"),        // record config
+	)
+	defer restoreCmd()
+	assert.Nil(t, testApp(nil).Sync(context.Background()))
+	require.Len(t, *calls, 3)
+	assert.Equal(t, []string{"lxc", "config", "set", "l-s"}, (*calls)[2][:4])
+}
+
+func TestSyncMissing(t *testing.T) {
+	restoreCmd, calls := patchCommands(exec.Command("/bin/true"))
+	defer restoreCmd()
+	err := testApp(nil).Sync(context.Background())
+	assert.ErrorIs(t, err, ErrInstanceNotFound)
+	assert.Len(t, *calls, 1)
+}
@@ -0,0 +1,66 @@
+package omnienv
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"al.essio.dev/pkg/shellescape"
+)
+
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// env resolves the variables to set in the instance.  Host variables
+// matching Config.PassEnv are overridden by Config.Env, which is in turn
+// overridden by Opts.Env.
+func (app App) env() (map[string]string, error) {
+	env := map[string]string{}
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+		for _, pattern := range app.Config.PassEnv {
+			if matched, _ := path.Match(pattern, name); matched {
+				env[name] = value
+				break
+			}
+		}
+	}
+
+	maps.Copy(env, app.Config.Env)
+
+	for _, entry := range app.Opts.Env {
+		name, value, found := strings.Cut(entry, "=")
+		if !found {
+			// as with docker, a bare name passes the host value
+			if value, found = os.LookupEnv(name); !found {
+				continue
+			}
+		}
+		env[name] = value
+	}
+
+	for name := range env {
+		if !envName.MatchString(name) {
+			return nil, fmt.Errorf("invalid environment variable name %q", name)
+		}
+	}
+	return env, nil
+}
+
+// envScript is a shell snippet exporting the variables of env, or empty if
+// there are none.
+func (app App) envScript() (string, error) {
+	env, err := app.env()
+	if err != nil || len(env) == 0 {
+		return "", err
+	}
+
+	assignments := make([]string, 0, len(env))
+	for _, name := range slices.Sorted(maps.Keys(env)) {
+		assignments = append(assignments, name+"="+shellescape.Quote(env[name]))
+	}
+	return "export " + strings.Join(assignments, " "), nil
+}
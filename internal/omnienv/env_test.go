@@ -0,0 +1,112 @@
+package omnienv
+
+import (
+	"context"
+	"encoding/base64"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var envTests = []struct {
+	summary string
+	config  Config
+	opts    Opts
+
+	env    map[string]string
+	errMsg string
+}{{
+	summary: "none",
+	env:     map[string]string{},
+}, {
+	summary: "pass by name and pattern",
+	config:  Config{PassEnv: []string{"OE_TEST_GOFLAGS", "OE_TEST_PROXY_*"}},
+	env: map[string]string{
+		"OE_TEST_GOFLAGS":     "-mod=mod",
+		"OE_TEST_PROXY_HTTP":  "http://proxy:3128",
+		"OE_TEST_PROXY_HTTPS": "http://proxy:3129",
+	},
+}, {
+	summary: "config overrides host",
+	config: Config{
+		PassEnv: []string{"OE_TEST_GOFLAGS"},
+		Env:     map[string]string{"OE_TEST_GOFLAGS": "-v", "CI": "true"},
+	},
+	env: map[string]string{"OE_TEST_GOFLAGS": "-v", "CI": "true"},
+}, {
+	summary: "opts override config",
+	config:  Config{Env: map[string]string{"CI": "true"}},
+	opts:    Opts{Env: []string{"CI=false", "EMPTY=", "OE_TEST_GOFLAGS", "OE_TEST_UNSET"}},
+	env: map[string]string{
+		"CI": "false", "EMPTY": "", "OE_TEST_GOFLAGS": "-mod=mod",
+	},
+}, {
+	summary: "invalid name",
+	opts:    Opts{Env: []string{"BAD-NAME=1"}},
+	errMsg:  `invalid environment variable name "BAD-NAME"`,
+}}
+
+func TestEnv(t *testing.T) {
+	t.Setenv("OE_TEST_GOFLAGS", "-mod=mod")
+	t.Setenv("OE_TEST_PROXY_HTTP", "http://proxy:3128")
+	t.Setenv("OE_TEST_PROXY_HTTPS", "http://proxy:3129")
+	for _, test := range envTests {
+		env, err := App{Config: test.config, Opts: test.opts}.env()
+		if test.errMsg != "" {
+			assert.ErrorContains(t, err, test.errMsg, test.summary)
+		} else {
+			assert.Nil(t, err, test.summary)
+			assert.Equal(t, test.env, env, test.summary)
+		}
+	}
+}
+
+func TestEnvScriptNone(t *testing.T) {
+	script, err := App{}.envScript()
+	assert.Nil(t, err)
+	assert.Equal(t, "", script)
+}
+
+func TestEnvScriptQuoting(t *testing.T) {
+	values := map[string]string{
+		"A": `it's "$HOME" and $(id) and ; rm -rf /`,
+		"B": "multi\nline",
+		"C": "",
+	}
+	script, err := App{Config: Config{Env: values}}.envScript()
+	assert.Nil(t, err)
+
+	// run the script to confirm the values arrive unchanged
+	for name, value := range values {
+		out, err := exec.Command("sh", "-c", script+` && printf %s "$`+name+`"`).Output()
+		assert.Nil(t, err, name)
+		assert.Equal(t, value, string(out), name)
+	}
+}
+
+func TestShellEnv(t *testing.T) {
+	defer patchTerminal(true)()
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/true"),                    // checkOwner
+		exec.Command("/bin/echo", "Status: RUNNING"), // StartIfNeeded
+		exec.Command("/bin/true"),                    // warnDrift
+		exec.Command("/bin/echo", "Type: container"), // Wait → isVM
+		exec.Command("/bin/true"),                    // Wait → user probe
+		exec.Command("/bin/echo", "{}"),              // ensurePorts
+		exec.Command("/bin/true"),                    // lxcExec
+	)
+	defer restoreCmd()
+	app := App{
+		Config: Config{Label: "l", System: NewSystem("s")},
+		Opts:   Opts{Env: []string{"CI=true"}},
+	}
+	assert.Nil(t, app.Shell(context.Background()))
+	require.Len(t, *calls, 7)
+	encoded := strings.Fields((*calls)[6][len((*calls)[6])-1])[2]
+	script, err := base64.StdEncoding.DecodeString(encoded)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(script), "export CI=true && cd "), string(script))
+}
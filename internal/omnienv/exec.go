@@ -1,21 +1,106 @@
 package omnienv
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
-func run(args ...string) error {
-	cmd := command(args[0], args[1:]...)
+// how long a cancelled command has to exit after SIGTERM before it is killed
+const cancelGrace = 10 * time.Second
+
+// gracefulCommand is exec.CommandContext, except that cancellation first
+// asks nicely, giving lxc the chance to pass the signal along to the
+// instance.
+func gracefulCommand(ctx context.Context, name string, arg ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, arg...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = cancelGrace
+	return cmd
+}
+
+// userContext is ctx for the shell or command of the user, which the
+// timeout and interrupts of oe's own steps leave running: lxc passes an
+// interrupt on to the command itself, and oe waits to report how it
+// exited.  A SIGTERM for oe still ends the command.
+func userContext(ctx context.Context) (context.Context, func()) {
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	ctx, stop := signal.NotifyContext(context.WithoutCancel(ctx), syscall.SIGTERM)
+	return ctx, func() {
+		stop()
+		signal.Stop(interrupts)
+	}
+}
+
+// ExitCodeError reports the exit code of a command run in the instance.
+type ExitCodeError struct {
+	Code int
+}
+
+func (err *ExitCodeError) Error() string {
+	return fmt.Sprintf("exit status %d", err.Code)
+}
+
+// exitCode converts the failure of lxc exec into an *ExitCodeError, as lxc
+// exec exits with the exit code of the command.
+func exitCode(err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+		return &ExitCodeError{Code: exitErr.ExitCode()}
+	}
+	return err
+}
+
+// Terminal reports if the file is a terminal.  Other character devices,
+// such as /dev/null, are not.
+func Terminal(file *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(file.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+func run(ctx context.Context, args ...string) error {
+	return runTo(ctx, os.Stdout, os.Stderr, args...)
+}
+
+// runTo runs the command with its output written to stdout and stderr.
+func runTo(ctx context.Context, stdout, stderr io.Writer, args ...string) error {
+	cmd := commandContext(ctx, args[0], args[1:]...)
 	slog.Debug("run", "command", args)
-	cmd.Stdout = os.Stdout
+	cmd.Stdout = stdout
 	cmd.Stdin = os.Stdin
-	cmd.Stderr = os.Stderr
+	cmd.Stderr = stderr
 	return cmd.Run()
 }
 
-func runDevNull(args ...string) error {
-	cmd := command(args[0], args[1:]...)
+// runQuiet runs the command, including its output in any error rather
+// than passing it through.
+func runQuiet(ctx context.Context, args ...string) error {
+	cmd := commandContext(ctx, args[0], args[1:]...)
 	slog.Debug("run", "command", args)
-	return cmd.Run()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timeAfter(d):
+		return nil
+	}
 }
@@ -1,8 +1,14 @@
 package omnienv
 
 import (
+	"context"
+	"errors"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -13,14 +19,97 @@ func Patch[T any](target *T, mock T) func() {
 	return func() { *target = original }
 }
 
+// patchCommands hands out cmds in order for each call to commandContext,
+// then /bin/true once exhausted.  The arguments of every call are recorded.
+func patchCommands(cmds ...*exec.Cmd) (func(), *[][]string) {
+	calls := &[][]string{}
+	restore := Patch(&commandContext, func(_ context.Context, arg0 string, argv ...string) *exec.Cmd {
+		*calls = append(*calls, append([]string{arg0}, argv...))
+		if len(*calls) <= len(cmds) {
+			return cmds[len(*calls)-1]
+		}
+		return exec.Command("/bin/true")
+	})
+	return restore, calls
+}
+
+// patchTerminal makes stdin and stdout appear to be terminals, or not.
+func patchTerminal(tty bool) func() {
+	return Patch(&isTerminal, func(*os.File) bool { return tty })
+}
+
 func TestLxcExec(t *testing.T) {
-	restoreCmd := Patch(&command, func(arg0 string, argv ...string) *exec.Cmd {
+	restoreCmd := Patch(&commandContext, func(_ context.Context, arg0 string, argv ...string) *exec.Cmd {
 		assert.Equal(t, "lxc", arg0)
-		assert.Equal(t, []string{"exec", "-", "--", "bar"}, argv)
+		assert.Equal(t, []string{"exec", "oe", "--", "bar"}, argv)
 		cmd := exec.Command("/bin/true")
 		cmd.Args = append([]string{arg0}, argv...)
 		return cmd
 	})
 	defer restoreCmd()
-	assert.Nil(t, App{}.lxcExec("bar"))
+	assert.Nil(t, App{}.lxcExec(context.Background(), "bar"))
+}
+
+func TestGracefulCommandCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := gracefulCommand(ctx, "/bin/sleep", "10")
+	assert.Nil(t, cmd.Start())
+	cancel()
+	err := cmd.Wait()
+	exitError, ok := err.(*exec.ExitError)
+	assert.True(t, ok)
+	status := exitError.Sys().(syscall.WaitStatus)
+	assert.Equal(t, syscall.SIGTERM, status.Signal())
+}
+
+func TestUserContext(t *testing.T) {
+	parent, cancel := context.WithCancel(context.Background())
+	ctx, stop := userContext(parent)
+	defer stop()
+	cancel()
+	assert.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGINT))
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, ctx.Err())
+
+	assert.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("SIGTERM did not cancel the context")
+	}
+}
+
+func TestSleepCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, sleep(ctx, time.Hour), context.Canceled)
+}
+
+func TestSleep(t *testing.T) {
+	assert.Nil(t, sleep(context.Background(), time.Millisecond))
+}
+
+func TestTerminal(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "f"))
+	assert.Nil(t, err)
+	defer file.Close()
+	assert.False(t, Terminal(file))
+}
+
+func TestTerminalDevNull(t *testing.T) {
+	file, err := os.Open(os.DevNull)
+	assert.Nil(t, err)
+	defer file.Close()
+	assert.False(t, Terminal(file))
+}
+
+func TestExitCode(t *testing.T) {
+	err := exec.Command("sh", "-c", "exit 3").Run()
+	var exitErr *ExitCodeError
+	assert.ErrorAs(t, exitCode(err), &exitErr)
+	assert.Equal(t, 3, exitErr.Code)
+	assert.EqualError(t, exitErr, "exit status 3")
+
+	other := errors.New("boom")
+	assert.Equal(t, other, exitCode(other))
 }
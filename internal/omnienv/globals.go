@@ -1,10 +1,14 @@
 package omnienv
 
 import (
-	"os/exec"
+	"io"
+	"os"
 	"time"
 )
 
-var command = exec.Command
-var commandContext = exec.CommandContext
-var timeSleep = time.Sleep
+var commandContext = gracefulCommand
+var timeAfter = time.After
+var timeNow = time.Now
+var progress io.Writer = os.Stderr
+var isTerminal = Terminal
+var spawn = spawnDetached
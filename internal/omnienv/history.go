@@ -0,0 +1,166 @@
+package omnienv
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// History is what the host remembers about an instance, kept in stateDir
+// as it is not derived from LXD.
+type History struct {
+	Instance string
+	// Launched is when the instance was last created by Launch.
+	Launched time.Time `yaml:",omitempty"`
+	// ConfigHash identifies the config the instance was launched with.
+	ConfigHash string `yaml:"config_hash,omitempty"`
+	// LastShell is when a shell or command last started.
+	LastShell time.Time `yaml:"last_shell,omitempty"`
+	// LastExit is the exit status of the last shell or command.
+	LastExit *int `yaml:"last_exit,omitempty"`
+	// Steps are the launch steps run by the last launch, including those
+	// of launches resumed with Opts.Resume.
+	Steps []StepLog `yaml:",omitempty"`
+}
+
+// StepLog records a launch step that ran.
+type StepLog struct {
+	Name     string
+	Started  time.Time
+	Duration time.Duration
+	Error    string `yaml:",omitempty"`
+}
+
+// stateDir holds the history of the instances, one file per instance name.
+func stateDir() (string, error) {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "omnienv"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "state", "omnienv"), nil
+}
+
+func (app App) historyPath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, app.Name()+".yaml"), nil
+}
+
+// History returns what the host has recorded about the instance, which is
+// empty but for the name if nothing is.
+func (app App) History() (History, error) {
+	history := History{Instance: app.Name()}
+	path, err := app.historyPath()
+	if err != nil {
+		return History{}, err
+	}
+	data, err := os.ReadFile(path) //gosec:disable G304
+	if errors.Is(err, os.ErrNotExist) {
+		return history, nil
+	}
+	if err != nil {
+		return History{}, err
+	}
+	if err := yaml.Unmarshal(data, &history); err != nil {
+		return History{}, fmt.Errorf("invalid history %s: %w", path, err)
+	}
+	return history, nil
+}
+
+func (app App) writeHistory(history History) error {
+	path, err := app.historyPath()
+	if err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(history)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	// replace the file whole, so that a reader never sees it half written
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".history-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// recordHistory updates the history of the instance.  History is only an
+// aid, so failing to record it does not fail the command.
+func (app App) recordHistory(update func(*History)) {
+	history, err := app.History()
+	if err == nil {
+		update(&history)
+		err = app.writeHistory(history)
+	}
+	if err != nil {
+		slog.Warn("failed to record history", "instance", app.Name(), "error", err)
+	}
+}
+
+// recordLaunch starts the history of a new instance.
+func (app App) recordLaunch() {
+	hash, err := app.configHash()
+	if err != nil {
+		slog.Debug("failed to hash config", "error", err)
+	}
+	app.recordHistory(func(history *History) {
+		*history = History{
+			Instance:   app.Name(),
+			Launched:   timeNow(),
+			ConfigHash: hash,
+		}
+	})
+}
+
+func (app App) recordStep(name string, started time.Time, err error) {
+	step := StepLog{Name: name, Started: started, Duration: timeNow().Sub(started)}
+	if err != nil {
+		step.Error = err.Error()
+	}
+	app.recordHistory(func(history *History) {
+		history.Steps = append(history.Steps, step)
+	})
+}
+
+func (app App) recordShell() {
+	app.recordHistory(func(history *History) {
+		history.LastShell = timeNow()
+	})
+}
+
+// recordExit records the exit status of a shell or command that ran, as
+// reported by err.  Failures to run it at all are not recorded.
+func (app App) recordExit(err error) {
+	status := 0
+	if err != nil {
+		var exitErr *ExitCodeError
+		if !errors.As(err, &exitErr) {
+			return
+		}
+		status = exitErr.Code
+	}
+	app.recordHistory(func(history *History) {
+		history.LastExit = &status
+	})
+}
@@ -0,0 +1,111 @@
+package omnienv
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateDir(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", "/xdg/state")
+	dir, err := stateDir()
+	assert.Nil(t, err)
+	assert.Equal(t, "/xdg/state/omnienv", dir)
+
+	t.Setenv("XDG_STATE_HOME", "")
+	t.Setenv("HOME", "/home/u")
+	dir, err = stateDir()
+	assert.Nil(t, err)
+	assert.Equal(t, "/home/u/.local/state/omnienv", dir)
+}
+
+func TestHistoryNone(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+	history, err := app.History()
+	assert.Nil(t, err)
+	assert.Equal(t, History{Instance: "l-s"}, history)
+}
+
+func TestHistoryInvalid(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+	path, err := app.historyPath()
+	assert.Nil(t, err)
+	assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0o700))
+	assert.Nil(t, os.WriteFile(path, []byte("steps: 3"), 0o600))
+	_, err = app.History()
+	assert.ErrorContains(t, err, "invalid history")
+
+	// recording does not fail, and leaves the history alone
+	logs := patchLog(t)
+	app.recordShell()
+	assert.Contains(t, logs.String(), "failed to record history")
+}
+
+func TestRecordExit(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+	lastExit := func() *int {
+		history, err := app.History()
+		assert.Nil(t, err)
+		return history.LastExit
+	}
+
+	app.recordExit(errors.New("lxc is missing"))
+	assert.Nil(t, lastExit())
+	app.recordExit(nil)
+	assert.Equal(t, 0, *lastExit())
+	app.recordExit(&ExitCodeError{Code: 3})
+	assert.Equal(t, 3, *lastExit())
+}
+
+func TestLaunchHistory(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	defer patchClock()()
+	restoreCmd, _ := patchCommands(exec.Command("/bin/false"))
+	defer restoreCmd()
+	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+	assert.NotNil(t, app.Launch(context.Background()))
+
+	hash, err := app.configHash()
+	assert.Nil(t, err)
+	history, err := app.History()
+	assert.Nil(t, err)
+	assert.Equal(t, time.Unix(0, 0), history.Launched.Local())
+	assert.Equal(t, hash, history.ConfigHash)
+	assert.Len(t, history.Steps, 1)
+	assert.Equal(t, "create", history.Steps[0].Name)
+	assert.Contains(t, history.Steps[0].Error, "failed to create instance")
+}
+
+func TestExecHistory(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	restoreCmd, _ := patchCommands(
+		exec.Command("/bin/true"),                    // checkOwner
+		exec.Command("/bin/echo", "Status: RUNNING"), // StartIfNeeded
+		exec.Command("/bin/true"),                    // warnDrift
+		exec.Command("/bin/echo", "Type: container"), // Wait → isVM
+		exec.Command("/bin/true"),                    // Wait → user probe
+		exec.Command("/bin/echo", "{}"),              // ensurePorts
+		exec.Command("sh", "-c", "exit 42"),          // lxc exec
+	)
+	defer restoreCmd()
+	app := App{
+		Config: Config{Label: "l", System: NewSystem("s")},
+		Opts:   Opts{Params: []string{"false"}},
+	}
+	assert.NotNil(t, app.Exec(context.Background()))
+
+	history, err := app.History()
+	assert.Nil(t, err)
+	assert.False(t, history.LastShell.IsZero())
+	assert.Equal(t, 42, *history.LastExit)
+	assert.True(t, history.Launched.IsZero())
+}
@@ -0,0 +1,199 @@
+package omnienv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Files in lockDir for the idle watcher.  Shells hold a shared flock on
+// the active file for as long as they run.  The idle watcher holds an
+// exclusive flock on its state file, which records when it is going to
+// stop the instance.
+const (
+	activeSuffix = ".active"
+	idleSuffix   = ".idle"
+)
+
+// how often the idle watcher checks for shells and sessions
+const idlePoll = 30 * time.Second
+
+// IdleState is what the idle watcher of the instance is waiting for.
+type IdleState struct {
+	PID int
+	// StopAt is when the instance is stopped if it stays unused, zero
+	// while shells or sessions are using it.
+	StopAt time.Time `yaml:"stop_at,omitempty"`
+}
+
+// spawnDetached starts oe with the args in a new session, to keep running
+// after this process exits.
+func spawnDetached(args ...string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, args...) //gosec:disable G204
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// markActive records that a shell is using the instance, until the
+// returned func is called, so that the idle watcher leaves it running.
+func (app App) markActive(ctx context.Context) (func(), error) {
+	if app.Config.IdleStop <= 0 {
+		return func() {}, nil
+	}
+	file, err := app.openState(activeSuffix)
+	if err != nil {
+		return nil, err
+	}
+	// the idle watcher holds its exclusive lock only while checking, or
+	// while stopping the instance
+	err = waitFlock(ctx, file, syscall.LOCK_SH, func() {
+		slog.Debug("waiting for idle watcher")
+	})
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to mark instance active: %w", err)
+	}
+	return func() { file.Close() }, nil
+}
+
+// readIdleState returns the state of the idle watcher of the instance, or
+// false if there is none running.
+func (app App) readIdleState() (IdleState, bool, error) {
+	file, err := app.openState(idleSuffix)
+	if err != nil {
+		return IdleState{}, false, err
+	}
+	defer file.Close()
+	locked, err := tryFlock(file, syscall.LOCK_SH)
+	if locked || err != nil {
+		return IdleState{}, false, err
+	}
+
+	state := IdleState{}
+	if err := yaml.NewDecoder(file).Decode(&state); err != nil {
+		// just started, and not written yet
+		return IdleState{}, true, nil
+	}
+	return state, true, nil
+}
+
+// ensureIdleWatch starts the idle watcher, if Config.IdleStop is set and
+// it is not running yet.
+func (app App) ensureIdleWatch() {
+	if app.Config.IdleStop <= 0 {
+		return
+	}
+	if _, running, err := app.readIdleState(); err != nil || running {
+		return
+	}
+	args := []string{"idle-watch"}
+	if app.Opts.System != "" {
+		args = append(args, "--system", app.Opts.System)
+	}
+	slog.Debug("starting idle watcher", "args", args)
+	if err := spawn(args...); err != nil {
+		slog.Warn("failed to start idle watcher", "error", err)
+	}
+}
+
+// inUse reports if shells or sessions are using the instance.  If not, the
+// active file is left locked, so that no shell starts until it is
+// unlocked.
+func (app App) inUse(ctx context.Context, active *os.File) (bool, error) {
+	locked, err := tryFlock(active, syscall.LOCK_EX)
+	if err != nil {
+		return false, err
+	}
+	if !locked {
+		return true, nil
+	}
+	sessions, err := app.Sessions(ctx)
+	if err != nil || len(sessions) > 0 {
+		syscall.Flock(int(active.Fd()), syscall.LOCK_UN)
+		return true, err
+	}
+	return false, nil
+}
+
+// IdleWatch stops the instance once no shells or sessions have used it for
+// Config.IdleStop, and returns when the instance is stopped, by itself or
+// otherwise.  Only one idle watcher runs per instance, others return at
+// once.
+func (app App) IdleWatch(ctx context.Context) error {
+	if app.Config.IdleStop <= 0 {
+		return errors.New("idle_stop is not configured")
+	}
+	file, err := app.openState(idleSuffix)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if locked, err := tryFlock(file, syscall.LOCK_EX); !locked || err != nil {
+		slog.Debug("idle watcher already running")
+		return err
+	}
+	active, err := app.openState(activeSuffix)
+	if err != nil {
+		return err
+	}
+	defer active.Close()
+
+	state := IdleState{PID: os.Getpid()}
+	idleSince := timeNow()
+	for {
+		fields, err := app.info(ctx)
+		if err != nil {
+			return err
+		}
+		if fields["Status"] != "RUNNING" {
+			slog.Debug("instance not running, idle watcher done")
+			return nil
+		}
+
+		busy, err := app.inUse(ctx, active)
+		if err != nil {
+			slog.Warn("failed to check if instance is in use", "error", err)
+		}
+		if busy {
+			idleSince = timeNow()
+			state.StopAt = time.Time{}
+		} else {
+			state.StopAt = idleSince.Add(app.Config.IdleStop)
+			if !timeNow().Before(state.StopAt) {
+				slog.Info("stopping idle instance", "instance", app.Name())
+				err := runQuiet(ctx, "lxc", "stop", app.Name())
+				syscall.Flock(int(active.Fd()), syscall.LOCK_UN)
+				if err != nil {
+					return fmt.Errorf("failed to stop instance: %w", err)
+				}
+				return nil
+			}
+			syscall.Flock(int(active.Fd()), syscall.LOCK_UN)
+		}
+
+		data, err := yaml.Marshal(state)
+		if err != nil {
+			return err
+		}
+		if err := writeAll(file, data); err != nil {
+			return err
+		}
+		if err := sleep(ctx, min(idlePoll, app.Config.IdleStop)); err != nil {
+			return nil
+		}
+	}
+}
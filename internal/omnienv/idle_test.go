@@ -0,0 +1,131 @@
+package omnienv
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdleWatchStops(t *testing.T) {
+	defer patchClock()()
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	app := testApp(nil)
+	app.Config.IdleStop = time.Minute
+	var cmds []*exec.Cmd
+	for range 3 {
+		cmds = append(cmds,
+			exec.Command("/bin/echo", "Status: RUNNING"), // IdleWatch
+			exec.Command("/bin/echo", "Status: RUNNING"), // Sessions
+			exec.Command("/bin/true"),                    // tmux list-sessions
+		)
+	}
+	restoreCmd, calls := patchCommands(cmds...)
+	defer restoreCmd()
+
+	assert.Nil(t, app.IdleWatch(context.Background()))
+	require.Len(t, *calls, 10)
+	assert.Equal(t, []string{"lxc", "stop", "l-s"}, (*calls)[9])
+}
+
+func TestIdleWatchInUse(t *testing.T) {
+	defer patchClock()()
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	app := testApp(nil)
+	app.Config.IdleStop = time.Minute
+	release, err := app.markActive(context.Background())
+	assert.Nil(t, err)
+	defer release()
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/echo", "Status: RUNNING"),
+		exec.Command("/bin/echo", "Status: STOPPED"),
+	)
+	defer restoreCmd()
+
+	assert.Nil(t, app.IdleWatch(context.Background()))
+	// the shell is seen without looking for sessions
+	assert.Len(t, *calls, 2)
+	data, err := os.ReadFile(filepath.Join(lockDir(), "l-s"+idleSuffix))
+	assert.Nil(t, err)
+	assert.Equal(t, "pid: "+strconv.Itoa(os.Getpid())+"\n", string(data))
+}
+
+func TestIdleWatchSessions(t *testing.T) {
+	defer patchClock()()
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	app := testApp(nil)
+	app.Config.IdleStop = time.Minute
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/echo", "Status: RUNNING"),
+		exec.Command("/bin/echo", "Status: RUNNING"),
+		exec.Command("/bin/printf", "main\t1735787045\t0\t/src/proj\tmake\n"),
+		exec.Command("/bin/false"),
+		exec.Command("/bin/true"), // lxc list
+	)
+	defer restoreCmd()
+
+	assert.ErrorIs(t, app.IdleWatch(context.Background()), ErrInstanceNotFound)
+	assert.Len(t, *calls, 5)
+}
+
+func TestIdleWatchAlreadyRunning(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	app := testApp(nil)
+	app.Config.IdleStop = time.Minute
+	file, err := app.openState(idleSuffix)
+	assert.Nil(t, err)
+	defer file.Close()
+	assert.Nil(t, syscall.Flock(int(file.Fd()), syscall.LOCK_EX))
+	restoreCmd, calls := patchCommands()
+	defer restoreCmd()
+
+	assert.Nil(t, app.IdleWatch(context.Background()))
+	assert.Empty(t, *calls)
+}
+
+func TestIdleWatchNotConfigured(t *testing.T) {
+	err := App{}.IdleWatch(context.Background())
+	assert.ErrorContains(t, err, "idle_stop is not configured")
+}
+
+func TestEnsureIdleWatch(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	app := testApp(nil)
+	app.Config.IdleStop = time.Minute
+	app.Opts.System = "noble"
+	var spawned [][]string
+	defer Patch(&spawn, func(args ...string) error {
+		spawned = append(spawned, args)
+		return nil
+	})()
+
+	app.ensureIdleWatch()
+	assert.Equal(t, [][]string{{"idle-watch", "--system", "noble"}}, spawned)
+
+	// not while one is running
+	file, err := app.openState(idleSuffix)
+	assert.Nil(t, err)
+	defer file.Close()
+	assert.Nil(t, syscall.Flock(int(file.Fd()), syscall.LOCK_EX))
+	assert.Nil(t, writeAll(file, []byte("pid: 42\nstop_at: 2025-01-02T03:04:05Z\n")))
+	app.ensureIdleWatch()
+	assert.Len(t, spawned, 1)
+
+	state, running, err := app.readIdleState()
+	assert.Nil(t, err)
+	assert.True(t, running)
+	assert.Equal(t, IdleState{PID: 42, StopAt: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)}, state)
+
+	// or when not configured
+	app.Config.IdleStop = 0
+	assert.Nil(t, file.Close())
+	app.ensureIdleWatch()
+	assert.Len(t, spawned, 1)
+}
@@ -0,0 +1,122 @@
+package omnienv
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+// baseImageKey is the LXD config key holding the fingerprint of the image
+// an instance was created from.
+const baseImageKey = "volatile.base_image"
+
+// isLocalImage reports if the image is in the local image store, such as
+// those created by Publish, rather than on a remote.
+func isLocalImage(image string) bool {
+	return !strings.Contains(image, ":") || strings.HasPrefix(image, "local:")
+}
+
+// PullImage copies the launch image to the local image store ahead of
+// Launch, so that launching does not stall on the download.
+func (app App) PullImage(ctx context.Context) error {
+	image := app.launchImage()
+	if isLocalImage(image) {
+		slog.Info("image is already local", "image", image)
+		return nil
+	}
+	if err := app.backend().PullImage(ctx, image, app.Config.isVM()); err != nil {
+		return fmt.Errorf("failed to pull %s: %w", image, err)
+	}
+	return nil
+}
+
+// Outdated is an omnienv instance created from an image that has since been
+// updated on its remote.
+type Outdated struct {
+	Instance string
+	Image    string
+	// Fingerprint is that of the image the instance was created from.
+	Fingerprint string
+	// Latest is the fingerprint the image now resolves to.
+	Latest string
+}
+
+// OutdatedInstances compares the image that each omnienv instance was
+// created from against the current image on the remote.
+func (app App) OutdatedInstances(ctx context.Context) ([]Outdated, error) {
+	instances, err := app.backend().ListInstances(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list instances: %w", err)
+	}
+
+	// an image alias resolves to different images for containers and VMs
+	type remoteImage struct {
+		image string
+		vm    bool
+	}
+	latest := map[remoteImage]string{}
+	var outdated []Outdated
+	for _, instance := range instances {
+		image := instance.Config[metaPrefix+imageKey]
+		fingerprint := instance.Config[baseImageKey]
+		if image == "" || fingerprint == "" || isLocalImage(image) {
+			continue
+		}
+
+		key := remoteImage{image, instance.isVM()}
+		if _, found := latest[key]; !found {
+			remote, err := app.backend().RemoteFingerprint(ctx, image, key.vm)
+			if err != nil {
+				return nil, fmt.Errorf("failed to look up %s: %w", image, err)
+			}
+			latest[key] = remote
+		}
+		if latest[key] != fingerprint {
+			outdated = append(outdated, Outdated{
+				Instance:    instance.Name,
+				Image:       image,
+				Fingerprint: fingerprint,
+				Latest:      latest[key],
+			})
+		}
+	}
+
+	slices.SortFunc(outdated, func(a, b Outdated) int {
+		return strings.Compare(a.Instance, b.Instance)
+	})
+	return outdated, nil
+}
+
+// warnStaleImage warns if the instance was created from an image older
+// than Config.StaleImageDays.  Problems finding the age are not fatal, as
+// the image may no longer be cached.
+func (app App) warnStaleImage(ctx context.Context) {
+	if app.Config.StaleImageDays <= 0 {
+		return
+	}
+
+	cmd := commandContext(ctx, "lxc", "config", "get", app.Name(), baseImageKey)
+	slog.Debug("run", "command", cmd.Args)
+	out, err := cmd.Output()
+	fingerprint := strings.TrimSpace(string(out))
+	if err != nil || fingerprint == "" {
+		slog.Debug("no base image", "instance", app.Name(), "error", err)
+		return
+	}
+	image, err := app.backend().GetImage(ctx, fingerprint)
+	if err != nil {
+		slog.Debug("base image unknown", "fingerprint", fingerprint, "error", err)
+		return
+	}
+
+	days := int(timeNow().Sub(image.Created) / (24 * time.Hour))
+	if days > app.Config.StaleImageDays {
+		slog.Warn(
+			"base image is stale, consider oe images pull and --launch=always",
+			"instance", app.Name(), "days", days,
+		)
+	}
+}
@@ -0,0 +1,172 @@
+package omnienv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var pullImageTests = []struct {
+	summary string
+	config  Config
+
+	calls []string
+}{{
+	summary: "remote",
+	config:  Config{Label: "l", System: NewSystem("noble")},
+	calls:   []string{"pull ubuntu-daily:noble"},
+}, {
+	summary: "vm",
+	config:  Config{Label: "l", System: NewSystem("noble"), Virtualization: "vm"},
+	calls:   []string{"pull ubuntu-daily:noble --vm"},
+}, {
+	summary: "published",
+	config:  Config{Label: "l", System: System{Name: "noble", Image: "local:team/go"}},
+}, {
+	summary: "no remote",
+	config:  Config{Label: "l", System: System{Name: "noble", Image: "team/go"}},
+}}
+
+func TestPullImage(t *testing.T) {
+	for _, test := range pullImageTests {
+		fake := &fakeBackend{}
+		app := App{Config: test.config, Backend: fake}
+		assert.Nil(t, app.PullImage(context.Background()), test.summary)
+		assert.Equal(t, test.calls, fake.calls, test.summary)
+	}
+}
+
+func TestPullImageFails(t *testing.T) {
+	fake := &fakeBackend{err: errors.New("boom")}
+	app := App{Config: Config{Label: "l", System: NewSystem("noble")}, Backend: fake}
+	err := app.PullImage(context.Background())
+	assert.ErrorContains(t, err, "failed to pull ubuntu-daily:noble: boom")
+}
+
+func TestOutdatedInstances(t *testing.T) {
+	fake := &fakeBackend{
+		instances: []Instance{{
+			Name: "b-noble",
+			Config: map[string]string{
+				"user.omnienv.image": "ubuntu-daily:noble", baseImageKey: "old",
+			},
+		}, {
+			Name: "a-noble",
+			Config: map[string]string{
+				"user.omnienv.image": "ubuntu-daily:noble", baseImageKey: "old",
+			},
+		}, {
+			Name: "c-noble",
+			Config: map[string]string{
+				"user.omnienv.image": "ubuntu-daily:noble", baseImageKey: "new",
+			},
+		}, {
+			Name: "vm-noble",
+			Type: "virtual-machine",
+			Config: map[string]string{
+				"user.omnienv.image": "ubuntu-daily:noble", baseImageKey: "new-vm",
+			},
+		}, {
+			Name:   "unmanaged",
+			Config: map[string]string{baseImageKey: "old"},
+		}, {
+			Name: "published",
+			Config: map[string]string{
+				"user.omnienv.image": "local:team/go", baseImageKey: "old",
+			},
+		}},
+		remote: map[string]string{
+			"ubuntu-daily:noble":      "new",
+			"ubuntu-daily:noble --vm": "new-vm",
+		},
+	}
+	outdated, err := App{Backend: fake}.OutdatedInstances(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []Outdated{
+		{Instance: "a-noble", Image: "ubuntu-daily:noble", Fingerprint: "old", Latest: "new"},
+		{Instance: "b-noble", Image: "ubuntu-daily:noble", Fingerprint: "old", Latest: "new"},
+	}, outdated)
+	// the remote is asked once per image and instance type
+	assert.Equal(t, []string{
+		"instances", "remote ubuntu-daily:noble", "remote ubuntu-daily:noble --vm",
+	}, fake.calls)
+}
+
+func TestOutdatedInstancesFails(t *testing.T) {
+	fake := &fakeBackend{err: errors.New("boom")}
+	_, err := App{Backend: fake}.OutdatedInstances(context.Background())
+	assert.ErrorContains(t, err, "failed to list instances: boom")
+}
+
+// patchLog captures warnings logged during the test.
+func patchLog(t *testing.T) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	orig := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(orig) })
+	return buf
+}
+
+var staleImageTests = []struct {
+	summary string
+	days    int
+	cmd     *exec.Cmd
+	created time.Time
+
+	calls int
+	warns bool
+}{{
+	summary: "disabled",
+	days:    0,
+}, {
+	summary: "fresh",
+	days:    7,
+	cmd:     exec.Command("/bin/echo", "abc"),
+	created: time.Date(2025, 1, 5, 0, 0, 0, 0, time.UTC),
+	calls:   1,
+}, {
+	summary: "stale",
+	days:    7,
+	cmd:     exec.Command("/bin/echo", "abc"),
+	created: time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC),
+	calls:   1,
+	warns:   true,
+}, {
+	summary: "no base image",
+	days:    7,
+	cmd:     exec.Command("/bin/false"),
+	calls:   1,
+}}
+
+func TestWarnStaleImage(t *testing.T) {
+	restoreClock := Patch(&timeNow, func() time.Time {
+		return time.Date(2025, 1, 10, 0, 0, 0, 0, time.UTC)
+	})
+	defer restoreClock()
+
+	for _, test := range staleImageTests {
+		buf := patchLog(t)
+		restoreCmd, calls := patchCommands(test.cmd)
+		fake := &fakeBackend{images: []Image{{Fingerprint: "abc", Created: test.created}}}
+		app := App{
+			Config:  Config{Label: "l", System: NewSystem("s"), StaleImageDays: test.days},
+			Backend: fake,
+		}
+		app.warnStaleImage(context.Background())
+		restoreCmd()
+		require.Len(t, *calls, test.calls, test.summary)
+		if test.calls > 0 {
+			assert.Equal(t, []string{
+				"lxc", "config", "get", "l-s", "volatile.base_image",
+			}, (*calls)[0], test.summary)
+		}
+		assert.Equal(t, test.warns, bytes.Contains(buf.Bytes(), []byte("stale")), test.summary)
+	}
+}
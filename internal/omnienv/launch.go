@@ -0,0 +1,365 @@
+package omnienv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Values for Opts.Launch.  The empty string is equivalent to LaunchNever.
+const (
+	LaunchAlways  = "always"
+	LaunchMissing = "missing"
+	LaunchNever   = "never"
+)
+
+// The image an instance was launched from is recorded in instance metadata
+// under this key.
+const imageKey = "image"
+
+// Launch progress is recorded in instance metadata under this key, as the
+// name of the step in progress, or launchDone once all steps succeed.
+const (
+	launchStepKey = "launch-step"
+	launchDone    = "done"
+)
+
+type launchStep struct {
+	name string
+	run  func(context.Context) error
+}
+
+func (app App) launchSteps() []launchStep {
+	return []launchStep{
+		{"create", app.create},
+		{"wait", app.waitBuiltin},
+		{"use_pty", app.setupUsePty},
+		{"lp1878225", app.workaroundLp1878225},
+		{"cloud-init", app.cloudInitWait},
+	}
+}
+
+func (app App) create(ctx context.Context) error {
+	// to snapshot before first boot, create without starting
+	verb := "launch"
+	if app.Config.SnapshotBeforeProvision {
+		verb = "init"
+	}
+	// record the step as part of creation, so that an instance created
+	// but failing to start is known to be incomplete.  Not part of
+	// lxdLaunchConfig, which is compared to tell config drift.
+	args := []string{
+		"lxc", verb, app.launchImage(), app.Name(),
+		"--config", metaPrefix + launchStepKey + "=create",
+	}
+	if app.Config.isVM() {
+		args = append(args, "--vm")
+	}
+
+	cmd := commandContext(ctx, args[0], args[1:]...)
+	slog.Debug("run", "command", args)
+	cmd.Stdout = os.Stdout
+	user := CurrentUserInfo()
+	cmd.Stdin = bytes.NewReader([]byte(app.Config.lxdLaunchConfig(user)))
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to create instance: %w", err)
+	}
+	if err := app.setMeta(ctx, imageKey, app.launchImage()); err != nil {
+		return err
+	}
+	if err := app.recordConfig(ctx); err != nil {
+		return err
+	}
+
+	if !app.Config.SnapshotBeforeProvision {
+		return nil
+	}
+	if err := app.snapshot(ctx, preProvisionSnapshot); err != nil {
+		return fmt.Errorf("pre-provision snapshot failure: %w", err)
+	}
+	return app.start(ctx)
+}
+
+func (app App) waitBuiltin(ctx context.Context) error {
+	// only the builtin probes here, configured probes may depend on
+	// provisioning that has not happened yet
+	probes, err := app.defaultProbes(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to wait for instance: %w", err)
+	}
+	if err := app.waitFor(ctx, probes); err != nil {
+		return fmt.Errorf("failed to wait for instance: %w", err)
+	}
+	return nil
+}
+
+func (app App) setupUsePty(ctx context.Context) error {
+	use_pty := []string{
+		"sh", "-c", "echo 'Defaults use_pty' > /etc/sudoers.d/use_pty",
+	}
+	if err := app.lxcExec(ctx, use_pty...); err != nil {
+		return fmt.Errorf("use_pty setup failure: %w", err)
+	}
+	return nil
+}
+
+func (app App) workaroundLp1878225(ctx context.Context) error {
+	if err := app.lp1878225Quirk(ctx); err != nil {
+		return fmt.Errorf("LP #1878225 workaround failure: %w", err)
+	}
+	return nil
+}
+
+func (app App) cloudInitWait(ctx context.Context) error {
+	if err := app.lxcExec(ctx, "cloud-init", "status", "--wait"); err != nil {
+		return fmt.Errorf("cloud-init failure: %w", err)
+	}
+	return nil
+}
+
+// resumePoint finds the index of the first step that has not completed.
+// An instance left part way through create is deleted to start over.
+func (app App) resumePoint(ctx context.Context, steps []launchStep) (int, error) {
+	recorded, err := app.getMeta(ctx, launchStepKey)
+	if err != nil {
+		// most likely the instance was never created
+		slog.Debug("resume from start", "error", err)
+		return 0, nil
+	}
+
+	switch recorded {
+	case launchDone:
+		return len(steps), nil
+	case "":
+		// created before launch steps were recorded, and everything
+		// after create is safe to repeat
+		return 1, nil
+	}
+	for i, step := range steps {
+		if step.name != recorded {
+			continue
+		}
+		if i == 0 {
+			// the instance was created but did not start, which
+			// only creating it afresh can repair
+			if err := app.Delete(ctx); err != nil {
+				return 0, err
+			}
+		}
+		return i, nil
+	}
+	return 0, fmt.Errorf("unknown launch step %q recorded", recorded)
+}
+
+// rollback deletes the instance after a failed launch step.
+func (app App) rollback(ctx context.Context, err error) error {
+	// the launch context being cancelled may be why the step failed
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+	defer cancel()
+
+	if rbErr := app.Delete(ctx); rbErr != nil {
+		return fmt.Errorf("%w (rollback also failed: %v)", err, rbErr)
+	}
+	slog.Info("rolled back failed launch", "instance", app.Name())
+	return err
+}
+
+// Launch creates and provisions the instance.  Each step is recorded in
+// instance metadata before it runs, so that a failed launch can be
+// continued with Opts.Resume, or removed with Opts.RollbackOnFailure.
+func (app App) Launch(ctx context.Context) error {
+	unlock, err := app.lock(ctx, "launch")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return app.launch(ctx)
+}
+
+func (app App) launch(ctx context.Context) error {
+	steps := app.launchSteps()
+	start := 0
+	if app.Opts.Resume {
+		var err error
+		if start, err = app.resumePoint(ctx, steps); err != nil {
+			return err
+		}
+		if start == len(steps) {
+			slog.Info("launch already complete", "instance", app.Name())
+			return nil
+		}
+		slog.Debug("resuming launch", "step", steps[start].name)
+	}
+
+	for _, step := range steps[start:] {
+		// create records its step as it creates the instance
+		if step.name != "create" {
+			if err := app.setMeta(ctx, launchStepKey, step.name); err != nil {
+				return err
+			}
+		} else {
+			app.recordLaunch()
+		}
+
+		started := timeNow()
+		err := step.run(ctx)
+		app.recordStep(step.name, started, err)
+		if err != nil {
+			// a failed create may or may not have left the instance
+			if step.name == "create" {
+				if exists, existsErr := app.Exists(ctx); existsErr != nil || !exists {
+					return err
+				}
+			}
+			if app.Opts.RollbackOnFailure {
+				return app.rollback(ctx, err)
+			}
+			if ctx.Err() != nil && app.confirm(fmt.Sprintf(
+				"Launch of %s was interrupted, delete the partially "+
+					"provisioned instance (keep it to continue with "+
+					"--launch --resume)?", app.Name(),
+			)) {
+				return app.rollback(ctx, err)
+			}
+			return err
+		}
+	}
+
+	return app.setMeta(ctx, launchStepKey, launchDone)
+}
+
+// Exists reports if the instance has been created.
+func (app App) Exists(ctx context.Context) (bool, error) {
+	cmd := commandContext(
+		ctx, "lxc", "list", "--format", "csv", "--columns", "n",
+		"^"+regexp.QuoteMeta(app.Name())+"$",
+	)
+	slog.Debug("run", "command", cmd.Args)
+	out, err := cmd.Output()
+	if err != nil {
+		return false, fmt.Errorf("failed to list instances: %w", err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.TrimSpace(line) == app.Name() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// mismatches describes how the existing instance differs from what Launch
+// would create.
+func (app App) mismatches(ctx context.Context) ([]string, error) {
+	var diffs []string
+
+	vm, err := app.isVM(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if vm != app.Config.isVM() {
+		have, want := "container", "vm"
+		if vm {
+			have, want = want, have
+		}
+		diffs = append(diffs, fmt.Sprintf(
+			"virtualization is %s, config wants %s", have, want,
+		))
+	}
+
+	image, err := app.getMeta(ctx, imageKey)
+	if err != nil {
+		return nil, err
+	}
+	// instances launched by older versions have no image recorded
+	if image != "" && image != app.launchImage() {
+		diffs = append(diffs, fmt.Sprintf(
+			"image is %s, config wants %s", image, app.launchImage(),
+		))
+	}
+	return diffs, nil
+}
+
+func (app App) recreate(ctx context.Context) error {
+	if err := app.Delete(ctx); err != nil {
+		return err
+	}
+	return app.launch(ctx)
+}
+
+// resumeIncomplete continues the launch of an existing instance if it did
+// not complete, such as after a failed or interrupted launch.
+func (app App) resumeIncomplete(ctx context.Context) error {
+	step, err := app.getMeta(ctx, launchStepKey)
+	if err != nil {
+		return err
+	}
+	// instances launched by older versions have no step recorded
+	if step == "" || step == launchDone {
+		slog.Debug("instance exists", "instance", app.Name())
+		return nil
+	}
+	slog.Info("resuming incomplete launch", "instance", app.Name(), "step", step)
+	app.Opts.Resume = true
+	return app.launch(ctx)
+}
+
+// EnsureLaunched creates the instance as directed by Opts.Launch.  With
+// LaunchMissing an existing instance is kept if it matches the config,
+// with its launch resumed if incomplete, otherwise Confirm is consulted
+// before replacing it.  LaunchAlways replaces any existing instance, after
+// confirmation.
+func (app App) EnsureLaunched(ctx context.Context) error {
+	mode := app.Opts.Launch
+	if mode == "" || mode == LaunchNever {
+		return nil
+	}
+	unlock, err := app.lock(ctx, "launch")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	exists, err := app.Exists(ctx)
+	if err != nil {
+		return err
+	}
+	// resuming may delete the instance, as may a rollback
+	if exists {
+		if err := app.checkOwner(ctx); err != nil {
+			return err
+		}
+	}
+	if !exists || app.Opts.Resume {
+		return app.launch(ctx)
+	}
+
+	if mode == LaunchAlways {
+		if !app.confirm(fmt.Sprintf("Replace existing instance %s?", app.Name())) {
+			return fmt.Errorf("not replacing existing instance %s", app.Name())
+		}
+		return app.recreate(ctx)
+	}
+
+	diffs, err := app.mismatches(ctx)
+	if err != nil {
+		return err
+	}
+	if len(diffs) == 0 {
+		return app.resumeIncomplete(ctx)
+	}
+
+	for _, diff := range diffs {
+		slog.Warn("existing instance differs from config", "instance", app.Name(), "difference", diff)
+	}
+	if !app.confirm(fmt.Sprintf("Recreate instance %s to match the config?", app.Name())) {
+		slog.Warn("keeping existing instance", "instance", app.Name())
+		return nil
+	}
+	return app.recreate(ctx)
+}
@@ -0,0 +1,667 @@
+package omnienv
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLaunchContainerOk(t *testing.T) {
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/true"),                    // lxc launch
+		exec.Command("/bin/true"),                    // record image
+		exec.Command("/bin/true"),                    // record root-dir and config
+		exec.Command("/bin/true"),                    // record wait
+		exec.Command("/bin/echo", "Type: container"), // lxc info
+		exec.Command("/bin/true"),                    // user probe
+		exec.Command("/bin/true"),                    // record use_pty
+		exec.Command("/bin/true"),                    // lxc exec use_pty
+		exec.Command("/bin/true"),                    // record lp1878225
+		exec.Command("/bin/echo", "Debian"),          // lsb_release
+		exec.Command("/bin/true"),                    // record cloud-init
+		exec.Command("/bin/true"),                    // lxc exec cloud-init
+		exec.Command("/bin/true"),                    // record done
+	)
+	defer restoreCmd()
+
+	app := App{Config: Config{Label: "l", System: NewSystem("s"), RootDir: "/src/l"}}
+	assert.Nil(t, app.Launch(context.Background()))
+	require.Len(t, *calls, 13)
+	assert.Equal(t,
+		[]string{"lxc", "config", "set", "l-s", "user.omnienv.image=ubuntu-daily:s"},
+		(*calls)[1],
+	)
+	hash, err := app.configHash()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"user.omnienv.config-hash=" + hash,
+		"user.omnienv.root-dir=/src/l",
+	}, (*calls)[2][5:])
+	assert.Equal(t,
+		[]string{"lxc", "config", "set", "l-s", "user.omnienv.launch-step=done"},
+		(*calls)[12],
+	)
+}
+
+func TestLaunchLaunchFails(t *testing.T) {
+	restoreCmd, calls := patchCommands(exec.Command("/bin/false"))
+	defer restoreCmd()
+
+	app := App{
+		Config: Config{Label: "l", System: NewSystem("s")},
+		Opts:   Opts{RollbackOnFailure: true},
+	}
+	err := app.Launch(context.Background())
+	assert.ErrorContains(t, err, "failed to create instance")
+	require.Len(t, *calls, 2)
+	assert.Equal(t, []string{
+		"lxc", "launch", "ubuntu-daily:s", "l-s",
+		"--config", "user.omnienv.launch-step=create",
+	}, (*calls)[0])
+	// nothing to roll back
+}
+
+func TestLaunchCreatedNotStarted(t *testing.T) {
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/false"),       // lxc launch
+		exec.Command("/bin/echo", "l-s"), // lxc list
+		exec.Command("/bin/true"),        // lxc delete
+	)
+	defer restoreCmd()
+
+	app := App{
+		Config: Config{Label: "l", System: NewSystem("s")},
+		Opts:   Opts{RollbackOnFailure: true},
+	}
+	err := app.Launch(context.Background())
+	assert.ErrorContains(t, err, "failed to create instance")
+	require.Len(t, *calls, 3)
+	assert.Equal(t, []string{"lxc", "delete", "--force", "l-s"}, (*calls)[2])
+}
+
+func TestLaunchRecordFails(t *testing.T) {
+	restoreCmd, _ := patchCommands(
+		exec.Command("/bin/true"),  // lxc launch
+		exec.Command("/bin/true"),  // record image
+		exec.Command("/bin/true"),  // record root-dir and config
+		exec.Command("/bin/false"), // record wait
+	)
+	defer restoreCmd()
+
+	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+	err := app.Launch(context.Background())
+	assert.ErrorContains(t, err, "failed to set launch-step")
+}
+
+func TestLaunchWaitFails(t *testing.T) {
+	restoreCmd, _ := patchCommands(
+		exec.Command("/bin/true"),  // lxc launch
+		exec.Command("/bin/true"),  // record image
+		exec.Command("/bin/true"),  // record root-dir and config
+		exec.Command("/bin/true"),  // record wait
+		exec.Command("/bin/false"), // lxc info
+	)
+	defer restoreCmd()
+
+	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+	err := app.Launch(context.Background())
+	assert.ErrorContains(t, err, "failed to wait for instance")
+}
+
+func TestLaunchUsePtyFails(t *testing.T) {
+	restoreCmd, _ := patchCommands(
+		exec.Command("/bin/true"),                    // lxc launch
+		exec.Command("/bin/true"),                    // record image
+		exec.Command("/bin/true"),                    // record root-dir and config
+		exec.Command("/bin/true"),                    // record wait
+		exec.Command("/bin/echo", "Type: container"), // lxc info
+		exec.Command("/bin/true"),                    // user probe
+		exec.Command("/bin/true"),                    // record use_pty
+		exec.Command("/bin/false"),                   // lxc exec use_pty
+	)
+	defer restoreCmd()
+
+	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+	err := app.Launch(context.Background())
+	assert.ErrorContains(t, err, "use_pty setup failure")
+}
+
+func TestLaunchQuirkFails(t *testing.T) {
+	restoreCmd, _ := patchCommands(
+		exec.Command("/bin/true"),                    // lxc launch
+		exec.Command("/bin/true"),                    // record image
+		exec.Command("/bin/true"),                    // record root-dir and config
+		exec.Command("/bin/true"),                    // record wait
+		exec.Command("/bin/echo", "Type: container"), // lxc info
+		exec.Command("/bin/true"),                    // user probe
+		exec.Command("/bin/true"),                    // record use_pty
+		exec.Command("/bin/true"),                    // lxc exec use_pty
+		exec.Command("/bin/true"),                    // record lp1878225
+		exec.Command("/bin/printf", "Distributor ID: Ubuntu\nRelease: 22.04"),
+		exec.Command("/bin/false"), // lxc exec bus wait (quirk)
+	)
+	defer restoreCmd()
+
+	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+	err := app.Launch(context.Background())
+	assert.ErrorContains(t, err, "LP #1878225 workaround failure")
+}
+
+func TestLaunchCloudInitFails(t *testing.T) {
+	restoreCmd, _ := patchCommands(
+		exec.Command("/bin/true"),                    // lxc launch
+		exec.Command("/bin/true"),                    // record image
+		exec.Command("/bin/true"),                    // record root-dir and config
+		exec.Command("/bin/true"),                    // record wait
+		exec.Command("/bin/echo", "Type: container"), // lxc info
+		exec.Command("/bin/true"),                    // user probe
+		exec.Command("/bin/true"),                    // record use_pty
+		exec.Command("/bin/true"),                    // lxc exec use_pty
+		exec.Command("/bin/true"),                    // record lp1878225
+		exec.Command("/bin/echo", "Debian"),          // lsb_release
+		exec.Command("/bin/true"),                    // record cloud-init
+		exec.Command("/bin/false"),                   // lxc exec cloud-init
+	)
+	defer restoreCmd()
+
+	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+	err := app.Launch(context.Background())
+	assert.ErrorContains(t, err, "cloud-init failure")
+}
+
+func TestLaunchRollbackOnFailure(t *testing.T) {
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/true"),                    // lxc launch
+		exec.Command("/bin/true"),                    // record image
+		exec.Command("/bin/true"),                    // record root-dir and config
+		exec.Command("/bin/true"),                    // record wait
+		exec.Command("/bin/echo", "Type: container"), // lxc info
+		exec.Command("/bin/true"),                    // user probe
+		exec.Command("/bin/true"),                    // record use_pty
+		exec.Command("/bin/false"),                   // lxc exec use_pty
+		exec.Command("/bin/true"),                    // lxc delete
+	)
+	defer restoreCmd()
+
+	app := App{
+		Config: Config{Label: "l", System: NewSystem("s")},
+		Opts:   Opts{RollbackOnFailure: true},
+	}
+	err := app.Launch(context.Background())
+	assert.ErrorContains(t, err, "use_pty setup failure")
+	require.Len(t, *calls, 9)
+	assert.Equal(t, []string{"lxc", "delete", "--force", "l-s"}, (*calls)[8])
+}
+
+func TestLaunchRollbackFails(t *testing.T) {
+	restoreCmd, _ := patchCommands(
+		exec.Command("/bin/true"),  // lxc launch
+		exec.Command("/bin/true"),  // record image
+		exec.Command("/bin/true"),  // record root-dir and config
+		exec.Command("/bin/true"),  // record wait
+		exec.Command("/bin/false"), // lxc info
+		exec.Command("/bin/false"), // lxc list
+		exec.Command("/bin/false"), // lxc delete
+	)
+	defer restoreCmd()
+
+	app := App{
+		Config: Config{Label: "l", System: NewSystem("s")},
+		Opts:   Opts{RollbackOnFailure: true},
+	}
+	err := app.Launch(context.Background())
+	assert.ErrorContains(t, err, "failed to wait for instance")
+	assert.ErrorContains(t, err, "rollback also failed")
+}
+
+var resumeTests = []struct {
+	summary string
+	cmd     *exec.Cmd
+
+	next   string
+	errMsg string
+}{{
+	summary: "never created",
+	cmd:     exec.Command("/bin/false"),
+	next:    "create",
+}, {
+	summary: "created, not started",
+	cmd:     exec.Command("/bin/echo", "create"),
+	next:    "create",
+}, {
+	summary: "unrecorded",
+	cmd:     exec.Command("/bin/echo", ""),
+	next:    "wait",
+}, {
+	summary: "interrupted",
+	cmd:     exec.Command("/bin/echo", "use_pty"),
+	next:    "use_pty",
+}, {
+	summary: "done",
+	cmd:     exec.Command("/bin/echo", "done"),
+	next:    "",
+}, {
+	summary: "unknown",
+	cmd:     exec.Command("/bin/echo", "bogus"),
+	errMsg:  `unknown launch step "bogus"`,
+}}
+
+func TestResumePoint(t *testing.T) {
+	for _, test := range resumeTests {
+		restoreCmd, _ := patchCommands(test.cmd)
+		app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+		steps := app.launchSteps()
+		start, err := app.resumePoint(context.Background(), steps)
+		restoreCmd()
+		if test.errMsg != "" {
+			assert.ErrorContains(t, err, test.errMsg, test.summary)
+			continue
+		}
+		assert.Nil(t, err, test.summary)
+		if test.next == "" {
+			assert.Equal(t, len(steps), start, test.summary)
+		} else {
+			assert.Equal(t, test.next, steps[start].name, test.summary)
+		}
+	}
+}
+
+func TestLaunchResume(t *testing.T) {
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/echo", "cloud-init"), // recorded step
+		exec.Command("/bin/true"),               // record cloud-init
+		exec.Command("/bin/true"),               // lxc exec cloud-init
+		exec.Command("/bin/true"),               // record done
+	)
+	defer restoreCmd()
+
+	app := App{
+		Config: Config{Label: "l", System: NewSystem("s")},
+		Opts:   Opts{Resume: true},
+	}
+	assert.Nil(t, app.Launch(context.Background()))
+	require.Len(t, *calls, 4)
+	assert.Equal(t, []string{
+		"lxc", "exec", "l-s", "--", "cloud-init", "status", "--wait",
+	}, (*calls)[2])
+}
+
+func TestLaunchResumeDone(t *testing.T) {
+	restoreCmd, calls := patchCommands(exec.Command("/bin/echo", "done"))
+	defer restoreCmd()
+
+	app := App{
+		Config: Config{Label: "l", System: NewSystem("s")},
+		Opts:   Opts{Resume: true},
+	}
+	assert.Nil(t, app.Launch(context.Background()))
+	assert.Len(t, *calls, 1)
+}
+
+func TestLaunchInterruptedConfirmRollback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/true"),                    // lxc launch
+		exec.Command("/bin/true"),                    // record image
+		exec.Command("/bin/true"),                    // record root-dir and config
+		exec.Command("/bin/true"),                    // record wait
+		exec.Command("/bin/echo", "Type: container"), // lxc info
+		exec.Command("/bin/false"),                   // user probe
+		exec.Command("/bin/true"),                    // lxc delete
+	)
+	defer restoreCmd()
+
+	var asked string
+	app := App{
+		Config:  Config{Label: "l", System: NewSystem("s")},
+		Confirm: func(question string) bool { asked = question; return true },
+	}
+	err := app.Launch(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Contains(t, asked, "Launch of l-s was interrupted")
+	require.Len(t, *calls, 7)
+	assert.Equal(t, []string{"lxc", "delete", "--force", "l-s"}, (*calls)[6])
+}
+
+func TestLaunchInterruptedNoConfirm(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/true"),                    // lxc launch
+		exec.Command("/bin/true"),                    // record image
+		exec.Command("/bin/true"),                    // record root-dir and config
+		exec.Command("/bin/true"),                    // record wait
+		exec.Command("/bin/echo", "Type: container"), // lxc info
+		exec.Command("/bin/false"),                   // user probe
+	)
+	defer restoreCmd()
+
+	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+	err := app.Launch(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Len(t, *calls, 6)
+}
+
+var existsTests = []struct {
+	summary string
+	cmd     *exec.Cmd
+
+	exists bool
+	errMsg string
+}{{
+	summary: "exists",
+	cmd:     exec.Command("/bin/echo", "l-s"),
+	exists:  true,
+}, {
+	summary: "missing",
+	cmd:     exec.Command("/bin/true"),
+	exists:  false,
+}, {
+	summary: "list fails",
+	cmd:     exec.Command("/bin/false"),
+	errMsg:  "failed to list instances",
+}}
+
+func TestExists(t *testing.T) {
+	for _, test := range existsTests {
+		restoreCmd, calls := patchCommands(test.cmd)
+		app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+		exists, err := app.Exists(context.Background())
+		restoreCmd()
+		require.Len(t, *calls, 1, test.summary)
+		assert.Equal(t, "^l-s$", (*calls)[0][len((*calls)[0])-1], test.summary)
+		if test.errMsg != "" {
+			assert.ErrorContains(t, err, test.errMsg, test.summary)
+		} else {
+			assert.Nil(t, err, test.summary)
+			assert.Equal(t, test.exists, exists, test.summary)
+		}
+	}
+}
+
+var mismatchTests = []struct {
+	summary string
+	config  Config
+	info    *exec.Cmd
+	image   *exec.Cmd
+
+	diffs  []string
+	errMsg string
+}{{
+	summary: "matches",
+	config:  Config{Label: "l", System: NewSystem("s")},
+	info:    exec.Command("/bin/echo", "Type: container"),
+	image:   exec.Command("/bin/echo", "ubuntu-daily:s"),
+}, {
+	summary: "unrecorded image",
+	config:  Config{Label: "l", System: NewSystem("s")},
+	info:    exec.Command("/bin/echo", "Type: container"),
+	image:   exec.Command("/bin/echo", ""),
+}, {
+	summary: "wants vm",
+	config:  Config{Label: "l", System: NewSystem("s"), Virtualization: "vm"},
+	info:    exec.Command("/bin/echo", "Type: container"),
+	image:   exec.Command("/bin/echo", "ubuntu-daily:s"),
+	diffs:   []string{"virtualization is container, config wants vm"},
+}, {
+	summary: "wants container, other image",
+	config:  Config{Label: "l", System: NewSystem("s")},
+	info:    exec.Command("/bin/echo", "Type: virtual-machine"),
+	image:   exec.Command("/bin/echo", "ubuntu:s"),
+	diffs: []string{
+		"virtualization is vm, config wants container",
+		"image is ubuntu:s, config wants ubuntu-daily:s",
+	},
+}, {
+	summary: "info fails",
+	config:  Config{Label: "l", System: NewSystem("s")},
+	info:    exec.Command("/bin/false"),
+	image:   exec.Command("/bin/false"), // lxc list
+	errMsg:  "failed to get instance info",
+}, {
+	summary: "meta fails",
+	config:  Config{Label: "l", System: NewSystem("s")},
+	info:    exec.Command("/bin/echo", "Type: container"),
+	image:   exec.Command("/bin/false"),
+	errMsg:  "failed to get image",
+}}
+
+func TestMismatches(t *testing.T) {
+	for _, test := range mismatchTests {
+		restoreCmd, _ := patchCommands(test.info, test.image)
+		diffs, err := App{Config: test.config}.mismatches(context.Background())
+		restoreCmd()
+		if test.errMsg != "" {
+			assert.ErrorContains(t, err, test.errMsg, test.summary)
+		} else {
+			assert.Nil(t, err, test.summary)
+			assert.Equal(t, test.diffs, diffs, test.summary)
+		}
+	}
+}
+
+var ensureLaunchedTests = []struct {
+	summary string
+	opts    Opts
+	cmds    []*exec.Cmd
+	answer  bool
+
+	calls  [][]string
+	errMsg string
+}{{
+	summary: "unset",
+	opts:    Opts{},
+}, {
+	summary: "never",
+	opts:    Opts{Launch: LaunchNever},
+}, {
+	summary: "missing, exists and matches",
+	opts:    Opts{Launch: LaunchMissing},
+	cmds: []*exec.Cmd{
+		exec.Command("/bin/echo", "l-s"),
+		exec.Command("/bin/true"), // checkOwner
+		exec.Command("/bin/echo", "Type: container"),
+		exec.Command("/bin/echo", "ubuntu-daily:s"),
+	},
+	calls: [][]string{
+		{"lxc", "list", "--format", "csv", "--columns", "n", "^l-s$"},
+		{"lxc", "config", "get", "l-s", "user.omnienv.root-dir"},
+		{"lxc", "info", "l-s"},
+		{"lxc", "config", "get", "l-s", "user.omnienv.image"},
+		{"lxc", "config", "get", "l-s", "user.omnienv.launch-step"},
+	},
+}, {
+	summary: "missing, exists, launch incomplete",
+	opts:    Opts{Launch: LaunchMissing},
+	cmds: []*exec.Cmd{
+		exec.Command("/bin/echo", "l-s"),
+		exec.Command("/bin/true"), // checkOwner
+		exec.Command("/bin/echo", "Type: container"),
+		exec.Command("/bin/echo", "ubuntu-daily:s"),
+		exec.Command("/bin/echo", "cloud-init"), // resumeIncomplete
+		exec.Command("/bin/echo", "cloud-init"), // resumePoint
+	},
+	calls: [][]string{
+		{"lxc", "list", "--format", "csv", "--columns", "n", "^l-s$"},
+		{"lxc", "config", "get", "l-s", "user.omnienv.root-dir"},
+		{"lxc", "info", "l-s"},
+		{"lxc", "config", "get", "l-s", "user.omnienv.image"},
+		{"lxc", "config", "get", "l-s", "user.omnienv.launch-step"},
+		{"lxc", "config", "get", "l-s", "user.omnienv.launch-step"},
+		{"lxc", "config", "set", "l-s", "user.omnienv.launch-step=cloud-init"},
+		{"lxc", "exec", "l-s", "--", "cloud-init", "status", "--wait"},
+		{"lxc", "config", "set", "l-s", "user.omnienv.launch-step=done"},
+	},
+}, {
+	summary: "missing, exists, step unreadable",
+	opts:    Opts{Launch: LaunchMissing},
+	cmds: []*exec.Cmd{
+		exec.Command("/bin/echo", "l-s"),
+		exec.Command("/bin/true"), // checkOwner
+		exec.Command("/bin/echo", "Type: container"),
+		exec.Command("/bin/echo", "ubuntu-daily:s"),
+		exec.Command("/bin/false"),
+	},
+	errMsg: "launch-step",
+}, {
+	summary: "missing, differs, declined",
+	opts:    Opts{Launch: LaunchMissing},
+	cmds: []*exec.Cmd{
+		exec.Command("/bin/echo", "l-s"),
+		exec.Command("/bin/true"), // checkOwner
+		exec.Command("/bin/echo", "Type: virtual-machine"),
+		exec.Command("/bin/echo", "ubuntu-daily:s"),
+	},
+	answer: false,
+	calls: [][]string{
+		{"lxc", "list", "--format", "csv", "--columns", "n", "^l-s$"},
+		{"lxc", "config", "get", "l-s", "user.omnienv.root-dir"},
+		{"lxc", "info", "l-s"},
+		{"lxc", "config", "get", "l-s", "user.omnienv.image"},
+	},
+}, {
+	summary: "missing, differs, recreate fails to delete",
+	opts:    Opts{Launch: LaunchMissing},
+	cmds: []*exec.Cmd{
+		exec.Command("/bin/echo", "l-s"),
+		exec.Command("/bin/true"), // checkOwner
+		exec.Command("/bin/echo", "Type: virtual-machine"),
+		exec.Command("/bin/echo", "ubuntu-daily:s"),
+		exec.Command("/bin/false"),
+	},
+	answer: true,
+	errMsg: "failed to delete instance",
+}, {
+	summary: "missing, list fails",
+	opts:    Opts{Launch: LaunchMissing},
+	cmds:    []*exec.Cmd{exec.Command("/bin/false")},
+	errMsg:  "failed to list instances",
+}, {
+	summary: "missing, does not exist",
+	opts:    Opts{Launch: LaunchMissing},
+	cmds: []*exec.Cmd{
+		exec.Command("/bin/true"),
+		exec.Command("/bin/false"), // lxc launch
+	},
+	errMsg: "failed to create instance",
+}, {
+	summary: "always, declined",
+	opts:    Opts{Launch: LaunchAlways},
+	cmds: []*exec.Cmd{
+		exec.Command("/bin/echo", "l-s"),
+		exec.Command("/bin/true"), // checkOwner
+	},
+	answer: false,
+	errMsg: "not replacing existing instance l-s",
+}, {
+	summary: "always, replaced",
+	opts:    Opts{Launch: LaunchAlways},
+	cmds: []*exec.Cmd{
+		exec.Command("/bin/echo", "l-s"),
+		exec.Command("/bin/true"),  // checkOwner
+		exec.Command("/bin/true"),  // lxc delete
+		exec.Command("/bin/false"), // lxc launch
+	},
+	answer: true,
+	errMsg: "failed to create instance",
+}, {
+	summary: "exists for another project",
+	opts:    Opts{Launch: LaunchAlways},
+	cmds: []*exec.Cmd{
+		exec.Command("/bin/echo", "l-s"),
+		exec.Command("/bin/echo", "/src/other/l"),
+	},
+	answer: true,
+	errMsg: "l-s was created for /src/other/l, not /src/l",
+}, {
+	summary: "resume",
+	opts:    Opts{Launch: LaunchMissing, Resume: true},
+	cmds: []*exec.Cmd{
+		exec.Command("/bin/echo", "l-s"),    // lxc list
+		exec.Command("/bin/echo", "/src/l"), // checkOwner
+		exec.Command("/bin/echo", "done"),   // launch-step
+	},
+	calls: [][]string{
+		{"lxc", "list", "--format", "csv", "--columns", "n", "^l-s$"},
+		{"lxc", "config", "get", "l-s", "user.omnienv.root-dir"},
+		{"lxc", "config", "get", "l-s", "user.omnienv.launch-step"},
+	},
+}, {
+	summary: "resume other project",
+	opts:    Opts{Launch: LaunchMissing, Resume: true},
+	cmds: []*exec.Cmd{
+		exec.Command("/bin/echo", "l-s"),          // lxc list
+		exec.Command("/bin/echo", "/src/other/l"), // checkOwner
+	},
+	errMsg: "l-s was created for /src/other/l, not /src/l",
+}}
+
+func TestEnsureLaunched(t *testing.T) {
+	for _, test := range ensureLaunchedTests {
+		restoreCmd, calls := patchCommands(test.cmds...)
+		app := App{
+			Config:  Config{Label: "l", System: NewSystem("s"), RootDir: "/src/l"},
+			Opts:    test.opts,
+			Confirm: func(string) bool { return test.answer },
+		}
+		err := app.EnsureLaunched(context.Background())
+		restoreCmd()
+		if test.errMsg != "" {
+			assert.ErrorContains(t, err, test.errMsg, test.summary)
+			continue
+		}
+		assert.Nil(t, err, test.summary)
+		if test.calls == nil {
+			assert.Empty(t, *calls, test.summary)
+		} else {
+			assert.Equal(t, test.calls, *calls, test.summary)
+		}
+	}
+}
+
+func TestLaunchSnapshotBeforeProvision(t *testing.T) {
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/true"), // lxc init
+		exec.Command("/bin/true"), // record image
+		exec.Command("/bin/true"), // record root-dir and config
+		exec.Command("/bin/true"), // lxc start
+	)
+	defer restoreCmd()
+
+	fake := &fakeBackend{}
+	app := App{
+		Config: Config{
+			Label: "l", System: NewSystem("s"), SnapshotBeforeProvision: true,
+		},
+		Backend: fake,
+	}
+	assert.Nil(t, app.create(context.Background()))
+	require.Len(t, *calls, 4)
+	assert.Equal(t, "init", (*calls)[0][1])
+	assert.Equal(t, []string{"lxc", "start", "l-s"}, (*calls)[3])
+	assert.Equal(t, []string{"list l-s", "create l-s/omnienv-pre-provision"}, fake.calls)
+}
+
+func TestLaunchSnapshotBeforeProvisionFails(t *testing.T) {
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/true"), // lxc init
+		exec.Command("/bin/true"), // record image
+		exec.Command("/bin/true"), // record root-dir and config
+	)
+	defer restoreCmd()
+
+	app := App{
+		Config: Config{
+			Label: "l", System: NewSystem("s"), SnapshotBeforeProvision: true,
+		},
+		Backend: &fakeBackend{err: errors.New("boom")},
+	}
+	err := app.create(context.Background())
+	assert.ErrorContains(t, err, "pre-provision snapshot failure")
+	assert.Len(t, *calls, 3)
+}
@@ -0,0 +1,118 @@
+package omnienv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// how often a lock held by another process is tried again
+const lockPoll = 250 * time.Millisecond
+
+// lockDir holds the lock files of the instances, one per instance name.
+func lockDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "omnienv")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("omnienv-%d", os.Getuid()))
+}
+
+// lockHolder describes the process holding the lock, as recorded in the
+// lock file.
+func lockHolder(file *os.File) string {
+	data := make([]byte, 256)
+	n, _ := file.ReadAt(data, 0)
+	pid, what, found := strings.Cut(strings.TrimSpace(string(data[:n])), " ")
+	if !found {
+		return "another process"
+	}
+	return fmt.Sprintf("%s in pid %s", what, pid)
+}
+
+// openState opens the file of the instance with the suffix in lockDir.
+func (app App) openState(suffix string) (*os.File, error) {
+	dir := lockDir()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+	path := filepath.Join(dir, app.Name()+suffix)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600) //gosec:disable G304
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	return file, nil
+}
+
+// tryFlock takes the flock of the file as how, LOCK_EX or LOCK_SH, and
+// reports false if another process holds a conflicting one.
+func tryFlock(file *os.File, how int) (bool, error) {
+	err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// waitFlock takes the flock of the file as how, calling waiting once if
+// another process holds a conflicting one, and then trying again until
+// ctx is done.
+func waitFlock(ctx context.Context, file *os.File, how int, waiting func()) error {
+	for first := true; ; first = false {
+		locked, err := tryFlock(file, how)
+		if locked || err != nil {
+			return err
+		}
+		if first {
+			waiting()
+		}
+		if err := sleep(ctx, lockPoll); err != nil {
+			return err
+		}
+	}
+}
+
+// writeAll replaces the content of the file.
+func writeAll(file *os.File, data []byte) error {
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := file.WriteAt(data, 0)
+	return err
+}
+
+// lock takes the lock of the instance for the operation what, such as
+// "launch", so that concurrent invocations of oe do not race on starting
+// or launching it.  If another process holds the lock, lock reports that
+// and waits for it.  The returned func releases the lock.
+func (app App) lock(ctx context.Context, what string) (func(), error) {
+	file, err := app.openState(".lock")
+	if err != nil {
+		return nil, err
+	}
+	err = waitFlock(ctx, file, syscall.LOCK_EX, func() {
+		fmt.Fprintf(progress, "Waiting for %s\n", lockHolder(file))
+	})
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", file.Name(), err)
+	}
+
+	// the lock file is kept, as removing it would race with others
+	// opening it, and only its content is replaced
+	data := fmt.Appendf(nil, "%d %s\n", os.Getpid(), what)
+	if err := writeAll(file, data); err != nil {
+		slog.Debug("failed to record lock holder", "error", err)
+	}
+	return func() {
+		if err := file.Truncate(0); err != nil {
+			slog.Debug("failed to clear lock holder", "error", err)
+		}
+		file.Close()
+	}, nil
+}
@@ -0,0 +1,63 @@
+package omnienv
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockDir(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+	assert.Equal(t, "/run/user/1000/omnienv", lockDir())
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	assert.Equal(t, filepath.Join(os.TempDir(), fmt.Sprintf("omnienv-%d", os.Getuid())), lockDir())
+}
+
+func TestLockWaits(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	restoreProgress, buf := patchProgress()
+	defer restoreProgress()
+	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+	ctx := context.Background()
+
+	unlock, err := app.lock(ctx, "launch")
+	assert.Nil(t, err)
+	data, err := os.ReadFile(filepath.Join(lockDir(), "l-s.lock"))
+	assert.Nil(t, err)
+	assert.Equal(t, fmt.Sprintf("%d launch\n", os.Getpid()), string(data))
+
+	acquired := make(chan func())
+	go func() {
+		unlock, err := app.lock(ctx, "start")
+		assert.Nil(t, err)
+		acquired <- unlock
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("lock taken twice")
+	case <-time.After(2 * lockPoll):
+	}
+	unlock()
+	(<-acquired)()
+	assert.Equal(t, fmt.Sprintf("Waiting for launch in pid %d\n", os.Getpid()), buf.String())
+}
+
+func TestLockCancelled(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	restoreProgress, _ := patchProgress()
+	defer restoreProgress()
+	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+
+	unlock, err := app.lock(context.Background(), "launch")
+	assert.Nil(t, err)
+	defer unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = app.lock(ctx, "start")
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,248 @@
+package omnienv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type lxd struct{}
+
+func (lxd) CreateSnapshot(ctx context.Context, instance, snapshot string) error {
+	return runQuiet(ctx, "lxc", "snapshot", instance, snapshot)
+}
+
+func (lxd) ListSnapshots(ctx context.Context, instance string) ([]Snapshot, error) {
+	url := fmt.Sprintf("/1.0/instances/%s/snapshots?recursion=1", instance)
+	cmd := commandContext(ctx, "lxc", "query", url)
+	slog.Debug("run", "command", cmd.Args)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []struct {
+		Name      string    `json:"name"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	if err := json.Unmarshal(out, &entries); err != nil {
+		return nil, fmt.Errorf("unexpected snapshot listing: %w", err)
+	}
+
+	snapshots := make([]Snapshot, 0, len(entries))
+	for _, entry := range entries {
+		// older servers report the name as instance/snapshot
+		snapshots = append(snapshots, Snapshot{
+			Name:    path.Base(entry.Name),
+			Created: entry.CreatedAt,
+		})
+	}
+	return snapshots, nil
+}
+
+func (lxd) RestoreSnapshot(ctx context.Context, instance, snapshot string) error {
+	return runQuiet(ctx, "lxc", "restore", instance, snapshot)
+}
+
+func (lxd) DeleteSnapshot(ctx context.Context, instance, snapshot string) error {
+	return runQuiet(ctx, "lxc", "delete", instance+"/"+snapshot)
+}
+
+func (lxd) ExportInstance(ctx context.Context, instance, path string) error {
+	return runQuiet(
+		ctx, "lxc", "export", instance, path,
+		"--instance-only", "--compression", "zstd",
+	)
+}
+
+func (lxd) ImportInstance(ctx context.Context, path, instance string) error {
+	return runQuiet(ctx, "lxc", "import", path, instance)
+}
+
+func (lxd) PublishImage(ctx context.Context, instance, alias string, properties map[string]string) error {
+	args := []string{"lxc", "publish", instance, "--alias", alias, "--reuse"}
+	for _, key := range slices.Sorted(maps.Keys(properties)) {
+		args = append(args, key+"="+properties[key])
+	}
+	return run(ctx, args...)
+}
+
+func (lxd) ListImages(ctx context.Context) ([]Image, error) {
+	cmd := commandContext(ctx, "lxc", "query", "/1.0/images?recursion=1")
+	slog.Debug("run", "command", cmd.Args)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []lxdImage
+	if err := json.Unmarshal(out, &entries); err != nil {
+		return nil, fmt.Errorf("unexpected image listing: %w", err)
+	}
+
+	images := make([]Image, 0, len(entries))
+	for _, entry := range entries {
+		images = append(images, entry.image())
+	}
+	return images, nil
+}
+
+func (lxd) GetImage(ctx context.Context, fingerprint string) (Image, error) {
+	cmd := commandContext(ctx, "lxc", "query", "/1.0/images/"+fingerprint)
+	slog.Debug("run", "command", cmd.Args)
+	out, err := cmd.Output()
+	if err != nil {
+		return Image{}, err
+	}
+
+	var entry lxdImage
+	if err := json.Unmarshal(out, &entry); err != nil {
+		return Image{}, fmt.Errorf("unexpected image: %w", err)
+	}
+	return entry.image(), nil
+}
+
+func (lxd) PullImage(ctx context.Context, image string, vm bool) error {
+	args := []string{"lxc", "image", "copy", image, "local:"}
+	if vm {
+		args = append(args, "--vm")
+	}
+	return run(ctx, args...)
+}
+
+func (lxd) RemoteFingerprint(ctx context.Context, image string, vm bool) (string, error) {
+	args := []string{"lxc", "image", "info", image}
+	if vm {
+		args = append(args, "--vm")
+	}
+	cmd := commandContext(ctx, args[0], args[1:]...)
+	slog.Debug("run", "command", cmd.Args)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if fingerprint, found := strings.CutPrefix(line, "Fingerprint: "); found {
+			return strings.TrimSpace(fingerprint), nil
+		}
+	}
+	return "", fmt.Errorf("no fingerprint for image %s", image)
+}
+
+func (lxd) ListInstances(ctx context.Context) ([]Instance, error) {
+	cmd := commandContext(ctx, "lxc", "query", "/1.0/instances?recursion=1")
+	slog.Debug("run", "command", cmd.Args)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []struct {
+		Name   string            `json:"name"`
+		Type   string            `json:"type"`
+		Config map[string]string `json:"config"`
+	}
+	if err := json.Unmarshal(out, &entries); err != nil {
+		return nil, fmt.Errorf("unexpected instance listing: %w", err)
+	}
+
+	instances := make([]Instance, 0, len(entries))
+	for _, entry := range entries {
+		instances = append(instances, Instance{
+			Name: entry.Name, Type: entry.Type, Config: entry.Config,
+		})
+	}
+	return instances, nil
+}
+
+func (lxd) ProxyDevices(ctx context.Context, instance string) (map[string]Port, error) {
+	cmd := commandContext(ctx, "lxc", "query", "/1.0/instances/"+instance)
+	slog.Debug("run", "command", cmd.Args)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var entry struct {
+		Devices map[string]map[string]string `json:"devices"`
+	}
+	if err := json.Unmarshal(out, &entry); err != nil {
+		return nil, fmt.Errorf("unexpected instance: %w", err)
+	}
+
+	ports := map[string]Port{}
+	for name, device := range entry.Devices {
+		if device["type"] != "proxy" {
+			continue
+		}
+		proto, host, err := parseProxyAddr(device["listen"])
+		if err != nil {
+			return nil, fmt.Errorf("device %s: %w", name, err)
+		}
+		_, guest, err := parseProxyAddr(device["connect"])
+		if err != nil {
+			return nil, fmt.Errorf("device %s: %w", name, err)
+		}
+		ports[name] = Port{Host: host, Guest: guest, Proto: proto}
+	}
+	return ports, nil
+}
+
+// parseProxyAddr splits a proxy device address like tcp:127.0.0.1:80.
+func parseProxyAddr(addr string) (string, int, error) {
+	proto, hostPort, found := strings.Cut(addr, ":")
+	if !found {
+		return "", 0, fmt.Errorf("unexpected address %q", addr)
+	}
+	_, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return "", 0, fmt.Errorf("unexpected address %q", addr)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, fmt.Errorf("unexpected address %q", addr)
+	}
+	return proto, port, nil
+}
+
+func (lxd) AddProxyDevice(ctx context.Context, instance, device string, port Port) error {
+	return runQuiet(
+		ctx, "lxc", "config", "device", "add", instance, device, "proxy",
+		fmt.Sprintf("listen=%s:127.0.0.1:%d", port.Proto, port.Host),
+		fmt.Sprintf("connect=%s:127.0.0.1:%d", port.Proto, port.Guest),
+	)
+}
+
+func (lxd) RemoveDevice(ctx context.Context, instance, device string) error {
+	return runQuiet(ctx, "lxc", "config", "device", "remove", instance, device)
+}
+
+// lxdImage is an image as reported by the LXD API.
+type lxdImage struct {
+	Fingerprint string `json:"fingerprint"`
+	Aliases     []struct {
+		Name string `json:"name"`
+	} `json:"aliases"`
+	Properties map[string]string `json:"properties"`
+	CreatedAt  time.Time         `json:"created_at"`
+}
+
+func (entry lxdImage) image() Image {
+	image := Image{
+		Fingerprint: entry.Fingerprint,
+		Properties:  entry.Properties,
+		Created:     entry.CreatedAt,
+	}
+	for _, alias := range entry.Aliases {
+		image.Aliases = append(image.Aliases, alias.Name)
+	}
+	return image
+}
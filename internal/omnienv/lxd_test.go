@@ -0,0 +1,302 @@
+package omnienv
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLxdCreateSnapshot(t *testing.T) {
+	restoreCmd, calls := patchCommands(exec.Command("/bin/true"))
+	defer restoreCmd()
+	assert.Nil(t, lxd{}.CreateSnapshot(context.Background(), "l-s", "omnienv-a"))
+	assert.Equal(t, [][]string{{"lxc", "snapshot", "l-s", "omnienv-a"}}, *calls)
+}
+
+func TestLxdCreateSnapshotFails(t *testing.T) {
+	restoreCmd, _ := patchCommands(
+		exec.Command("/bin/sh", "-c", "echo 'Error: boom' >&2; exit 1"),
+	)
+	defer restoreCmd()
+	err := lxd{}.CreateSnapshot(context.Background(), "l-s", "omnienv-a")
+	assert.ErrorContains(t, err, "exit status 1: Error: boom")
+}
+
+var lxdListSnapshotsTests = []struct {
+	summary string
+	cmd     *exec.Cmd
+
+	snapshots []Snapshot
+	errMsg    string
+}{{
+	summary: "snapshots",
+	cmd: exec.Command("/bin/echo", `[
+		{"name": "omnienv-a", "created_at": "2025-01-02T03:04:05Z"},
+		{"name": "l-s/snap0", "created_at": "2025-01-02T03:04:06Z"}
+	]`),
+	snapshots: []Snapshot{
+		{Name: "omnienv-a", Created: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{Name: "snap0", Created: time.Date(2025, 1, 2, 3, 4, 6, 0, time.UTC)},
+	},
+}, {
+	summary:   "none",
+	cmd:       exec.Command("/bin/echo", `[]`),
+	snapshots: []Snapshot{},
+}, {
+	summary: "query fails",
+	cmd:     exec.Command("/bin/false"),
+	errMsg:  "exit status 1",
+}, {
+	summary: "garbage",
+	cmd:     exec.Command("/bin/echo", `{`),
+	errMsg:  "unexpected snapshot listing",
+}}
+
+func TestLxdListSnapshots(t *testing.T) {
+	for _, test := range lxdListSnapshotsTests {
+		restoreCmd, calls := patchCommands(test.cmd)
+		snapshots, err := lxd{}.ListSnapshots(context.Background(), "l-s")
+		restoreCmd()
+		require.Len(t, *calls, 1, test.summary)
+		assert.Equal(t, []string{
+			"lxc", "query", "/1.0/instances/l-s/snapshots?recursion=1",
+		}, (*calls)[0], test.summary)
+		if test.errMsg != "" {
+			assert.ErrorContains(t, err, test.errMsg, test.summary)
+		} else {
+			assert.Nil(t, err, test.summary)
+			assert.Equal(t, test.snapshots, snapshots, test.summary)
+		}
+	}
+}
+
+func TestLxdRestoreSnapshot(t *testing.T) {
+	restoreCmd, calls := patchCommands(exec.Command("/bin/true"))
+	defer restoreCmd()
+	assert.Nil(t, lxd{}.RestoreSnapshot(context.Background(), "l-s", "omnienv-a"))
+	assert.Equal(t, [][]string{{"lxc", "restore", "l-s", "omnienv-a"}}, *calls)
+}
+
+func TestLxdDeleteSnapshot(t *testing.T) {
+	restoreCmd, calls := patchCommands(exec.Command("/bin/true"))
+	defer restoreCmd()
+	assert.Nil(t, lxd{}.DeleteSnapshot(context.Background(), "l-s", "omnienv-a"))
+	assert.Equal(t, [][]string{{"lxc", "delete", "l-s/omnienv-a"}}, *calls)
+}
+
+func TestLxdExportInstance(t *testing.T) {
+	restoreCmd, calls := patchCommands(exec.Command("/bin/true"))
+	defer restoreCmd()
+	assert.Nil(t, lxd{}.ExportInstance(context.Background(), "l-s", "/tmp/b"))
+	assert.Equal(t, [][]string{{
+		"lxc", "export", "l-s", "/tmp/b", "--instance-only", "--compression", "zstd",
+	}}, *calls)
+}
+
+func TestLxdImportInstance(t *testing.T) {
+	restoreCmd, calls := patchCommands(exec.Command("/bin/true"))
+	defer restoreCmd()
+	assert.Nil(t, lxd{}.ImportInstance(context.Background(), "/tmp/b", "l-s"))
+	assert.Equal(t, [][]string{{"lxc", "import", "/tmp/b", "l-s"}}, *calls)
+}
+
+func TestLxdPublishImage(t *testing.T) {
+	restoreCmd, calls := patchCommands(exec.Command("/bin/true"))
+	defer restoreCmd()
+	err := lxd{}.PublishImage(context.Background(), "l-s", "team/l", map[string]string{
+		"omnienv.source": "l-s", "omnienv.config-hash": "abc",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{{
+		"lxc", "publish", "l-s", "--alias", "team/l", "--reuse",
+		"omnienv.config-hash=abc", "omnienv.source=l-s",
+	}}, *calls)
+}
+
+var lxdListImagesTests = []struct {
+	summary string
+	cmd     *exec.Cmd
+
+	images []Image
+	errMsg string
+}{{
+	summary: "images",
+	cmd: exec.Command("/bin/echo", `[{
+		"fingerprint": "abc",
+		"aliases": [{"name": "team/l"}],
+		"properties": {"omnienv.source": "l-s"},
+		"created_at": "2025-01-02T03:04:05Z"
+	}, {
+		"fingerprint": "def",
+		"aliases": [],
+		"properties": {"os": "ubuntu"},
+		"created_at": "2025-01-02T03:04:06Z"
+	}]`),
+	images: []Image{{
+		Fingerprint: "abc",
+		Aliases:     []string{"team/l"},
+		Properties:  map[string]string{"omnienv.source": "l-s"},
+		Created:     time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+	}, {
+		Fingerprint: "def",
+		Properties:  map[string]string{"os": "ubuntu"},
+		Created:     time.Date(2025, 1, 2, 3, 4, 6, 0, time.UTC),
+	}},
+}, {
+	summary: "query fails",
+	cmd:     exec.Command("/bin/false"),
+	errMsg:  "exit status 1",
+}, {
+	summary: "garbage",
+	cmd:     exec.Command("/bin/echo", "nope"),
+	errMsg:  "unexpected image listing",
+}}
+
+func TestLxdListImages(t *testing.T) {
+	for _, test := range lxdListImagesTests {
+		restoreCmd, calls := patchCommands(test.cmd)
+		images, err := lxd{}.ListImages(context.Background())
+		restoreCmd()
+		require.Len(t, *calls, 1, test.summary)
+		assert.Equal(t, []string{
+			"lxc", "query", "/1.0/images?recursion=1",
+		}, (*calls)[0], test.summary)
+		if test.errMsg != "" {
+			assert.ErrorContains(t, err, test.errMsg, test.summary)
+		} else {
+			assert.Nil(t, err, test.summary)
+			assert.Equal(t, test.images, images, test.summary)
+		}
+	}
+}
+
+func TestLxdGetImage(t *testing.T) {
+	restoreCmd, calls := patchCommands(exec.Command("/bin/echo",
+		`{"fingerprint": "abc", "created_at": "2025-01-02T03:04:05Z"}`,
+	))
+	defer restoreCmd()
+	image, err := lxd{}.GetImage(context.Background(), "abc")
+	assert.Nil(t, err)
+	assert.Equal(t, Image{
+		Fingerprint: "abc", Created: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+	}, image)
+	assert.Equal(t, [][]string{{"lxc", "query", "/1.0/images/abc"}}, *calls)
+}
+
+func TestLxdPullImage(t *testing.T) {
+	restoreCmd, calls := patchCommands()
+	defer restoreCmd()
+	assert.Nil(t, lxd{}.PullImage(context.Background(), "ubuntu-daily:noble", false))
+	assert.Nil(t, lxd{}.PullImage(context.Background(), "ubuntu-daily:noble", true))
+	assert.Equal(t, [][]string{
+		{"lxc", "image", "copy", "ubuntu-daily:noble", "local:"},
+		{"lxc", "image", "copy", "ubuntu-daily:noble", "local:", "--vm"},
+	}, *calls)
+}
+
+var lxdRemoteFingerprintTests = []struct {
+	summary string
+	cmd     *exec.Cmd
+
+	fingerprint string
+	errMsg      string
+}{{
+	summary:     "found",
+	cmd:         exec.Command("/bin/echo", "Fingerprint: abc\nSize: 1.00MiB"),
+	fingerprint: "abc",
+}, {
+	summary: "missing",
+	cmd:     exec.Command("/bin/echo", "Size: 1.00MiB"),
+	errMsg:  "no fingerprint for image ubuntu-daily:noble",
+}, {
+	summary: "fails",
+	cmd:     exec.Command("/bin/false"),
+	errMsg:  "exit status 1",
+}}
+
+func TestLxdRemoteFingerprint(t *testing.T) {
+	for _, test := range lxdRemoteFingerprintTests {
+		restoreCmd, calls := patchCommands(test.cmd)
+		fingerprint, err := lxd{}.RemoteFingerprint(context.Background(), "ubuntu-daily:noble", false)
+		restoreCmd()
+		require.Len(t, *calls, 1, test.summary)
+		assert.Equal(t, []string{
+			"lxc", "image", "info", "ubuntu-daily:noble",
+		}, (*calls)[0], test.summary)
+		if test.errMsg != "" {
+			assert.ErrorContains(t, err, test.errMsg, test.summary)
+		} else {
+			assert.Nil(t, err, test.summary)
+			assert.Equal(t, test.fingerprint, fingerprint, test.summary)
+		}
+	}
+}
+
+func TestLxdRemoteFingerprintVM(t *testing.T) {
+	restoreCmd, calls := patchCommands(exec.Command("/bin/echo", "Fingerprint: abc"))
+	defer restoreCmd()
+	_, err := lxd{}.RemoteFingerprint(context.Background(), "ubuntu-daily:noble", true)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{
+		{"lxc", "image", "info", "ubuntu-daily:noble", "--vm"},
+	}, *calls)
+}
+
+func TestLxdListInstances(t *testing.T) {
+	restoreCmd, calls := patchCommands(exec.Command("/bin/echo",
+		`[{"name": "l-s", "type": "virtual-machine", "config": {"user.omnienv.image": "ubuntu-daily:s"}}]`,
+	))
+	defer restoreCmd()
+	instances, err := lxd{}.ListInstances(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []Instance{{
+		Name: "l-s", Type: "virtual-machine",
+		Config: map[string]string{"user.omnienv.image": "ubuntu-daily:s"},
+	}}, instances)
+	assert.Equal(t, [][]string{{"lxc", "query", "/1.0/instances?recursion=1"}}, *calls)
+}
+
+func TestLxdProxyDevices(t *testing.T) {
+	restoreCmd, calls := patchCommands(exec.Command("/bin/echo", `{"devices": {
+		"workdir": {"type": "disk", "source": "/src/l"},
+		"oe-port-tcp-3000": {
+			"type": "proxy",
+			"listen": "tcp:127.0.0.1:3000",
+			"connect": "tcp:127.0.0.1:80"
+		}
+	}}`))
+	defer restoreCmd()
+	devices, err := lxd{}.ProxyDevices(context.Background(), "l-s")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]Port{
+		"oe-port-tcp-3000": {Host: 3000, Guest: 80, Proto: "tcp"},
+	}, devices)
+	assert.Equal(t, [][]string{{"lxc", "query", "/1.0/instances/l-s"}}, *calls)
+}
+
+func TestLxdProxyDevicesBadAddr(t *testing.T) {
+	restoreCmd, _ := patchCommands(exec.Command("/bin/echo", `{"devices": {
+		"p": {"type": "proxy", "listen": "unix:/run/x", "connect": "tcp:127.0.0.1:80"}
+	}}`))
+	defer restoreCmd()
+	_, err := lxd{}.ProxyDevices(context.Background(), "l-s")
+	assert.ErrorContains(t, err, `device p: unexpected address "unix:/run/x"`)
+}
+
+func TestLxdAddProxyDevice(t *testing.T) {
+	restoreCmd, calls := patchCommands()
+	defer restoreCmd()
+	port := Port{Host: 3000, Guest: 80, Proto: "udp"}
+	assert.Nil(t, lxd{}.AddProxyDevice(context.Background(), "l-s", "oe-port-udp-3000", port))
+	assert.Nil(t, lxd{}.RemoveDevice(context.Background(), "l-s", "oe-port-udp-3000"))
+	assert.Equal(t, [][]string{{
+		"lxc", "config", "device", "add", "l-s", "oe-port-udp-3000", "proxy",
+		"listen=udp:127.0.0.1:3000", "connect=udp:127.0.0.1:80",
+	}, {
+		"lxc", "config", "device", "remove", "l-s", "oe-port-udp-3000",
+	}}, *calls)
+}
@@ -0,0 +1,22 @@
+package omnienv
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+// TestMain keeps the state and lock files written by the tests out of the
+// home and runtime directories of whoever runs them.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "omnienv-test-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Setenv("XDG_STATE_HOME", dir+"/state")
+	os.Setenv("XDG_RUNTIME_DIR", dir+"/run")
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
@@ -0,0 +1,72 @@
+package omnienv
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// omnienv keeps its own bookkeeping in LXD user config keys on the
+// instance, under this prefix.
+const metaPrefix = "user.omnienv."
+
+func (app App) getMeta(ctx context.Context, key string) (string, error) {
+	cmd := commandContext(ctx, "lxc", "config", "get", app.Name(), metaPrefix+key)
+	slog.Debug("run", "command", cmd.Args)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get %s: %w", key, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (app App) setMeta(ctx context.Context, key, value string) error {
+	err := runQuiet(
+		ctx, "lxc", "config", "set", app.Name(), metaPrefix+key+"="+value,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set %s: %w", key, err)
+	}
+	return nil
+}
+
+// setMetas sets several keys with a single command.
+func (app App) setMetas(ctx context.Context, values map[string]string) error {
+	args := []string{"lxc", "config", "set", app.Name()}
+	for _, key := range slices.Sorted(maps.Keys(values)) {
+		args = append(args, metaPrefix+key+"="+values[key])
+	}
+	if err := runQuiet(ctx, args...); err != nil {
+		return fmt.Errorf("failed to set metadata: %w", err)
+	}
+	return nil
+}
+
+// info returns the top level "Key: value" fields reported by lxc info.
+func (app App) info(ctx context.Context) (map[string]string, error) {
+	cmd := commandContext(ctx, "lxc", "info", app.Name())
+	slog.Debug("run", "command", cmd.Args)
+	out, err := cmd.Output()
+	if err != nil {
+		// lxc info fails the same way for every problem, so check
+		// separately if that is because there is no such instance
+		if exists, existsErr := app.Exists(ctx); existsErr == nil && !exists {
+			err = ErrInstanceNotFound
+		}
+		return nil, fmt.Errorf("failed to get instance info: %w", err)
+	}
+
+	fields := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, " ") {
+			continue
+		}
+		if key, value, found := strings.Cut(line, ": "); found {
+			fields[key] = value
+		}
+	}
+	return fields, nil
+}
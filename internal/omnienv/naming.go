@@ -0,0 +1,109 @@
+package omnienv
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var ErrNameCollision = errors.New("instance belongs to another project")
+
+// Values for Config.Naming.
+const (
+	NamingPlain  = "plain"
+	NamingHashed = "hashed"
+)
+
+const (
+	// LXD instance names are used as hostnames, so are limited to 63
+	// letters, digits and hyphens, must not start with a digit or hyphen,
+	// and must not end with a hyphen.
+	maxNameLen = 63
+	// hashLen is the number of hex digits of the project directory hash
+	// used with NamingHashed.
+	hashLen = 8
+	// namePrefix stands in for an empty label, and is prepended to labels
+	// that start with a digit.
+	namePrefix = "oe"
+)
+
+var (
+	invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9-]+`)
+	repeatedHyphens  = regexp.MustCompile(`-{2,}`)
+)
+
+// sanitizeName replaces runs of characters not allowed in an instance name
+// with a single hyphen, and trims hyphens from either end.
+func sanitizeName(part string) string {
+	part = invalidNameChars.ReplaceAllString(part, "-")
+	part = repeatedHyphens.ReplaceAllString(part, "-")
+	return strings.Trim(part, "-")
+}
+
+// dirHash is a short, stable hash of the directory.
+func dirHash(dir string) string {
+	sum := sha256.Sum256([]byte(dir))
+	return hex.EncodeToString(sum[:])[:hashLen]
+}
+
+// buildName joins the label with the suffixes into a valid instance name,
+// shortening the label if needed so that the suffixes are kept intact.
+func buildName(label string, suffixes ...string) string {
+	suffix := ""
+	for _, part := range suffixes {
+		if part = sanitizeName(part); part != "" {
+			suffix += "-" + part
+		}
+	}
+
+	label = sanitizeName(label)
+	if label == "" {
+		label = namePrefix
+	} else if label[0] >= '0' && label[0] <= '9' {
+		label = namePrefix + "-" + label
+	}
+	if room := maxNameLen - len(suffix); len(label) > room {
+		label = strings.TrimRight(label[:max(room, 1)], "-")
+	}
+	name := label + suffix
+	if len(name) > maxNameLen {
+		name = strings.TrimRight(name[:maxNameLen], "-")
+	}
+	return name
+}
+
+// projectDir identifies the project an instance is created for.  This is
+// RootDir, except for worktrees sharing the instance of the main worktree.
+func (cfg Config) projectDir() string {
+	if cfg.mainDir != "" {
+		return cfg.mainDir
+	}
+	return cfg.RootDir
+}
+
+// checkOwner fails if the instance was created for a different project
+// that happens to produce the same instance name.
+func (app App) checkOwner(ctx context.Context) error {
+	owner, err := app.getMeta(ctx, rootDirKey)
+	if err != nil {
+		// like lxc info, lxc config get fails the same way for every
+		// problem
+		if exists, existsErr := app.Exists(ctx); existsErr == nil && !exists {
+			return ErrInstanceNotFound
+		}
+		return err
+	}
+	// instances created by older versions have no root dir recorded
+	if owner == "" || owner == app.Config.projectDir() {
+		return nil
+	}
+	return fmt.Errorf(
+		"%w: %s was created for %s, not %s, "+
+			"set a different label or use naming: hashed",
+		ErrNameCollision, app.Name(), owner, app.Config.projectDir(),
+	)
+}
@@ -0,0 +1,169 @@
+package omnienv
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// validName are the LXD rules for instance names.
+var validName = regexp.MustCompile(`^[a-zA-Z]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+var buildNameTests = []struct {
+	summary  string
+	label    string
+	suffixes []string
+
+	name string
+}{{
+	summary:  "plain",
+	label:    "foo",
+	suffixes: []string{"noble"},
+	name:     "foo-noble",
+}, {
+	summary:  "dots and underscores",
+	label:    "my_app.v2",
+	suffixes: []string{"noble"},
+	name:     "my-app-v2-noble",
+}, {
+	summary:  "leading and trailing junk",
+	label:    "_.foo..",
+	suffixes: []string{"noble"},
+	name:     "foo-noble",
+}, {
+	summary:  "leading digit",
+	label:    "2048",
+	suffixes: []string{"noble"},
+	name:     "oe-2048-noble",
+}, {
+	summary:  "empty label",
+	label:    "___",
+	suffixes: []string{"noble"},
+	name:     "oe-noble",
+}, {
+	summary:  "long label keeps suffixes",
+	label:    strings.Repeat("a", 70),
+	suffixes: []string{"noble", "0123abcd"},
+	name:     strings.Repeat("a", 48) + "-noble-0123abcd",
+}, {
+	summary:  "truncation does not end in a hyphen",
+	label:    strings.Repeat("a", 56) + "-b",
+	suffixes: []string{"noble"},
+	name:     strings.Repeat("a", 56) + "-noble",
+}}
+
+func TestBuildName(t *testing.T) {
+	for _, test := range buildNameTests {
+		name := buildName(test.label, test.suffixes...)
+		assert.Equal(t, test.name, name, test.summary)
+		assert.Regexp(t, validName, name, test.summary)
+	}
+}
+
+func TestNameHashed(t *testing.T) {
+	app := App{Config: Config{
+		Label: "app", System: NewSystem("noble"), RootDir: "/src/a/app",
+		Naming: NamingHashed,
+	}}
+	other := app
+	other.Config.RootDir = "/src/b/app"
+
+	assert.Regexp(t, `^app-noble-[0-9a-f]{8}$`, app.Name())
+	assert.Equal(t, app.Name(), App{Config: app.Config}.Name())
+	assert.NotEqual(t, app.Name(), other.Name())
+}
+
+func TestNameHashedSharedWorktree(t *testing.T) {
+	base := t.TempDir()
+	wt := makeWorktree(t, base, "feature", true)
+	assert.Nil(t, os.WriteFile(filepath.Join(base, "main", cfgName), []byte("{worktrees: shared, naming: hashed}"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(wt, cfgName), []byte("{worktrees: shared, naming: hashed}"), 0644))
+
+	mainCfg, err := loadConfig(filepath.Join(base, "main", cfgName))
+	assert.Nil(t, err)
+	wtCfg, err := loadConfig(filepath.Join(wt, cfgName))
+	assert.Nil(t, err)
+	assert.Equal(t, App{Config: mainCfg}.Name(), App{Config: wtCfg}.Name())
+	assert.Equal(t, mainCfg.RootDir, wtCfg.projectDir())
+}
+
+func TestLoadCfgInvalidNaming(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), cfgName)
+	assert.Nil(t, os.WriteFile(filename, []byte("naming: fancy"), 0644))
+	_, err := loadConfig(filename)
+	assert.ErrorContains(t, err, `invalid naming "fancy"`)
+}
+
+func TestCheckOwner(t *testing.T) {
+	tests := []struct {
+		summary string
+		cmds    []*exec.Cmd
+
+		collision bool
+		errMsg    string
+	}{{
+		summary: "same project",
+		cmds:    []*exec.Cmd{exec.Command("/bin/echo", "/src/a/app")},
+	}, {
+		summary: "not recorded",
+		cmds:    []*exec.Cmd{exec.Command("/bin/true")},
+	}, {
+		summary:   "other project",
+		cmds:      []*exec.Cmd{exec.Command("/bin/echo", "/src/b/app")},
+		collision: true,
+		errMsg:    "app-s was created for /src/b/app, not /src/a/app",
+	}, {
+		summary: "missing",
+		cmds:    []*exec.Cmd{exec.Command("/bin/false"), exec.Command("/bin/true")},
+		errMsg:  "instance not found",
+	}, {
+		summary: "get fails",
+		cmds: []*exec.Cmd{
+			exec.Command("/bin/false"), exec.Command("/bin/echo", "app-s"),
+		},
+		errMsg: "failed to get root-dir",
+	}}
+	for _, test := range tests {
+		restoreCmd, calls := patchCommands(test.cmds...)
+		app := App{Config: Config{
+			Label: "app", System: NewSystem("s"), RootDir: "/src/a/app",
+		}}
+		err := app.checkOwner(context.Background())
+		restoreCmd()
+		assert.Len(t, *calls, len(test.cmds), test.summary)
+		require.NotEmpty(t, *calls, test.summary)
+		assert.Equal(t,
+			[]string{"lxc", "config", "get", "app-s", "user.omnienv.root-dir"},
+			(*calls)[0], test.summary,
+		)
+		if test.errMsg != "" {
+			assert.Equal(t, test.collision, errors.Is(err, ErrNameCollision), test.summary)
+			assert.ErrorContains(t, err, test.errMsg, test.summary)
+		} else {
+			assert.Nil(t, err, test.summary)
+		}
+	}
+}
+
+func TestShellNameCollision(t *testing.T) {
+	defer patchTerminal(true)()
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/echo", "/src/b/app"), // checkOwner
+	)
+	defer restoreCmd()
+	app := App{Config: Config{
+		Label: "app", System: NewSystem("s"), RootDir: "/src/a/app",
+	}}
+	err := app.Shell(context.Background())
+	assert.ErrorIs(t, err, ErrNameCollision)
+	// the other project's instance is not even started
+	assert.Len(t, *calls, 1)
+}
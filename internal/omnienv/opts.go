@@ -1,9 +1,82 @@
 package omnienv
 
+import "time"
+
 type Opts struct {
-	Launch  bool   `long:"launch"            description:"Create environment"`
-	System  string `long:"system"  short:"s" description:"Override system value"`
-	Verbose bool   `long:"verbose" short:"v" description:"Increase logging verbosity"`
-	Version bool   `long:"version"           description:"Show version"`
+	AutoLaunch        string        `long:"auto-launch"         description:"Launch a missing environment before the shell" optional:"yes" optional-value:"true" choice:"true" choice:"prompt" choice:"false"`
+	Env               []string      `long:"env"     short:"e"   description:"Set an environment variable, KEY=VAL, or KEY to pass it from the host"`
+	Launch            string        `long:"launch"              description:"Create environment" optional:"yes" optional-value:"missing" choice:"always" choice:"missing" choice:"never"`
+	Resume            bool          `long:"resume"              description:"Continue an interrupted launch"`
+	RollbackOnFailure bool          `long:"rollback-on-failure" description:"Delete the environment if launch fails"`
+	System            string        `long:"system"  short:"s"   description:"Override system value"`
+	Timeout           time.Duration `long:"timeout"             description:"Give up starting the environment after this long, e.g. 10m"`
+	TranslatePaths    bool          `long:"translate-paths"     description:"Translate host paths in arguments and output"`
+	Verbose           bool          `long:"verbose" short:"v"   description:"Increase logging verbosity"`
+	Version           bool          `long:"version"             description:"Show version"`
+
+	Status    struct{}     `command:"status"    description:"Show environment status"`
+	Snapshot  SnapshotOpts `command:"snapshot"  description:"Snapshot the environment"`
+	Snapshots struct{}     `command:"snapshots" description:"List environment snapshots"`
+	Restore   struct{}     `command:"restore"   description:"Restore the environment to a snapshot"`
+	Clone     CloneOpts    `command:"clone"     description:"Copy the environment to a new label or system"`
+	Export    ExportOpts   `command:"export"    description:"Write the environment to an archive"`
+	Import    struct{}     `command:"import"    description:"Create the environment from an archive"`
+	Publish   PublishOpts  `command:"publish"   description:"Publish the environment as a local image"`
+	Images    ImagesOpts   `command:"images"    description:"Manage the images environments are launched from"`
+	Forward   struct{}     `command:"forward"   description:"Forward ports to the environment until interrupted"`
+	Exec      struct{}     `command:"exec"      description:"Run a command in the environment without a pty"`
+	Session   SessionOpts  `command:"session"   description:"Manage shells that keep running when detached"`
+	Attach    struct{}     `command:"attach"    description:"Attach to a session, same as session attach"`
+	IdleWatch struct{}     `command:"idle-watch" description:"Stop the environment once idle" hidden:"yes"`
+	History   struct{}     `command:"history"   description:"Show what is recorded about the environment"`
+	Sync      struct{}     `command:"sync"      description:"Accept the current config as what the environment was launched with"`
+	Config    ConfigOpts   `command:"config"    description:"Check the config file"`
+
+	// Command is the name of the subcommand given, if any.  Nested
+	// subcommands are separated by a space, as in "images pull".
+	Command string
 	Params  []string
 }
+
+type SnapshotOpts struct {
+	Delete bool `long:"delete" description:"Delete the named snapshot"`
+}
+
+type CloneOpts struct {
+	ToLabel  string `long:"to-label"  description:"Label of the new environment"`
+	ToSystem string `long:"to-system" description:"System name of the new environment"`
+	ToDir    string `long:"to-dir"    description:"Project directory of the new environment"`
+	Snapshot string `long:"snapshot"  description:"Copy from this snapshot"`
+}
+
+type ExportOpts struct {
+	Snapshot string `long:"snapshot"          description:"Export this snapshot"`
+	Output   string `long:"output"   short:"o" description:"Archive to write" required:"yes"`
+}
+
+type PublishOpts struct {
+	Alias string `long:"alias" description:"Alias of the published image"`
+	List  bool   `long:"list"  description:"List the images published by omnienv"`
+}
+
+type ImagesOpts struct {
+	Pull     struct{} `command:"pull"     description:"Download the image of the environment"`
+	Outdated struct{} `command:"outdated" description:"List environments created from outdated images"`
+}
+
+type SessionOpts struct {
+	New    NewSessionOpts `command:"new"    description:"Start a session, running a shell or a command"`
+	Attach struct{}       `command:"attach" description:"Attach to a session"`
+	List   struct{}       `command:"list"   description:"List the sessions"`
+	Kill   struct{}       `command:"kill"   description:"End a session"`
+}
+
+type NewSessionOpts struct {
+	Detach bool   `long:"detach" short:"d" description:"Do not attach to the new session"`
+	Name   string `long:"name"   short:"n" description:"Name the session, main by default"`
+}
+
+type ConfigOpts struct {
+	Validate struct{} `command:"validate" description:"Report problems in the config file"`
+	Schema   struct{} `command:"schema"   description:"Print a JSON Schema of the config file"`
+}
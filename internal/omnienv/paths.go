@@ -0,0 +1,228 @@
+package omnienv
+
+import (
+	"io"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// guestWorkdir is where RootDir is mounted in the instance.
+const guestWorkdir = "/project"
+
+// mount is a host directory and where it appears in the instance.
+type mount struct {
+	Host  string
+	Guest string
+}
+
+// mounts are the host directories available in the instance, longest host
+// path first so that nested mounts are matched before their parents.
+func (app App) mounts() []mount {
+	mounts := []mount{{Host: filepath.Clean(app.Config.RootDir), Guest: guestWorkdir}}
+	sortMounts(mounts)
+	return mounts
+}
+
+func sortMounts(mounts []mount) {
+	slices.SortFunc(mounts, func(a, b mount) int {
+		return len(b.Host) - len(a.Host)
+	})
+}
+
+// under returns path relative to dir, if path is dir or below it.
+func under(path, dir string) (string, bool) {
+	if path == dir {
+		return "", true
+	}
+	if dir == "/" {
+		return path, strings.HasPrefix(path, "/")
+	}
+	rest, found := strings.CutPrefix(path, dir+"/")
+	if !found {
+		return "", false
+	}
+	return "/" + rest, true
+}
+
+// hostToGuest maps an absolute host path below a mount to the instance.
+func hostToGuest(mounts []mount, path string) (string, bool) {
+	if !filepath.IsAbs(path) {
+		return "", false
+	}
+	for _, mnt := range mounts {
+		if rest, found := under(path, mnt.Host); found {
+			return mnt.Guest + rest, true
+		}
+	}
+	return "", false
+}
+
+// resolve is the path with symlinks resolved, or just cleaned if that
+// fails, such as for a path that does not exist on this host.
+func resolve(path string) string {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	return filepath.Clean(path)
+}
+
+// guestDir is the directory in the instance matching wd on the host.  wd
+// is matched as given first, then with symlinks resolved on both sides,
+// and outside of the mounts falls back to the top of the project.
+func (app App) guestDir(wd string) string {
+	mounts := app.mounts()
+	if dest, found := hostToGuest(mounts, filepath.Clean(wd)); found {
+		return dest
+	}
+	for i := range mounts {
+		mounts[i].Host = resolve(mounts[i].Host)
+	}
+	sortMounts(mounts)
+	if dest, found := hostToGuest(mounts, resolve(wd)); found {
+		return dest
+	}
+	slog.Warn("working directory is outside the project", "dir", wd, "using", guestWorkdir)
+	return guestWorkdir
+}
+
+// translateArg maps an argument that is an absolute host path, or an
+// option of the form --name=PATH, to the instance.  Other arguments are
+// returned unchanged.
+func translateArg(mounts []mount, arg string) string {
+	if guest, found := hostToGuest(mounts, arg); found {
+		return guest
+	}
+	if name, value, found := strings.Cut(arg, "="); found && strings.HasPrefix(name, "-") {
+		if guest, found := hostToGuest(mounts, value); found {
+			return name + "=" + guest
+		}
+	}
+	return arg
+}
+
+// translatePaths reports if paths are to be translated, by Opts or by
+// default from Config.
+func (app App) translatePaths() bool {
+	return app.Opts.TranslatePaths || app.Config.TranslatePaths
+}
+
+// params are Params, with host paths translated if enabled.
+func (app App) params() []string {
+	if !app.translatePaths() {
+		return app.Opts.Params
+	}
+	mounts := app.mounts()
+	params := make([]string, len(app.Opts.Params))
+	for i, arg := range app.Opts.Params {
+		params[i] = translateArg(mounts, arg)
+	}
+	return params
+}
+
+// guestPathsRegexp matches the guest side of the mounts, longest first.
+func guestPathsRegexp(mounts []mount) *regexp.Regexp {
+	quoted := make([]string, len(mounts))
+	for i, mnt := range mounts {
+		quoted[i] = regexp.QuoteMeta(mnt.Guest)
+	}
+	slices.SortFunc(quoted, func(a, b string) int {
+		return len(b) - len(a)
+	})
+	return regexp.MustCompile(strings.Join(quoted, "|"))
+}
+
+// pathChar reports if c may be part of a path component, such that a
+// match next to it is part of a longer name, as in /projects.
+func pathChar(c byte) bool {
+	return c == '_' || c == '.' || c == '-' || c == '~' ||
+		'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// pathFilter writes output of the instance to w, with paths in the
+// instance translated back to the host.  Output is passed on as it is
+// written, so that prompts and progress show at once, except for a tail
+// that may be the start of a path, which is held until the rest of it
+// arrives.  Close writes out anything still held.
+type pathFilter struct {
+	w      io.Writer
+	guest  map[string]string
+	re     *regexp.Regexp
+	buffer []byte
+	// longest is the length of the longest guest path.
+	longest int
+	// last is the last byte written out, which decides if a path at the
+	// start of the buffer is part of a longer name.
+	last byte
+}
+
+func newPathFilter(w io.Writer, mounts []mount) *pathFilter {
+	filter := &pathFilter{w: w, guest: map[string]string{}, re: guestPathsRegexp(mounts)}
+	for _, mnt := range mounts {
+		filter.guest[mnt.Guest] = mnt.Host
+		filter.longest = max(filter.longest, len(mnt.Guest))
+	}
+	return filter
+}
+
+func (filter *pathFilter) translate(data []byte) []byte {
+	var out []byte
+	last := 0
+	for _, match := range filter.re.FindAllIndex(data, -1) {
+		start, end := match[0], match[1]
+		before := filter.last
+		if start > 0 {
+			before = data[start-1]
+		}
+		if pathChar(before) || before == '/' || end < len(data) && pathChar(data[end]) {
+			continue
+		}
+		out = append(out, data[last:start]...)
+		out = append(out, filter.guest[string(data[start:end])]...)
+		last = end
+	}
+	return append(out, data[last:]...)
+}
+
+// held is where the tail of the buffer that may be the start of a guest
+// path begins, or the end of the buffer if there is none.  A whole guest
+// path is held too, as what follows decides if it is part of a longer name.
+func (filter *pathFilter) held() int {
+	for i := max(0, len(filter.buffer)-filter.longest); i < len(filter.buffer); i++ {
+		if filter.buffer[i] != '/' {
+			continue
+		}
+		for guest := range filter.guest {
+			if strings.HasPrefix(guest, string(filter.buffer[i:])) {
+				return i
+			}
+		}
+	}
+	return len(filter.buffer)
+}
+
+// flush writes out the buffer up to end.
+func (filter *pathFilter) flush(end int) error {
+	if end == 0 {
+		return nil
+	}
+	out := filter.translate(filter.buffer[:end])
+	filter.last = filter.buffer[end-1]
+	filter.buffer = slices.Clone(filter.buffer[end:])
+	_, err := filter.w.Write(out)
+	return err
+}
+
+func (filter *pathFilter) Write(data []byte) (int, error) {
+	filter.buffer = append(filter.buffer, data...)
+	if err := filter.flush(filter.held()); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (filter *pathFilter) Close() error {
+	return filter.flush(len(filter.buffer))
+}
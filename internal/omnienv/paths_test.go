@@ -0,0 +1,158 @@
+package omnienv
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testMounts = []mount{{Host: "/home/u/src/proj", Guest: "/project"}}
+
+var translateArgTests = []struct {
+	arg      string
+	expected string
+}{
+	{"/home/u/src/proj", "/project"},
+	{"/home/u/src/proj/main.go", "/project/main.go"},
+	{"/home/u/src/proj/a b/c.go", "/project/a b/c.go"},
+	{"--config=/home/u/src/proj/x.yaml", "--config=/project/x.yaml"},
+	{"-I=/home/u/src/proj/include", "-I=/project/include"},
+	// not below the mount
+	{"/home/u/src/project/main.go", "/home/u/src/project/main.go"},
+	{"/home/u/src/proj-2", "/home/u/src/proj-2"},
+	{"/etc/passwd", "/etc/passwd"},
+	// relative paths resolve against the matching directory already
+	{"main.go", "main.go"},
+	{"home/u/src/proj/main.go", "home/u/src/proj/main.go"},
+	// only options are split on =
+	{"KEY=/home/u/src/proj", "KEY=/home/u/src/proj"},
+	{"", ""},
+}
+
+func TestTranslateArg(t *testing.T) {
+	for _, test := range translateArgTests {
+		assert.Equal(t, test.expected, translateArg(testMounts, test.arg), test.arg)
+	}
+}
+
+func TestParams(t *testing.T) {
+	params := []string{"go", "test", "/home/u/src/proj/pkg"}
+	app := App{
+		Config: Config{RootDir: "/home/u/src/proj/"},
+		Opts:   Opts{Params: params},
+	}
+	assert.Equal(t, params, app.params())
+
+	app.Opts.TranslatePaths = true
+	assert.Equal(t, []string{"go", "test", "/project/pkg"}, app.params())
+
+	app.Opts.TranslatePaths = false
+	app.Config.TranslatePaths = true
+	assert.Equal(t, []string{"go", "test", "/project/pkg"}, app.params())
+}
+
+var pathFilterTests = []struct {
+	summary string
+	writes  []string
+	// flushed is the output before Close, if it differs from expected
+	flushed  string
+	expected string
+}{{
+	summary:  "compiler error",
+	writes:   []string{"/project/main.go:3:1: syntax error\n"},
+	expected: "/home/u/src/proj/main.go:3:1: syntax error\n",
+}, {
+	summary:  "split across writes",
+	writes:   []string{"at /pro", "ject/a.go\nat /project/b.go\n"},
+	expected: "at /home/u/src/proj/a.go\nat /home/u/src/proj/b.go\n",
+}, {
+	summary:  "incomplete last line",
+	writes:   []string{"in /project"},
+	expected: "in /home/u/src/proj",
+}, {
+	summary:  "adjacent and quoted",
+	writes:   []string{"/project /project '/project/x' (/project)\n"},
+	expected: "/home/u/src/proj /home/u/src/proj '/home/u/src/proj/x' (/home/u/src/proj)\n",
+}, {
+	summary:  "prompt without newline",
+	writes:   []string{"Continue? "},
+	flushed:  "Continue? ",
+	expected: "Continue? ",
+}, {
+	summary:  "progress",
+	writes:   []string{"10%\r", "20%\r"},
+	flushed:  "10%\r20%\r",
+	expected: "10%\r20%\r",
+}, {
+	summary:  "possible path held",
+	writes:   []string{"cd /proj"},
+	flushed:  "cd ",
+	expected: "cd /proj",
+}, {
+	summary:  "whole path held for what follows",
+	writes:   []string{"a /project", "s\n"},
+	expected: "a /projects\n",
+}, {
+	summary:  "path after a name split across writes",
+	writes:   []string{"x", "/project\n"},
+	expected: "x/project\n",
+}, {
+	summary:  "longer names untouched",
+	writes:   []string{"/projects /project-x /x/project ~/project /project.go\n"},
+	expected: "/projects /project-x /x/project ~/project /project.go\n",
+}}
+
+func TestPathFilter(t *testing.T) {
+	for _, test := range pathFilterTests {
+		var out bytes.Buffer
+		filter := newPathFilter(&out, testMounts)
+		for _, data := range test.writes {
+			n, err := filter.Write([]byte(data))
+			assert.Nil(t, err, test.summary)
+			assert.Equal(t, len(data), n, test.summary)
+		}
+		if test.flushed != "" {
+			assert.Equal(t, test.flushed, out.String(), test.summary)
+		}
+		assert.Nil(t, filter.Close(), test.summary)
+		assert.Equal(t, test.expected, out.String(), test.summary)
+	}
+}
+
+func TestGuestDir(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "proj")
+	for _, dir := range []string{"proj/sub/deep", "proj2", "other"} {
+		assert.Nil(t, os.MkdirAll(filepath.Join(base, dir), 0o755))
+	}
+	assert.Nil(t, os.Symlink(root, filepath.Join(base, "link")))
+	assert.Nil(t, os.Symlink(filepath.Join(root, "sub"), filepath.Join(base, "other", "sub")))
+
+	tests := []struct {
+		summary string
+		rootDir string
+		wd      string
+		dest    string
+		warning bool
+	}{
+		{"root", root, root, "/project", false},
+		{"subdir", root, filepath.Join(root, "sub", "deep"), "/project/sub/deep", false},
+		{"unclean", root + "/", root + "/sub/../sub/", "/project/sub", false},
+		{"prefix collision", root, filepath.Join(base, "proj2"), "/project", true},
+		{"outside", root, filepath.Join(base, "other"), "/project", true},
+		{"symlinked wd", root, filepath.Join(base, "link", "sub"), "/project/sub", false},
+		{"symlink into project", root, filepath.Join(base, "other", "sub", "deep"), "/project/sub/deep", false},
+		{"symlinked root", filepath.Join(base, "link"), filepath.Join(root, "sub"), "/project/sub", false},
+	}
+	for _, test := range tests {
+		logs := patchLog(t)
+		app := App{Config: Config{RootDir: test.rootDir}}
+		assert.Equal(t, test.dest, app.guestDir(test.wd), test.summary)
+		assert.Equal(t, test.warning,
+			strings.Contains(logs.String(), "outside the project"), test.summary)
+	}
+}
@@ -0,0 +1,264 @@
+package omnienv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Device name prefixes of the proxy devices for ports from the config, and
+// for ports forwarded by Forward.
+const (
+	portDevicePrefix    = "oe-port"
+	forwardDevicePrefix = "oe-forward"
+)
+
+var ErrPortInUse = errors.New("port already in use")
+
+// ErrPortsVM is returned for port forwarding to a VM, as LXD forwards to
+// VMs only in NAT mode, which needs a static address for the instance.
+var ErrPortsVM = errors.New("port forwarding is not supported for VMs")
+
+// Port forwards a port on the host to a port in the instance.
+type Port struct {
+	Host  int
+	Guest int
+	// Proto is "tcp" (default) or "udp".
+	Proto string
+}
+
+func (port Port) validate() error {
+	for _, num := range []int{port.Host, port.Guest} {
+		if num <= 0 || num > 65535 {
+			return fmt.Errorf("invalid port %d", num)
+		}
+	}
+	switch port.Proto {
+	case "tcp", "udp":
+		return nil
+	default:
+		return fmt.Errorf("invalid port proto %q, expected tcp or udp", port.Proto)
+	}
+}
+
+func (port *Port) UnmarshalYAML(node *yaml.Node) error {
+	return collectable(port.unmarshal(node))
+}
+
+func (port *Port) unmarshal(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		// if a number, the same port on both sides
+		var num int
+		if err := node.Decode(&num); err != nil {
+			return err
+		}
+		*port = Port{Host: num, Guest: num, Proto: "tcp"}
+	case yaml.MappingNode:
+		if err := checkFields(node, "host", "guest", "proto"); err != nil {
+			return err
+		}
+		var dict struct {
+			Host  int
+			Guest int
+			Proto string
+		}
+		if err := node.Decode(&dict); err != nil {
+			return err
+		}
+		*port = Port(dict)
+		if port.Guest == 0 {
+			port.Guest = port.Host
+		}
+		if port.Proto == "" {
+			port.Proto = "tcp"
+		}
+	default:
+		return nodeError(node, "expected a port number or a map of host, guest and proto")
+	}
+	if err := port.validate(); err != nil {
+		return nodeError(node, "%v", err)
+	}
+	return nil
+}
+
+// MarshalYAML writes the port in the map form UnmarshalYAML reads.
+func (port Port) MarshalYAML() (any, error) {
+	return struct {
+		Host  int
+		Guest int
+		Proto string
+	}(port), nil
+}
+
+// ParsePort parses a port given as PORT or HOST:GUEST, optionally followed
+// by /tcp or /udp.
+func ParsePort(val string) (Port, error) {
+	port := Port{Proto: "tcp"}
+	spec, proto, found := strings.Cut(val, "/")
+	if found {
+		port.Proto = proto
+	}
+
+	host, guest, found := strings.Cut(spec, ":")
+	var err error
+	if port.Host, err = strconv.Atoi(host); err != nil {
+		return Port{}, fmt.Errorf("invalid port %q", val)
+	}
+	port.Guest = port.Host
+	if found {
+		if port.Guest, err = strconv.Atoi(guest); err != nil {
+			return Port{}, fmt.Errorf("invalid port %q", val)
+		}
+	}
+	return port, port.validate()
+}
+
+func (port Port) String() string {
+	if port.Host == port.Guest {
+		return fmt.Sprintf("%d/%s", port.Host, port.Proto)
+	}
+	return fmt.Sprintf("%d:%d/%s", port.Host, port.Guest, port.Proto)
+}
+
+func (port Port) device(prefix string) string {
+	return fmt.Sprintf("%s-%s-%d", prefix, port.Proto, port.Host)
+}
+
+// checkHostPort fails if something on the host is listening on the port.
+func checkHostPort(port Port) error {
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port.Host))
+	var err error
+	if port.Proto == "udp" {
+		var conn net.PacketConn
+		if conn, err = net.ListenPacket("udp", addr); err == nil {
+			conn.Close()
+		}
+	} else {
+		var listener net.Listener
+		if listener, err = net.Listen("tcp", addr); err == nil {
+			listener.Close()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%w: host port %s: %w", ErrPortInUse, port, err)
+	}
+	return nil
+}
+
+// forwardedPorts are the proxy devices of the instance with the prefix.
+func (app App) forwardedPorts(ctx context.Context, prefix string) (map[string]Port, error) {
+	devices, err := app.backend().ProxyDevices(ctx, app.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list proxy devices: %w", err)
+	}
+	for device := range devices {
+		if !strings.HasPrefix(device, prefix+"-") {
+			delete(devices, device)
+		}
+	}
+	return devices, nil
+}
+
+// removeForwarding removes the proxy devices omnienv added, such as those
+// copied along with an instance, which would conflict with the original's.
+func (app App) removeForwarding(ctx context.Context) error {
+	for _, prefix := range []string{portDevicePrefix, forwardDevicePrefix} {
+		devices, err := app.forwardedPorts(ctx, prefix)
+		if err != nil {
+			return err
+		}
+		for device, port := range devices {
+			if err := app.backend().RemoveDevice(ctx, app.Name(), device); err != nil {
+				return fmt.Errorf("failed to remove port %s: %w", port, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (app App) forward(ctx context.Context, prefix string, port Port) error {
+	if err := checkHostPort(port); err != nil {
+		return err
+	}
+	if err := app.backend().AddProxyDevice(ctx, app.Name(), port.device(prefix), port); err != nil {
+		return fmt.Errorf("failed to forward port %s: %w", port, err)
+	}
+	return nil
+}
+
+// ensurePorts makes the proxy devices of the instance match Config.Ports,
+// adding those missing and removing those no longer configured, including
+// all of them once the ports are removed from the config.
+func (app App) ensurePorts(ctx context.Context) error {
+	current, err := app.forwardedPorts(ctx, portDevicePrefix)
+	if err != nil {
+		return err
+	}
+	for device, port := range current {
+		if slices.Contains(app.Config.Ports, port) {
+			continue
+		}
+		slog.Debug("removing port", "port", port.String())
+		if err := app.backend().RemoveDevice(ctx, app.Name(), device); err != nil {
+			return fmt.Errorf("failed to remove port %s: %w", port, err)
+		}
+	}
+	for _, port := range app.Config.Ports {
+		if current[port.device(portDevicePrefix)] == port {
+			continue
+		}
+		slog.Debug("adding port", "port", port.String())
+		if err := app.forward(ctx, portDevicePrefix, port); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Forward forwards the ports from the host to the instance until ctx is
+// done, then removes the forwarding again.
+func (app App) Forward(ctx context.Context, ports []Port) error {
+	if app.Config.isVM() {
+		return ErrPortsVM
+	}
+	if err := app.checkOwner(ctx); err != nil {
+		return err
+	}
+	if err := app.StartIfNeeded(ctx); err != nil {
+		return fmt.Errorf("failed to start instance: %w", err)
+	}
+
+	var added []Port
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+		defer cancel()
+		for _, port := range added {
+			err := app.backend().RemoveDevice(ctx, app.Name(), port.device(forwardDevicePrefix))
+			if err != nil {
+				slog.Warn("failed to stop forwarding", "port", port.String(), "error", err)
+			}
+		}
+	}()
+
+	for _, port := range ports {
+		if err := app.forward(ctx, forwardDevicePrefix, port); err != nil {
+			return err
+		}
+		added = append(added, port)
+		fmt.Fprintf(progress, "Forwarding localhost:%d to %s:%d/%s\n",
+			port.Host, app.Name(), port.Guest, port.Proto)
+	}
+
+	fmt.Fprintln(progress, "Press Ctrl-C to stop forwarding")
+	<-ctx.Done()
+	return nil
+}
@@ -0,0 +1,219 @@
+package omnienv
+
+import (
+	"context"
+	"net"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+var portUnmarshalTests = []struct {
+	summary string
+	data    string
+
+	ports  []Port
+	errMsg string
+}{{
+	summary: "number",
+	data:    "[8080]",
+	ports:   []Port{{Host: 8080, Guest: 8080, Proto: "tcp"}},
+}, {
+	summary: "map",
+	data:    "[{host: 3000, guest: 80, proto: udp}]",
+	ports:   []Port{{Host: 3000, Guest: 80, Proto: "udp"}},
+}, {
+	summary: "map defaults",
+	data:    "[{host: 3000}]",
+	ports:   []Port{{Host: 3000, Guest: 3000, Proto: "tcp"}},
+}, {
+	summary: "out of range",
+	data:    "[70000]",
+	errMsg:  "invalid port 70000",
+}, {
+	summary: "map without host",
+	data:    "[{guest: 80}]",
+	errMsg:  "invalid port 0",
+}, {
+	summary: "bad proto",
+	data:    "[{host: 53, proto: sctp}]",
+	errMsg:  `invalid port proto "sctp"`,
+}, {
+	summary: "string",
+	data:    "[http]",
+	errMsg:  "cannot unmarshal",
+}}
+
+func TestPortUnmarshal(t *testing.T) {
+	for _, test := range portUnmarshalTests {
+		var ports []Port
+		err := yaml.Unmarshal([]byte(test.data), &ports)
+		if test.errMsg != "" {
+			assert.ErrorContains(t, err, test.errMsg, test.summary)
+		} else {
+			assert.Nil(t, err, test.summary)
+			assert.Equal(t, test.ports, ports, test.summary)
+		}
+	}
+}
+
+var parsePortTests = []struct {
+	val string
+
+	port   Port
+	errMsg string
+}{
+	{val: "5432", port: Port{Host: 5432, Guest: 5432, Proto: "tcp"}},
+	{val: "3000:80", port: Port{Host: 3000, Guest: 80, Proto: "tcp"}},
+	{val: "53/udp", port: Port{Host: 53, Guest: 53, Proto: "udp"}},
+	{val: "x", errMsg: `invalid port "x"`},
+	{val: "1:x", errMsg: `invalid port "1:x"`},
+	{val: "0", errMsg: "invalid port 0"},
+	{val: "80/icmp", errMsg: `invalid port proto "icmp"`},
+}
+
+func TestParsePort(t *testing.T) {
+	for _, test := range parsePortTests {
+		port, err := ParsePort(test.val)
+		if test.errMsg != "" {
+			assert.ErrorContains(t, err, test.errMsg, test.val)
+		} else {
+			assert.Nil(t, err, test.val)
+			assert.Equal(t, test.port, port, test.val)
+		}
+	}
+}
+
+func TestPortString(t *testing.T) {
+	assert.Equal(t, "80/tcp", Port{Host: 80, Guest: 80, Proto: "tcp"}.String())
+	assert.Equal(t, "3000:80/udp", Port{Host: 3000, Guest: 80, Proto: "udp"}.String())
+}
+
+// busyPort listens on a free localhost port for the rest of the test.
+func busyPort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// freePort finds a localhost port that nothing is listening on.
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestCheckHostPort(t *testing.T) {
+	busy := busyPort(t)
+	err := checkHostPort(Port{Host: busy, Guest: 80, Proto: "tcp"})
+	assert.ErrorIs(t, err, ErrPortInUse)
+
+	free := freePort(t)
+	assert.Nil(t, checkHostPort(Port{Host: free, Guest: 80, Proto: "tcp"}))
+}
+
+func TestEnsurePortsNone(t *testing.T) {
+	fake := &fakeBackend{}
+	assert.Nil(t, testApp(fake).ensurePorts(context.Background()))
+	assert.Equal(t, []string{"devices l-s"}, fake.calls)
+}
+
+func TestEnsurePortsAllRemoved(t *testing.T) {
+	port := Port{Host: 8080, Guest: 8080, Proto: "tcp"}
+	fake := &fakeBackend{devices: map[string]Port{
+		port.device(portDevicePrefix): port,
+	}}
+	app := testApp(fake)
+	app.Config.Ports = []Port{port}
+	assert.Nil(t, app.ensurePorts(context.Background()))
+	assert.Equal(t, []string{"devices l-s"}, fake.calls)
+
+	// the last port is removed from the config
+	fake.calls = nil
+	assert.Nil(t, testApp(fake).ensurePorts(context.Background()))
+	assert.Equal(t, []string{"devices l-s", "remove l-s oe-port-tcp-8080"}, fake.calls)
+	assert.Empty(t, fake.devices)
+}
+
+func TestEnsurePorts(t *testing.T) {
+	kept := Port{Host: freePort(t), Guest: 80, Proto: "tcp"}
+	added := Port{Host: freePort(t), Guest: 81, Proto: "tcp"}
+	stale := Port{Host: 9999, Guest: 9999, Proto: "tcp"}
+	fake := &fakeBackend{devices: map[string]Port{
+		kept.device(portDevicePrefix):     kept,
+		stale.device(portDevicePrefix):    stale,
+		"oe-forward-tcp-5432":             {Host: 5432, Guest: 5432, Proto: "tcp"},
+		stale.device(forwardDevicePrefix): stale,
+	}}
+	app := testApp(fake)
+	app.Config.Ports = []Port{kept, added}
+	assert.Nil(t, app.ensurePorts(context.Background()))
+	assert.Equal(t, []string{
+		"devices l-s",
+		"remove l-s oe-port-tcp-9999",
+		"add l-s " + added.device(portDevicePrefix),
+	}, fake.calls)
+	// ports forwarded by oe forward are left alone
+	assert.Contains(t, fake.devices, "oe-forward-tcp-5432")
+}
+
+func TestEnsurePortsConflict(t *testing.T) {
+	busy := Port{Host: busyPort(t), Guest: 80, Proto: "tcp"}
+	fake := &fakeBackend{}
+	app := testApp(fake)
+	app.Config.Ports = []Port{busy}
+	err := app.ensurePorts(context.Background())
+	assert.ErrorIs(t, err, ErrPortInUse)
+	assert.Equal(t, []string{"devices l-s"}, fake.calls)
+}
+
+func TestForward(t *testing.T) {
+	restoreCmd, _ := patchCommands(
+		exec.Command("/bin/true"),                    // checkOwner
+		exec.Command("/bin/echo", "Status: RUNNING"), // StartIfNeeded
+	)
+	defer restoreCmd()
+	restoreProgress, _ := patchProgress()
+	defer restoreProgress()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	port := Port{Host: freePort(t), Guest: 5432, Proto: "tcp"}
+	fake := &fakeBackend{}
+	assert.Nil(t, testApp(fake).Forward(ctx, []Port{port}))
+	device := port.device(forwardDevicePrefix)
+	assert.Equal(t, []string{"add l-s " + device, "remove l-s " + device}, fake.calls)
+}
+
+func TestForwardVM(t *testing.T) {
+	restoreCmd, calls := patchCommands()
+	defer restoreCmd()
+	app := testApp(&fakeBackend{})
+	app.Config.Virtualization = "vm"
+	err := app.Forward(context.Background(), []Port{{Host: 80, Guest: 80, Proto: "tcp"}})
+	assert.ErrorIs(t, err, ErrPortsVM)
+	assert.Empty(t, *calls)
+}
+
+func TestForwardConflict(t *testing.T) {
+	restoreCmd, _ := patchCommands(
+		exec.Command("/bin/true"),                    // checkOwner
+		exec.Command("/bin/echo", "Status: RUNNING"), // StartIfNeeded
+	)
+	defer restoreCmd()
+	restoreProgress, _ := patchProgress()
+	defer restoreProgress()
+
+	free := Port{Host: freePort(t), Guest: 80, Proto: "tcp"}
+	busy := Port{Host: busyPort(t), Guest: 81, Proto: "tcp"}
+	fake := &fakeBackend{}
+	err := testApp(fake).Forward(context.Background(), []Port{free, busy})
+	assert.ErrorIs(t, err, ErrPortInUse)
+	// the port already forwarded is cleaned up
+	device := free.device(forwardDevicePrefix)
+	assert.Equal(t, []string{"add l-s " + device, "remove l-s " + device}, fake.calls)
+}
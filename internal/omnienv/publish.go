@@ -0,0 +1,92 @@
+package omnienv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Properties omnienv sets on the images it publishes.
+const (
+	imageSourceProperty     = "omnienv.source"
+	imageConfigHashProperty = "omnienv.config-hash"
+	imageSystemProperty     = "omnienv.system"
+)
+
+// Publish stops the instance and publishes it as a local image under the
+// alias given by Opts.Publish, so that configs can launch from it with an
+// image of local:<alias>.  The instance is started again if it was running,
+// even if publishing fails.
+func (app App) Publish(ctx context.Context) (err error) {
+	alias := app.Opts.Publish.Alias
+	if alias == "" {
+		return errors.New("publish requires --alias")
+	}
+	if err := app.checkOwner(ctx); err != nil {
+		return err
+	}
+	// held until restarted, so that a shell does not start the instance
+	// while it is being published
+	unlock, err := app.lock(ctx, "publish")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	fields, err := app.info(ctx)
+	if err != nil {
+		return err
+	}
+	running := fields["Status"] == "RUNNING"
+	if running {
+		if err := runQuiet(ctx, "lxc", "stop", app.Name()); err != nil {
+			return fmt.Errorf("failed to stop instance: %w", err)
+		}
+		defer func() {
+			// publishing being cancelled may be why it failed
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+			defer cancel()
+			if startErr := app.start(ctx); startErr != nil {
+				if err == nil {
+					err = startErr
+				} else {
+					err = fmt.Errorf("%w (restart also failed: %v)", err, startErr)
+				}
+			}
+		}()
+	}
+
+	hash, err := app.configHash()
+	if err != nil {
+		return err
+	}
+	properties := map[string]string{
+		imageSourceProperty:     app.Name(),
+		imageConfigHashProperty: hash,
+		imageSystemProperty:     app.system(),
+	}
+	err = app.backend().PublishImage(ctx, app.Name(), alias, properties)
+	if err != nil {
+		return fmt.Errorf("failed to publish image: %w", err)
+	}
+	return nil
+}
+
+// PublishedImages lists the local images that Publish created.
+func (app App) PublishedImages(ctx context.Context) ([]Image, error) {
+	images, err := app.backend().ListImages(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %w", err)
+	}
+
+	published := slices.DeleteFunc(images, func(image Image) bool {
+		return image.Properties[imageSourceProperty] == ""
+	})
+	slices.SortFunc(published, func(a, b Image) int {
+		return strings.Compare(strings.Join(a.Aliases, ","), strings.Join(b.Aliases, ","))
+	})
+	return published, nil
+}
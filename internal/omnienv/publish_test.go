@@ -0,0 +1,171 @@
+package omnienv
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishRunning(t *testing.T) {
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/true"),                    // checkOwner
+		exec.Command("/bin/echo", "Status: RUNNING"), // lxc info
+		exec.Command("/bin/true"),                    // lxc stop
+		exec.Command("/bin/true"),                    // lxc start
+	)
+	defer restoreCmd()
+
+	fake := &fakeBackend{}
+	app := testApp(fake)
+	app.Opts.Publish.Alias = "team/l"
+	assert.Nil(t, app.Publish(context.Background()))
+	assert.Equal(t, [][]string{
+		{"lxc", "config", "get", "l-s", "user.omnienv.root-dir"},
+		{"lxc", "info", "l-s"},
+		{"lxc", "stop", "l-s"},
+		{"lxc", "start", "l-s"},
+	}, *calls)
+	assert.Equal(t, []string{"publish l-s as team/l"}, fake.calls)
+
+	hash, err := app.configHash()
+	assert.Nil(t, err)
+	require.Len(t, fake.images, 1)
+	assert.Equal(t, map[string]string{
+		"omnienv.source":      "l-s",
+		"omnienv.config-hash": hash,
+		"omnienv.system":      "s",
+	}, fake.images[0].Properties)
+}
+
+func TestPublishWaitsForLock(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	restoreProgress, _ := patchProgress()
+	defer restoreProgress()
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/true"), // checkOwner
+	)
+	defer restoreCmd()
+
+	fake := &fakeBackend{}
+	app := testApp(fake)
+	app.Opts.Publish.Alias = "team/l"
+	unlock, err := app.lock(context.Background(), "start")
+	require.Nil(t, err)
+	defer unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = app.Publish(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	// not stopped while the lock is held elsewhere
+	assert.Len(t, *calls, 1)
+	assert.Empty(t, fake.calls)
+}
+
+func TestPublishFailsRestarts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/true"),                    // checkOwner
+		exec.Command("/bin/echo", "Status: RUNNING"), // lxc info
+		exec.Command("/bin/true"),                    // lxc stop
+		exec.Command("/bin/true"),                    // lxc start
+	)
+	defer restoreCmd()
+
+	// interrupted while publishing
+	fake := &fakeBackend{err: context.Canceled}
+	cancel()
+	app := testApp(fake)
+	app.Opts.Publish.Alias = "team/l"
+	err := app.Publish(ctx)
+	assert.ErrorContains(t, err, "failed to publish image")
+	require.Len(t, *calls, 4)
+	assert.Equal(t, []string{"lxc", "start", "l-s"}, (*calls)[3])
+}
+
+func TestPublishRestartFails(t *testing.T) {
+	restoreCmd, _ := patchCommands(
+		exec.Command("/bin/true"),                    // checkOwner
+		exec.Command("/bin/echo", "Status: RUNNING"), // lxc info
+		exec.Command("/bin/true"),                    // lxc stop
+		exec.Command("/bin/false"),                   // lxc start
+	)
+	defer restoreCmd()
+
+	fake := &fakeBackend{err: errors.New("boom")}
+	app := testApp(fake)
+	app.Opts.Publish.Alias = "team/l"
+	err := app.Publish(context.Background())
+	assert.ErrorContains(t, err, "failed to publish image: boom")
+	assert.ErrorContains(t, err, "restart also failed")
+}
+
+func TestPublishedRestartFails(t *testing.T) {
+	restoreCmd, _ := patchCommands(
+		exec.Command("/bin/true"),                    // checkOwner
+		exec.Command("/bin/echo", "Status: RUNNING"), // lxc info
+		exec.Command("/bin/true"),                    // lxc stop
+		exec.Command("/bin/false"),                   // lxc start
+	)
+	defer restoreCmd()
+
+	app := testApp(&fakeBackend{})
+	app.Opts.Publish.Alias = "team/l"
+	err := app.Publish(context.Background())
+	assert.ErrorContains(t, err, "failed to start instance")
+}
+
+func TestPublishStopped(t *testing.T) {
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/true"),                    // checkOwner
+		exec.Command("/bin/echo", "Status: STOPPED"), // lxc info
+	)
+	defer restoreCmd()
+
+	fake := &fakeBackend{}
+	app := testApp(fake)
+	app.Opts.Publish.Alias = "team/l"
+	assert.Nil(t, app.Publish(context.Background()))
+	assert.Len(t, *calls, 2)
+	assert.Equal(t, []string{"publish l-s as team/l"}, fake.calls)
+}
+
+func TestPublishNoAlias(t *testing.T) {
+	fake := &fakeBackend{}
+	err := testApp(fake).Publish(context.Background())
+	assert.ErrorContains(t, err, "publish requires --alias")
+	assert.Empty(t, fake.calls)
+}
+
+func TestPublishedImages(t *testing.T) {
+	fake := &fakeBackend{images: []Image{
+		{Aliases: []string{"z"}, Properties: map[string]string{imageSourceProperty: "z-s"}},
+		{Aliases: []string{"ubuntu"}, Properties: map[string]string{"os": "ubuntu"}},
+		{Aliases: []string{"a"}, Properties: map[string]string{imageSourceProperty: "a-s"}},
+	}}
+	images, err := testApp(fake).PublishedImages(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []Image{
+		{Aliases: []string{"a"}, Properties: map[string]string{imageSourceProperty: "a-s"}},
+		{Aliases: []string{"z"}, Properties: map[string]string{imageSourceProperty: "z-s"}},
+	}, images)
+}
+
+func TestConfigHash(t *testing.T) {
+	app := testApp(nil)
+	a, err := app.configHash()
+	assert.Nil(t, err)
+	assert.Len(t, a, 16)
+	b, _ := app.configHash()
+	assert.Equal(t, a, b)
+	// settings applied on every shell are not part of it
+	app.Config.Env = map[string]string{"CI": "true"}
+	b, _ = app.configHash()
+	assert.Equal(t, a, b)
+	app.Config.Virtualization = "vm"
+	c, _ := app.configHash()
+	assert.NotEqual(t, a, c)
+}
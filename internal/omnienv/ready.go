@@ -0,0 +1,284 @@
+package omnienv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultReadyTimeout = 5 * time.Minute
+	probeTimeout        = 30 * time.Second
+	backoffMin          = 250 * time.Millisecond
+	backoffMax          = 5 * time.Second
+)
+
+var probeKinds = []string{"agent", "user", "systemd", "cloud-init"}
+
+// Probe is a single readiness check run inside the instance.
+type Probe struct {
+	// Kind is one of "agent", "user", "systemd", "cloud-init", "command"
+	// or "port".
+	Kind string
+	// Command is the shell snippet run for the "command" kind.
+	Command string
+	// Port is the TCP port that must be listening for the "port" kind.
+	Port int
+}
+
+func (probe *Probe) UnmarshalYAML(node *yaml.Node) error {
+	return collectable(probe.unmarshal(node))
+}
+
+func (probe *Probe) unmarshal(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		// if string, it must name one of the builtin probes
+		if !slices.Contains(probeKinds, node.Value) {
+			return nodeError(node, "unknown probe %q", node.Value)
+		}
+		*probe = Probe{Kind: node.Value}
+		return nil
+	case yaml.MappingNode:
+		// otherwise a map with exactly one of command or port
+		if err := checkFields(node, "command", "port"); err != nil {
+			return err
+		}
+		var dict struct {
+			Command string
+			Port    int
+		}
+		if err := node.Decode(&dict); err != nil {
+			return err
+		}
+		switch {
+		case dict.Command != "" && dict.Port != 0:
+			return nodeError(node, "probe has both command and port, expected one")
+		case dict.Command != "":
+			*probe = Probe{Kind: "command", Command: dict.Command}
+		case dict.Port > 0 && dict.Port < 65536:
+			*probe = Probe{Kind: "port", Port: dict.Port}
+		case dict.Port != 0:
+			return nodeError(node, "invalid probe port %d", dict.Port)
+		default:
+			return nodeError(node, "empty probe map")
+		}
+		return nil
+	default:
+		return nodeError(node, "expected a probe name or a map of command or port")
+	}
+}
+
+// MarshalYAML writes the probe in the form UnmarshalYAML reads.
+func (probe Probe) MarshalYAML() (any, error) {
+	switch probe.Kind {
+	case "command":
+		return map[string]string{"command": probe.Command}, nil
+	case "port":
+		return map[string]int{"port": probe.Port}, nil
+	default:
+		return probe.Kind, nil
+	}
+}
+
+func (probe Probe) String() string {
+	switch probe.Kind {
+	case "command":
+		return fmt.Sprintf("command %q", probe.Command)
+	case "port":
+		return fmt.Sprintf("port %d", probe.Port)
+	default:
+		return probe.Kind
+	}
+}
+
+// Ready controls how omnienv decides that an instance is usable.
+type Ready struct {
+	// Timeout bounds the total time spent waiting across all probes.
+	// Defaults to 5 minutes.
+	Timeout time.Duration
+	// Probes are checked in order, each must pass before the next is
+	// attempted.  When unset, the user account must exist, and for VMs
+	// the LXD agent must first be reachable.
+	Probes []Probe
+}
+
+func portScript(port int) string {
+	// inspect the listening sockets directly rather than depend on tools
+	// like ss or nc being present in the image
+	return fmt.Sprintf(
+		`awk 'FNR > 1 && $4 == "0A" { split($2, a, ":"); print a[2] }' `+
+			`/proc/net/tcp /proc/net/tcp6 2>/dev/null | grep -qx %04X`,
+		port,
+	)
+}
+
+func (probe Probe) args() []string {
+	switch probe.Kind {
+	case "agent":
+		return []string{"/bin/true"}
+	case "user":
+		return []string{"id", "-u", "user"}
+	case "systemd":
+		return []string{"systemctl", "is-system-running"}
+	case "cloud-init":
+		return []string{"cloud-init", "status"}
+	case "command":
+		return []string{"sh", "-c", probe.Command}
+	case "port":
+		return []string{"sh", "-c", portScript(probe.Port)}
+	}
+	return nil
+}
+
+// probeExec runs the command in the instance, reporting the exit code
+// rather than treating a non-zero exit as an error.  An exit code of -1
+// indicates the command was interrupted.
+func (app App) probeExec(ctx context.Context, args ...string) (string, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	cmd := append([]string{"lxc", "exec", app.Name(), "--"}, args...)
+	cc := commandContext(ctx, cmd[0], cmd[1:]...)
+	slog.Debug("run", "command", cc.Args)
+	out, err := cc.Output()
+	if err != nil {
+		exitError, ok := err.(*exec.ExitError)
+		if !ok {
+			return "", 0, err
+		}
+		return strings.TrimSpace(string(out)), exitError.ExitCode(), nil
+	}
+	return strings.TrimSpace(string(out)), 0, nil
+}
+
+// check reports if the probe has passed, or an error if it never will.
+func (app App) check(ctx context.Context, probe Probe) (bool, error) {
+	args := probe.args()
+	if args == nil {
+		return false, fmt.Errorf("unknown probe %q", probe.Kind)
+	}
+
+	out, ec, err := app.probeExec(ctx, args...)
+	if err != nil {
+		return false, err
+	}
+	// lxc exec exits 255 when it cannot reach the instance at all
+	if ec < 0 || ec == 255 {
+		return false, nil
+	}
+
+	switch probe.Kind {
+	case "agent":
+		if ec != 0 {
+			return false, fmt.Errorf("strange exit code %d", ec)
+		}
+		return true, nil
+	case "systemd":
+		return out == "running" || out == "degraded", nil
+	case "cloud-init":
+		for _, line := range strings.Split(out, "\n") {
+			if after, found := strings.CutPrefix(line, "status: "); found {
+				switch after {
+				case "done", "disabled", "degraded done":
+					return true, nil
+				case "error":
+					return false, errors.New("cloud-init reported an error")
+				}
+			}
+		}
+		return false, nil
+	default:
+		return ec == 0, nil
+	}
+}
+
+func (app App) defaultProbes(ctx context.Context) ([]Probe, error) {
+	vm, err := app.isVM(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if vm {
+		return []Probe{{Kind: "agent"}, {Kind: "user"}}, nil
+	}
+	return []Probe{{Kind: "user"}}, nil
+}
+
+func (app App) probes(ctx context.Context) ([]Probe, error) {
+	if len(app.Config.Ready.Probes) > 0 {
+		return app.Config.Ready.Probes, nil
+	}
+	return app.defaultProbes(ctx)
+}
+
+func (app App) waitForProbe(ctx context.Context, probe Probe, deadline time.Time) error {
+	delay := backoffMin
+	waiting := false
+	defer func() {
+		if waiting {
+			fmt.Fprintln(progress)
+		}
+	}()
+
+	for {
+		ready, err := app.check(ctx, probe)
+		if err != nil {
+			return fmt.Errorf("%s probe: %w", probe, err)
+		}
+		if ready {
+			slog.Debug("probe ready", "probe", probe.String())
+			return nil
+		}
+
+		remaining := deadline.Sub(timeNow())
+		if remaining <= 0 {
+			return fmt.Errorf(
+				"timed out waiting for %s on %s", probe, app.Name(),
+			)
+		}
+
+		if !waiting {
+			fmt.Fprintf(progress, "Waiting for %s", probe)
+			waiting = true
+		} else {
+			fmt.Fprint(progress, ".")
+		}
+		if err := sleep(ctx, min(delay, remaining)); err != nil {
+			return err
+		}
+		delay = min(delay*2, backoffMax)
+	}
+}
+
+// waitFor checks each probe in turn, backing off exponentially between
+// attempts, until all have passed or the overall deadline is reached.
+func (app App) waitFor(ctx context.Context, probes []Probe) error {
+	timeout := app.Config.Ready.Timeout
+	if timeout <= 0 {
+		timeout = defaultReadyTimeout
+	}
+	deadline := timeNow().Add(timeout)
+
+	for _, probe := range probes {
+		if err := app.waitForProbe(ctx, probe, deadline); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Wait blocks until the instance passes its readiness probes.
+func (app App) Wait(ctx context.Context) error {
+	probes, err := app.probes(ctx)
+	if err != nil {
+		return err
+	}
+	return app.waitFor(ctx, probes)
+}
@@ -0,0 +1,327 @@
+package omnienv
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+var unmarshalProbeTests = []struct {
+	summary string
+	data    string
+
+	probe  Probe
+	errMsg string
+}{{
+	summary: "agent",
+	data:    "agent",
+	probe:   Probe{Kind: "agent"},
+}, {
+	summary: "cloud-init",
+	data:    "cloud-init",
+	probe:   Probe{Kind: "cloud-init"},
+}, {
+	summary: "command",
+	data:    "command: test -e /run/ready",
+	probe:   Probe{Kind: "command", Command: "test -e /run/ready"},
+}, {
+	summary: "port",
+	data:    "port: 8080",
+	probe:   Probe{Kind: "port", Port: 8080},
+}, {
+	summary: "unknown",
+	data:    "sytemd",
+	errMsg:  `unknown probe "sytemd"`,
+}, {
+	summary: "both",
+	data:    "{command: true, port: 22}",
+	errMsg:  "both command and port",
+}, {
+	summary: "bad port",
+	data:    "port: 70000",
+	errMsg:  "invalid probe port 70000",
+}, {
+	summary: "empty",
+	data:    "{}",
+	errMsg:  "empty probe map",
+}}
+
+func TestUnmarshalProbe(t *testing.T) {
+	for _, test := range unmarshalProbeTests {
+		var probe Probe
+		err := yaml.Unmarshal([]byte(test.data), &probe)
+		if test.errMsg != "" {
+			assert.ErrorContains(t, err, test.errMsg, test.summary)
+		} else {
+			assert.Nil(t, err, test.summary)
+			assert.Equal(t, test.probe, probe, test.summary)
+		}
+	}
+}
+
+func TestUnmarshalReady(t *testing.T) {
+	data := []byte(`
+ready:
+  timeout: 90s
+  probes:
+  - systemd
+  - port: 22
+`)
+	var cfg Config
+	assert.Nil(t, yaml.Unmarshal(data, &cfg))
+	expected := Ready{
+		Timeout: 90 * time.Second,
+		Probes:  []Probe{{Kind: "systemd"}, {Kind: "port", Port: 22}},
+	}
+	assert.Equal(t, expected, cfg.Ready)
+}
+
+func TestPortScript(t *testing.T) {
+	assert.Contains(t, portScript(8080), "grep -qx 1F90")
+}
+
+var checkTests = []struct {
+	summary string
+	probe   Probe
+	cmd     *exec.Cmd
+
+	ready  bool
+	errMsg string
+}{{
+	summary: "agent ok",
+	probe:   Probe{Kind: "agent"},
+	cmd:     exec.Command("/bin/true"),
+	ready:   true,
+}, {
+	summary: "agent unreachable",
+	probe:   Probe{Kind: "agent"},
+	cmd:     exec.Command("/bin/sh", "-c", "exit 255"),
+	ready:   false,
+}, {
+	summary: "agent strange",
+	probe:   Probe{Kind: "agent"},
+	cmd:     exec.Command("/bin/false"),
+	errMsg:  "strange exit code 1",
+}, {
+	summary: "exec fails",
+	probe:   Probe{Kind: "agent"},
+	cmd:     exec.Command("/nonexistent-binary"),
+	errMsg:  "no such file",
+}, {
+	summary: "user missing",
+	probe:   Probe{Kind: "user"},
+	cmd:     exec.Command("/bin/false"),
+	ready:   false,
+}, {
+	summary: "systemd starting",
+	probe:   Probe{Kind: "systemd"},
+	cmd:     exec.Command("/bin/sh", "-c", "echo starting; exit 1"),
+	ready:   false,
+}, {
+	summary: "systemd degraded",
+	probe:   Probe{Kind: "systemd"},
+	cmd:     exec.Command("/bin/sh", "-c", "echo degraded; exit 1"),
+	ready:   true,
+}, {
+	summary: "systemd running",
+	probe:   Probe{Kind: "systemd"},
+	cmd:     exec.Command("/bin/echo", "running"),
+	ready:   true,
+}, {
+	summary: "cloud-init running",
+	probe:   Probe{Kind: "cloud-init"},
+	cmd:     exec.Command("/bin/echo", "status: running"),
+	ready:   false,
+}, {
+	summary: "cloud-init done",
+	probe:   Probe{Kind: "cloud-init"},
+	cmd:     exec.Command("/bin/echo", "status: done"),
+	ready:   true,
+}, {
+	summary: "cloud-init error",
+	probe:   Probe{Kind: "cloud-init"},
+	cmd:     exec.Command("/bin/sh", "-c", "echo 'status: error'; exit 1"),
+	errMsg:  "cloud-init reported an error",
+}, {
+	summary: "command fails",
+	probe:   Probe{Kind: "command", Command: "false"},
+	cmd:     exec.Command("/bin/false"),
+	ready:   false,
+}, {
+	summary: "port listening",
+	probe:   Probe{Kind: "port", Port: 22},
+	cmd:     exec.Command("/bin/true"),
+	ready:   true,
+}, {
+	summary: "unknown",
+	probe:   Probe{Kind: "bogus"},
+	errMsg:  `unknown probe "bogus"`,
+}}
+
+func TestCheck(t *testing.T) {
+	for _, test := range checkTests {
+		restoreCmdCtx := Patch(&commandContext, func(_ context.Context, _ string, _ ...string) *exec.Cmd {
+			return test.cmd
+		})
+		app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+		ready, err := app.check(context.Background(), test.probe)
+		restoreCmdCtx()
+		if test.errMsg != "" {
+			assert.ErrorContains(t, err, test.errMsg, test.summary)
+		} else {
+			assert.Nil(t, err, test.summary)
+			assert.Equal(t, test.ready, ready, test.summary)
+		}
+	}
+}
+
+func patchClock() func() {
+	now := time.Unix(0, 0)
+	restoreNow := Patch(&timeNow, func() time.Time { return now })
+	restoreAfter := Patch(&timeAfter, func(d time.Duration) <-chan time.Time {
+		now = now.Add(d)
+		ch := make(chan time.Time, 1)
+		ch <- now
+		return ch
+	})
+	return func() {
+		restoreAfter()
+		restoreNow()
+	}
+}
+
+func patchProgress() (func(), *bytes.Buffer) {
+	buf := &bytes.Buffer{}
+	return Patch[io.Writer](&progress, buf), buf
+}
+
+func TestWaitNotVM(t *testing.T) {
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/echo", "Type: container"),
+		exec.Command("/bin/true"),
+	)
+	defer restoreCmd()
+	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+	assert.Nil(t, app.Wait(context.Background()))
+	assert.Equal(t, [][]string{
+		{"lxc", "info", "l-s"},
+		{"lxc", "exec", "l-s", "--", "id", "-u", "user"},
+	}, *calls)
+}
+
+func TestWaitVMExecOk(t *testing.T) {
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/echo", "Type: virtual-machine"),
+		exec.Command("/bin/true"),
+		exec.Command("/bin/true"),
+	)
+	defer restoreCmd()
+	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+	assert.Nil(t, app.Wait(context.Background()))
+	assert.Equal(t, [][]string{
+		{"lxc", "info", "l-s"},
+		{"lxc", "exec", "l-s", "--", "/bin/true"},
+		{"lxc", "exec", "l-s", "--", "id", "-u", "user"},
+	}, *calls)
+}
+
+func TestWaitIsVMFails(t *testing.T) {
+	restoreCmd, _ := patchCommands(exec.Command("/bin/false"))
+	defer restoreCmd()
+	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+	assert.ErrorContains(t, app.Wait(context.Background()), "failed to get instance info")
+}
+
+func TestWaitConfiguredProbes(t *testing.T) {
+	var probed [][]string
+	restoreCmdCtx := Patch(&commandContext, func(_ context.Context, _ string, argv ...string) *exec.Cmd {
+		probed = append(probed, argv[3:])
+		return exec.Command("/bin/echo", "running")
+	})
+	defer restoreCmdCtx()
+	app := App{Config: Config{
+		Label:  "l",
+		System: NewSystem("s"),
+		Ready: Ready{Probes: []Probe{
+			{Kind: "systemd"}, {Kind: "command", Command: "make check"},
+		}},
+	}}
+	assert.Nil(t, app.Wait(context.Background()))
+	assert.Equal(t, [][]string{
+		{"systemctl", "is-system-running"},
+		{"sh", "-c", "make check"},
+	}, probed)
+}
+
+func TestWaitVMStrangeExitCode(t *testing.T) {
+	restoreCmdCtx := Patch(&commandContext, func(_ context.Context, _ string, _ ...string) *exec.Cmd {
+		return exec.Command("/bin/false")
+	})
+	defer restoreCmdCtx()
+	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+	err := app.waitFor(context.Background(), []Probe{{Kind: "agent"}})
+	assert.ErrorContains(t, err, "agent probe: strange exit code 1")
+}
+
+func TestWaitVMTimeout(t *testing.T) {
+	restoreCmdCtx := Patch(&commandContext, func(_ context.Context, _ string, _ ...string) *exec.Cmd {
+		return exec.Command("/bin/sh", "-c", "exit 255")
+	})
+	defer restoreCmdCtx()
+	restoreClock := patchClock()
+	defer restoreClock()
+	restoreProgress, buf := patchProgress()
+	defer restoreProgress()
+
+	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+	err := app.waitFor(context.Background(), []Probe{{Kind: "agent"}})
+	assert.ErrorContains(t, err, "timed out waiting for agent on l-s")
+	assert.Contains(t, buf.String(), "Waiting for agent.")
+}
+
+func TestWaitConfiguredTimeout(t *testing.T) {
+	attempts := 0
+	restoreCmdCtx := Patch(&commandContext, func(_ context.Context, _ string, _ ...string) *exec.Cmd {
+		attempts++
+		return exec.Command("/bin/false")
+	})
+	defer restoreCmdCtx()
+	restoreClock := patchClock()
+	defer restoreClock()
+	restoreProgress, _ := patchProgress()
+	defer restoreProgress()
+
+	// 250ms + 500ms + 1s + 2s + 250ms remaining
+	app := App{Config: Config{
+		Label: "l", System: NewSystem("s"), Ready: Ready{Timeout: 4 * time.Second},
+	}}
+	err := app.waitFor(context.Background(), []Probe{{Kind: "user"}})
+	assert.ErrorContains(t, err, "timed out waiting for user")
+	assert.Equal(t, 6, attempts)
+}
+
+func TestWaitVMEventualSuccess(t *testing.T) {
+	callCount := 0
+	restoreCmdCtx := Patch(&commandContext, func(_ context.Context, _ string, _ ...string) *exec.Cmd {
+		callCount++
+		if callCount < 5 {
+			return exec.Command("/bin/sh", "-c", "exit 255")
+		}
+		return exec.Command("/bin/true")
+	})
+	defer restoreCmdCtx()
+	restoreClock := patchClock()
+	defer restoreClock()
+	restoreProgress, buf := patchProgress()
+	defer restoreProgress()
+
+	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+	assert.Nil(t, app.waitFor(context.Background(), []Probe{{Kind: "agent"}, {Kind: "user"}}))
+	assert.Equal(t, "Waiting for agent...\n", buf.String())
+}
@@ -0,0 +1,165 @@
+package omnienv
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// schema is a JSON Schema, or part of one.
+type schema = map[string]any
+
+// durationPattern matches what time.ParseDuration accepts.
+const durationPattern = `^(0|([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+)$`
+
+// portSchema is a TCP or UDP port number.
+var portSchema = schema{"type": "integer", "minimum": 1, "maximum": 65535}
+
+// customSchemas describe the types with their own UnmarshalYAML, which
+// accept forms the fields of the type do not tell.
+var customSchemas = map[reflect.Type]schema{
+	reflect.TypeFor[System](): {"oneOf": []schema{{
+		"type":        "string",
+		"description": "the Ubuntu series, such as noble",
+	}, {
+		"type":          "object",
+		"description":   "the series, mapped to the image to launch it from",
+		"minProperties": 1,
+		"maxProperties": 1,
+		"additionalProperties": schema{
+			"type":                 "object",
+			"properties":           schema{"image": schema{"type": "string"}},
+			"additionalProperties": false,
+		},
+	}}},
+	reflect.TypeFor[Port](): {"oneOf": []schema{portSchema, {
+		"type": "object",
+		"properties": schema{
+			"host":  portSchema,
+			"guest": portSchema,
+			"proto": schema{"enum": []string{"tcp", "udp"}},
+		},
+		"required":             []string{"host"},
+		"additionalProperties": false,
+	}}},
+	reflect.TypeFor[Probe](): {"oneOf": []schema{{"enum": probeKinds}, {
+		"type": "object",
+		"properties": schema{
+			"command": schema{"type": "string", "minLength": 1},
+			"port":    portSchema,
+		},
+		"minProperties":        1,
+		"maxProperties":        1,
+		"additionalProperties": false,
+	}}},
+	reflect.TypeFor[time.Duration](): {"type": "string", "pattern": durationPattern},
+}
+
+// unmarshalerTypes are the interfaces of the UnmarshalYAML methods yaml.v3
+// calls.
+var unmarshalerTypes = []reflect.Type{
+	reflect.TypeFor[yaml.Unmarshaler](),
+	reflect.TypeFor[interface {
+		UnmarshalYAML(func(any) error) error
+	}](),
+}
+
+// typeSchema describes how typ is written in YAML.  Types with their own
+// UnmarshalYAML must be in customSchemas, so that the schema cannot
+// silently fall out of step with them.
+func typeSchema(typ reflect.Type) (schema, error) {
+	if custom, ok := customSchemas[typ]; ok {
+		return custom, nil
+	}
+	for _, unmarshaler := range unmarshalerTypes {
+		if reflect.PointerTo(typ).Implements(unmarshaler) {
+			return nil, fmt.Errorf("no schema for %s, which has its own UnmarshalYAML", typ)
+		}
+	}
+
+	switch typ.Kind() {
+	case reflect.String:
+		// YAML reads unquoted values such as true and 4 as booleans and
+		// numbers, which are decoded into strings as written
+		return schema{"type": []string{"string", "boolean", "number"}}, nil
+	case reflect.Bool:
+		return schema{"type": "boolean"}, nil
+	case reflect.Int, reflect.Int64:
+		return schema{"type": "integer"}, nil
+	case reflect.Slice:
+		items, err := typeSchema(typ.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return schema{"type": "array", "items": items}, nil
+	case reflect.Map:
+		if typ.Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("no schema for %s, keys must be strings", typ)
+		}
+		values, err := typeSchema(typ.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return schema{"type": "object", "additionalProperties": values}, nil
+	case reflect.Struct:
+		return structSchema(typ)
+	default:
+		return nil, fmt.Errorf("no schema for %s", typ)
+	}
+}
+
+func structSchema(typ reflect.Type) (schema, error) {
+	properties := schema{}
+	for i := range typ.NumField() {
+		field := typ.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		prop, err := typeSchema(field.Type)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", typ.Name(), field.Name, err)
+		}
+		properties[fieldKey(field)] = prop
+	}
+	return schema{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}, nil
+}
+
+// ConfigSchema returns a JSON Schema of the config file, generated from
+// Config, for editors to complete and check it with.
+func ConfigSchema() ([]byte, error) {
+	root, err := structSchema(reflect.TypeFor[Config]())
+	if err != nil {
+		return nil, err
+	}
+	properties := root["properties"].(schema)
+	for key, allowed := range configEnums {
+		var values []any
+		for _, value := range allowed {
+			values = append(values, value)
+			// YAML reads these as booleans, which work as their strings
+			if value == "true" || value == "false" {
+				values = append(values, value == "true")
+			}
+		}
+		properties[key] = schema{"enum": values}
+	}
+	for _, key := range []string{"project", "series"} {
+		properties[key].(schema)["deprecationMessage"] = key + " is not supported and is ignored"
+	}
+	root["$schema"] = "http://json-schema.org/draft-07/schema#"
+	root["title"] = "omnienv config"
+	root["description"] = "The " + cfgName + " file of an omnienv project."
+
+	data, err := json.MarshalIndent(root, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
@@ -0,0 +1,123 @@
+package omnienv
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+// schemaPath is where the schema is published, for editors to fetch.
+const schemaPath = "../../omnienv.schema.json"
+
+func TestConfigSchemaPublished(t *testing.T) {
+	expected, err := ConfigSchema()
+	assert.Nil(t, err)
+	published, err := os.ReadFile(schemaPath)
+	assert.Nil(t, err)
+	assert.Equal(t, string(expected), string(published),
+		"the config changed, update the schema with: make schema")
+}
+
+func TestConfigSchemaKeys(t *testing.T) {
+	data, err := ConfigSchema()
+	assert.Nil(t, err)
+	var root struct {
+		Properties map[string]json.RawMessage
+	}
+	assert.Nil(t, json.Unmarshal(data, &root))
+
+	var keys []string
+	for key := range root.Properties {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	expected := configKeys()
+	slices.Sort(expected)
+	assert.Equal(t, expected, keys)
+	for key := range configEnums {
+		assert.Contains(t, string(root.Properties[key]), `"enum"`, key)
+	}
+}
+
+type customYAML struct{}
+
+func (*customYAML) UnmarshalYAML(*yaml.Node) error {
+	return nil
+}
+
+var typeSchemaTests = []struct {
+	summary string
+	value   any
+
+	schema schema
+	errMsg string
+}{{
+	summary: "string list",
+	value:   []string{},
+	schema: schema{"type": "array", "items": schema{
+		"type": []string{"string", "boolean", "number"},
+	}},
+}, {
+	summary: "string map",
+	value:   map[string]bool{},
+	schema:  schema{"type": "object", "additionalProperties": schema{"type": "boolean"}},
+}, {
+	summary: "custom",
+	value:   Port{},
+	schema:  customSchemas[reflect.TypeFor[Port]()],
+}, {
+	summary: "unmarshaler without schema",
+	value:   customYAML{},
+	errMsg:  "no schema for omnienv.customYAML, which has its own UnmarshalYAML",
+}, {
+	summary: "unmarshaler in a struct",
+	value:   struct{ Field []customYAML }{},
+	errMsg:  ".Field: no schema for omnienv.customYAML",
+}, {
+	summary: "int keys",
+	value:   map[int]string{},
+	errMsg:  "keys must be strings",
+}, {
+	summary: "float",
+	value:   1.5,
+	errMsg:  "no schema for float64",
+}}
+
+func TestConfigSchemaScalarStrings(t *testing.T) {
+	// YAML reads these values as numbers and booleans, which the loader
+	// takes as strings, so the schema must allow them too
+	_, err := parseConfig("CFG", []byte("label: 2024\nenv: {CI: true, JOBS: 4, RATIO: 0.5}\n"))
+	assert.Nil(t, err)
+
+	data, err := ConfigSchema()
+	assert.Nil(t, err)
+	var root struct {
+		Properties struct {
+			Env struct {
+				AdditionalProperties struct {
+					Type []string
+				}
+			}
+		}
+	}
+	assert.Nil(t, json.Unmarshal(data, &root))
+	assert.Equal(t, []string{"string", "boolean", "number"},
+		root.Properties.Env.AdditionalProperties.Type)
+}
+
+func TestTypeSchema(t *testing.T) {
+	for _, test := range typeSchemaTests {
+		result, err := typeSchema(reflect.TypeOf(test.value))
+		if test.errMsg != "" {
+			assert.ErrorContains(t, err, test.errMsg, test.summary)
+		} else {
+			assert.Nil(t, err, test.summary)
+			assert.Equal(t, test.schema, result, test.summary)
+		}
+	}
+}
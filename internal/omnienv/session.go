@@ -0,0 +1,200 @@
+package omnienv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"al.essio.dev/pkg/shellescape"
+)
+
+// DefaultSession is the name of the session when none is given.
+const DefaultSession = "main"
+
+// Sessions are tmux sessions in the instance, so that they survive the
+// host side going away.  The command and host directory of a session are
+// kept in tmux user options.
+const (
+	requireTmux = `command -v tmux >/dev/null || ` +
+		`{ echo "tmux is not installed in the environment" >&2; exit 127; }`
+	sessionFormat = "#{session_name}\t#{session_created}\t#{session_attached}" +
+		"\t#{@oe_dir}\t#{@oe_command}"
+)
+
+var sessionNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// Session is a shell or command running in the instance under tmux.
+type Session struct {
+	Name     string
+	Command  string
+	Dir      string
+	Started  time.Time
+	Attached bool
+}
+
+func checkSessionName(name string) error {
+	if !sessionNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid session name %q", name)
+	}
+	return nil
+}
+
+// sessionTarget names the session exactly, as tmux otherwise also accepts
+// a prefix of the name.
+func sessionTarget(name string) string {
+	return shellescape.Quote("=" + name)
+}
+
+// sessionScript creates the session, detached, running the script.
+func sessionScript(name, dest, script, command, dir string) string {
+	target := sessionTarget(name)
+	return strings.Join([]string{
+		requireTmux,
+		"tmux new-session -d -s " + shellescape.Quote(name) + " -c " +
+			shellescape.Quote(dest) + " sh -c " + shellescape.Quote(script),
+		"tmux set-option -t " + target + " @oe_command " + shellescape.Quote(command),
+		"tmux set-option -t " + target + " @oe_dir " + shellescape.Quote(dir),
+	}, " && ")
+}
+
+// NewSession starts a session running Params, or a shell, in the directory
+// matching the current one, and attaches to it unless detach is set or
+// there is no terminal to attach.
+func (app App) NewSession(ctx context.Context, name string, detach bool) error {
+	if err := checkSessionName(name); err != nil {
+		return err
+	}
+	release, err := app.markActive(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := app.enter(ctx); err != nil {
+		return err
+	}
+	script, err := app.script()
+	if err != nil {
+		return err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("getting working directory: %w", err)
+	}
+	command := "shell"
+	if len(app.Opts.Params) > 0 {
+		command = shellescape.QuoteCommand(app.Opts.Params)
+	}
+
+	script = sessionScript(name, app.guestDir(wd), script, command, wd)
+	args := append(
+		[]string{"lxc", "exec", app.Name(), "--mode", "non-interactive", "--"},
+		app.sudoLogin(script)...,
+	)
+	if err := run(ctx, args...); err != nil {
+		return fmt.Errorf("failed to start session: %w", err)
+	}
+	if detach || !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+		fmt.Fprintf(progress, "Started session %s, attach with oe session attach %s\n", name, name)
+		return nil
+	}
+	return app.attach(ctx, name)
+}
+
+// AttachSession reconnects the terminal to a running session.
+func (app App) AttachSession(ctx context.Context, name string) error {
+	if err := checkSessionName(name); err != nil {
+		return err
+	}
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+		return errors.New("attaching to a session requires a terminal")
+	}
+	release, err := app.markActive(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := app.enter(ctx); err != nil {
+		return err
+	}
+	return app.attach(ctx, name)
+}
+
+func (app App) attach(ctx context.Context, name string) error {
+	script := requireTmux + " && exec tmux attach-session -t " + sessionTarget(name)
+	ctx, stop := userContext(ctx)
+	defer stop()
+	if err := app.lxcExec(ctx, app.sudoLogin(script)...); err != nil {
+		return fmt.Errorf("failed to attach session: %w", exitCode(err))
+	}
+	return nil
+}
+
+func parseSessions(out string) ([]Session, error) {
+	var sessions []Session
+	for _, line := range strings.Split(out, "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, "\t", 5)
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("unexpected tmux output %q", line)
+		}
+		created, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected tmux output %q", line)
+		}
+		session := Session{
+			Name:     fields[0],
+			Started:  time.Unix(created, 0),
+			Attached: fields[2] != "0",
+			Dir:      fields[3],
+		}
+		if len(fields) == 5 {
+			session.Command = fields[4]
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// Sessions lists the sessions in the instance.  A stopped instance has
+// none, and is left stopped.
+func (app App) Sessions(ctx context.Context) ([]Session, error) {
+	fields, err := app.info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if fields["Status"] != "RUNNING" {
+		return nil, nil
+	}
+
+	// without tmux, or without a tmux server, there are no sessions
+	script := "command -v tmux >/dev/null || exit 0; " +
+		"tmux list-sessions -F " + shellescape.Quote(sessionFormat) + " 2>/dev/null || true"
+	out, err := app.lxcOutput(ctx, app.sudoLogin(script)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+	return parseSessions(out)
+}
+
+// KillSession ends the session and what runs in it.
+func (app App) KillSession(ctx context.Context, name string) error {
+	if err := checkSessionName(name); err != nil {
+		return err
+	}
+	if err := app.checkOwner(ctx); err != nil {
+		return err
+	}
+	script := requireTmux + " && tmux kill-session -t " + sessionTarget(name)
+	args := append([]string{"lxc", "exec", app.Name(), "--"}, app.sudoLogin(script)...)
+	if err := runQuiet(ctx, args...); err != nil {
+		return fmt.Errorf("failed to kill session %s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package omnienv
+
+import (
+	"context"
+	"encoding/base64"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckSessionName(t *testing.T) {
+	for _, name := range []string{"main", "build-2", "long_run"} {
+		assert.Nil(t, checkSessionName(name), name)
+	}
+	for _, name := range []string{"", "a.b", "a:b", "a b", "=main", "$(x)"} {
+		assert.ErrorContains(t, checkSessionName(name), "invalid session name", name)
+	}
+}
+
+func TestSessionScript(t *testing.T) {
+	script := sessionScript("build", "/project/a b", "cd x && exec make", "make 'a b'", "/src/a b")
+	assert.Equal(t, requireTmux+
+		` && tmux new-session -d -s build -c '/project/a b' sh -c 'cd x && exec make'`+
+		` && tmux set-option -t =build @oe_command 'make '"'"'a b'"'"''`+
+		` && tmux set-option -t =build @oe_dir '/src/a b'`,
+		script,
+	)
+}
+
+var parseSessionsTests = []struct {
+	summary string
+	out     string
+
+	sessions []Session
+	errMsg   string
+}{{
+	summary: "none",
+	out:     "",
+}, {
+	summary: "sessions",
+	out:     "main\t1735787045\t1\t/src/proj\tshell\nbuild\t1735787046\t0\t/src/proj/sub\tmake -j8",
+	sessions: []Session{{
+		Name: "main", Command: "shell", Dir: "/src/proj",
+		Started: time.Unix(1735787045, 0), Attached: true,
+	}, {
+		Name: "build", Command: "make -j8", Dir: "/src/proj/sub",
+		Started: time.Unix(1735787046, 0),
+	}},
+}, {
+	summary:  "not started by oe",
+	out:      "other\t1735787045\t0\t",
+	sessions: []Session{{Name: "other", Started: time.Unix(1735787045, 0)}},
+}, {
+	summary: "garbage",
+	out:     "no server running",
+	errMsg:  "unexpected tmux output",
+}}
+
+func TestParseSessions(t *testing.T) {
+	for _, test := range parseSessionsTests {
+		sessions, err := parseSessions(test.out)
+		if test.errMsg != "" {
+			assert.ErrorContains(t, err, test.errMsg, test.summary)
+		} else {
+			assert.Nil(t, err, test.summary)
+			assert.Equal(t, test.sessions, sessions, test.summary)
+		}
+	}
+}
+
+func TestSessionsStopped(t *testing.T) {
+	restoreCmd, calls := patchCommands(exec.Command("/bin/echo", "Status: STOPPED"))
+	defer restoreCmd()
+	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+	sessions, err := app.Sessions(context.Background())
+	assert.Nil(t, err)
+	assert.Empty(t, sessions)
+	assert.Len(t, *calls, 1)
+}
+
+func TestSessionsRunning(t *testing.T) {
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/echo", "Status: RUNNING"),
+		exec.Command("/bin/printf", "main\t1735787045\t0\t/src/proj\tshell\n"),
+	)
+	defer restoreCmd()
+	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+	sessions, err := app.Sessions(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []Session{{
+		Name: "main", Command: "shell", Dir: "/src/proj", Started: time.Unix(1735787045, 0),
+	}}, sessions)
+
+	require.Len(t, *calls, 2)
+	call := (*calls)[1]
+	assert.Equal(t, []string{"lxc", "exec", "l-s", "--"}, call[:4])
+	encoded := strings.TrimSuffix(strings.TrimPrefix(call[len(call)-1], "eval \"`echo "), " | base64 -d`\"")
+	script, err := base64.StdEncoding.DecodeString(encoded)
+	assert.Nil(t, err)
+	assert.Contains(t, string(script), "tmux list-sessions -F")
+}
+
+func TestKillSession(t *testing.T) {
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/true"), // checkOwner
+		exec.Command("sh", "-c", "echo can\\'t find session: =x >&2; exit 1"),
+	)
+	defer restoreCmd()
+	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+	ctx := context.Background()
+	assert.ErrorContains(t, app.KillSession(ctx, "a.b"), "invalid session name")
+	assert.Empty(t, *calls)
+	assert.ErrorContains(t, app.KillSession(ctx, "x"), "failed to kill session x: exit status 1: can't find session")
+}
+
+func TestAttachSessionNoTerminal(t *testing.T) {
+	defer patchTerminal(false)()
+	restoreCmd, calls := patchCommands()
+	defer restoreCmd()
+	err := App{}.AttachSession(context.Background(), "main")
+	assert.ErrorContains(t, err, "requires a terminal")
+	assert.Empty(t, *calls)
+}
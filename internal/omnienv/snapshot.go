@@ -0,0 +1,141 @@
+package omnienv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+var ErrSnapshotExists = errors.New("snapshot already exists")
+
+// Snapshots taken by omnienv are namespaced with this prefix, so that
+// they can be told apart from any taken by other tools.
+const snapshotPrefix = "omnienv-"
+
+// preProvisionSnapshot is taken by Launch when
+// Config.SnapshotBeforeProvision is set.
+const preProvisionSnapshot = "pre-provision"
+
+var snapshotNameRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+func snapshotName(name string) (string, error) {
+	name = strings.TrimPrefix(name, snapshotPrefix)
+	if !snapshotNameRE.MatchString(name) {
+		return "", fmt.Errorf("invalid snapshot name %q", name)
+	}
+	return snapshotPrefix + name, nil
+}
+
+// Snapshots lists the snapshots of the instance taken by omnienv, with the
+// namespace prefix removed.
+func (app App) Snapshots(ctx context.Context) ([]Snapshot, error) {
+	all, err := app.backend().ListSnapshots(ctx, app.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+
+	var snapshots []Snapshot
+	for _, snapshot := range all {
+		if name, found := strings.CutPrefix(snapshot.Name, snapshotPrefix); found {
+			snapshot.Name = name
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	return snapshots, nil
+}
+
+func (app App) hasSnapshot(ctx context.Context, name string) (bool, error) {
+	snapshots, err := app.Snapshots(ctx)
+	if err != nil {
+		return false, err
+	}
+	return slices.ContainsFunc(snapshots, func(snapshot Snapshot) bool {
+		return snapshotPrefix+snapshot.Name == name
+	}), nil
+}
+
+// Snapshot takes a snapshot of the instance.
+func (app App) Snapshot(ctx context.Context, name string) error {
+	if _, err := snapshotName(name); err != nil {
+		return err
+	}
+	if err := app.checkOwner(ctx); err != nil {
+		return err
+	}
+	return app.snapshot(ctx, name)
+}
+
+func (app App) snapshot(ctx context.Context, name string) error {
+	full, err := snapshotName(name)
+	if err != nil {
+		return err
+	}
+
+	exists, err := app.hasSnapshot(ctx, full)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("%w: %s", ErrSnapshotExists, name)
+	}
+
+	if err := app.backend().CreateSnapshot(ctx, app.Name(), full); err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	return nil
+}
+
+// existingSnapshot resolves name to the full snapshot name, if it exists.
+func (app App) existingSnapshot(ctx context.Context, name string) (string, error) {
+	full, err := snapshotName(name)
+	if err != nil {
+		return "", err
+	}
+
+	exists, err := app.hasSnapshot(ctx, full)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", fmt.Errorf("%w: %s", ErrSnapshotNotFound, name)
+	}
+	return full, nil
+}
+
+// Restore returns the instance to the state of the snapshot.
+func (app App) Restore(ctx context.Context, name string) error {
+	if err := app.checkOwner(ctx); err != nil {
+		return err
+	}
+	unlock, err := app.lock(ctx, "restore")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	full, err := app.existingSnapshot(ctx, name)
+	if err != nil {
+		return err
+	}
+	if err := app.backend().RestoreSnapshot(ctx, app.Name(), full); err != nil {
+		return fmt.Errorf("failed to restore snapshot: %w", err)
+	}
+	return nil
+}
+
+func (app App) DeleteSnapshot(ctx context.Context, name string) error {
+	if err := app.checkOwner(ctx); err != nil {
+		return err
+	}
+	full, err := app.existingSnapshot(ctx, name)
+	if err != nil {
+		return err
+	}
+	if err := app.backend().DeleteSnapshot(ctx, app.Name(), full); err != nil {
+		return fmt.Errorf("failed to delete snapshot: %w", err)
+	}
+	return nil
+}
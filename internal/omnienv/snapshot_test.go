@@ -0,0 +1,308 @@
+package omnienv
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBackend keeps snapshots in memory, recording each call made.
+type fakeBackend struct {
+	snapshots []Snapshot
+	err       error
+	calls     []string
+	// imported is the content of the backup given to ImportInstance
+	imported  string
+	images    []Image
+	instances []Instance
+	// remote maps images to their fingerprint on the remote, with a
+	// suffix of " --vm" for VM images
+	remote map[string]string
+	// devices are the proxy devices of the instance
+	devices map[string]Port
+}
+
+func (fake *fakeBackend) CreateSnapshot(_ context.Context, instance, snapshot string) error {
+	fake.calls = append(fake.calls, "create "+instance+"/"+snapshot)
+	if fake.err != nil {
+		return fake.err
+	}
+	fake.snapshots = append(fake.snapshots, Snapshot{Name: snapshot})
+	return nil
+}
+
+func (fake *fakeBackend) ListSnapshots(_ context.Context, instance string) ([]Snapshot, error) {
+	fake.calls = append(fake.calls, "list "+instance)
+	return fake.snapshots, nil
+}
+
+func (fake *fakeBackend) RestoreSnapshot(_ context.Context, instance, snapshot string) error {
+	fake.calls = append(fake.calls, "restore "+instance+"/"+snapshot)
+	return fake.err
+}
+
+func (fake *fakeBackend) DeleteSnapshot(_ context.Context, instance, snapshot string) error {
+	fake.calls = append(fake.calls, "delete "+instance+"/"+snapshot)
+	return fake.err
+}
+
+func (fake *fakeBackend) ExportInstance(_ context.Context, instance, path string) error {
+	fake.calls = append(fake.calls, "export "+instance)
+	if fake.err != nil {
+		return fake.err
+	}
+	return os.WriteFile(path, []byte("backup of "+instance), 0600)
+}
+
+func (fake *fakeBackend) ImportInstance(_ context.Context, path, instance string) error {
+	fake.calls = append(fake.calls, "import "+instance)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	fake.imported = string(data)
+	return fake.err
+}
+
+func (fake *fakeBackend) PublishImage(_ context.Context, instance, alias string, properties map[string]string) error {
+	fake.calls = append(fake.calls, "publish "+instance+" as "+alias)
+	if fake.err != nil {
+		return fake.err
+	}
+	fake.images = append(fake.images, Image{
+		Aliases: []string{alias}, Properties: properties,
+	})
+	return nil
+}
+
+func (fake *fakeBackend) ListImages(context.Context) ([]Image, error) {
+	fake.calls = append(fake.calls, "images")
+	return fake.images, fake.err
+}
+
+func (fake *fakeBackend) GetImage(_ context.Context, fingerprint string) (Image, error) {
+	fake.calls = append(fake.calls, "image "+fingerprint)
+	for _, image := range fake.images {
+		if image.Fingerprint == fingerprint {
+			return image, nil
+		}
+	}
+	return Image{}, errors.New("not found")
+}
+
+func (fake *fakeBackend) PullImage(_ context.Context, image string, vm bool) error {
+	call := "pull " + image
+	if vm {
+		call += " --vm"
+	}
+	fake.calls = append(fake.calls, call)
+	return fake.err
+}
+
+func (fake *fakeBackend) RemoteFingerprint(_ context.Context, image string, vm bool) (string, error) {
+	if vm {
+		image += " --vm"
+	}
+	fake.calls = append(fake.calls, "remote "+image)
+	return fake.remote[image], fake.err
+}
+
+func (fake *fakeBackend) ListInstances(context.Context) ([]Instance, error) {
+	fake.calls = append(fake.calls, "instances")
+	return fake.instances, fake.err
+}
+
+func (fake *fakeBackend) ProxyDevices(_ context.Context, instance string) (map[string]Port, error) {
+	fake.calls = append(fake.calls, "devices "+instance)
+	devices := map[string]Port{}
+	maps.Copy(devices, fake.devices)
+	return devices, fake.err
+}
+
+func (fake *fakeBackend) AddProxyDevice(_ context.Context, instance, device string, port Port) error {
+	fake.calls = append(fake.calls, "add "+instance+" "+device)
+	if fake.err != nil {
+		return fake.err
+	}
+	if fake.devices == nil {
+		fake.devices = map[string]Port{}
+	}
+	fake.devices[device] = port
+	return nil
+}
+
+func (fake *fakeBackend) RemoveDevice(_ context.Context, instance, device string) error {
+	fake.calls = append(fake.calls, "remove "+instance+" "+device)
+	delete(fake.devices, device)
+	return fake.err
+}
+
+// testApp is project l on system s, so the instance l-s, as the tests of
+// instance operations use it.
+func testApp(backend Backend) App {
+	return App{
+		Config: Config{
+			Label: "l", System: NewSystem("s"), RootDir: "/src/l",
+			Virtualization: "container",
+		},
+		Backend: backend,
+	}
+}
+
+var snapshotNameTests = []struct {
+	summary string
+	name    string
+
+	full   string
+	errMsg string
+}{{
+	summary: "plain",
+	name:    "before-upgrade",
+	full:    "omnienv-before-upgrade",
+}, {
+	summary: "already prefixed",
+	name:    "omnienv-x",
+	full:    "omnienv-x",
+}, {
+	summary: "slash",
+	name:    "a/b",
+	errMsg:  `invalid snapshot name "a/b"`,
+}, {
+	summary: "empty",
+	name:    "",
+	errMsg:  `invalid snapshot name ""`,
+}}
+
+func TestSnapshotName(t *testing.T) {
+	for _, test := range snapshotNameTests {
+		full, err := snapshotName(test.name)
+		if test.errMsg != "" {
+			assert.ErrorContains(t, err, test.errMsg, test.summary)
+		} else {
+			assert.Nil(t, err, test.summary)
+			assert.Equal(t, test.full, full, test.summary)
+		}
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	created := time.Unix(1700000000, 0)
+	fake := &fakeBackend{snapshots: []Snapshot{
+		{Name: "snap0"},
+		{Name: "omnienv-a", Created: created},
+	}}
+	snapshots, err := testApp(fake).Snapshots(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []Snapshot{{Name: "a", Created: created}}, snapshots)
+}
+
+func TestSnapshot(t *testing.T) {
+	restoreCmd, _ := patchCommands() // no owner recorded
+	defer restoreCmd()
+	fake := &fakeBackend{}
+	assert.Nil(t, testApp(fake).Snapshot(context.Background(), "a"))
+	assert.Equal(t, []string{"list l-s", "create l-s/omnienv-a"}, fake.calls)
+}
+
+func TestSnapshotExists(t *testing.T) {
+	restoreCmd, _ := patchCommands() // no owner recorded
+	defer restoreCmd()
+	fake := &fakeBackend{snapshots: []Snapshot{{Name: "omnienv-a"}}}
+	err := testApp(fake).Snapshot(context.Background(), "a")
+	assert.ErrorIs(t, err, ErrSnapshotExists)
+	assert.Equal(t, []string{"list l-s"}, fake.calls)
+}
+
+func TestSnapshotFails(t *testing.T) {
+	restoreCmd, _ := patchCommands() // no owner recorded
+	defer restoreCmd()
+	fake := &fakeBackend{err: errors.New("boom")}
+	err := testApp(fake).Snapshot(context.Background(), "a")
+	assert.ErrorContains(t, err, "failed to create snapshot: boom")
+}
+
+func TestSnapshotInvalid(t *testing.T) {
+	fake := &fakeBackend{}
+	err := testApp(fake).Snapshot(context.Background(), "../a")
+	assert.ErrorContains(t, err, "invalid snapshot name")
+	assert.Empty(t, fake.calls)
+}
+
+func TestSnapshotOtherProject(t *testing.T) {
+	restoreCmd, _ := patchCommands(exec.Command("/bin/echo", "/src/other/l"))
+	defer restoreCmd()
+	fake := &fakeBackend{}
+	err := testApp(fake).Snapshot(context.Background(), "a")
+	assert.ErrorIs(t, err, ErrNameCollision)
+	assert.Empty(t, fake.calls)
+}
+
+func TestRestore(t *testing.T) {
+	restoreCmd, _ := patchCommands() // no owner recorded
+	defer restoreCmd()
+	fake := &fakeBackend{snapshots: []Snapshot{{Name: "omnienv-a"}}}
+	assert.Nil(t, testApp(fake).Restore(context.Background(), "a"))
+	assert.Equal(t, []string{"list l-s", "restore l-s/omnienv-a"}, fake.calls)
+}
+
+func TestRestoreWaitsForLock(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	restoreProgress, _ := patchProgress()
+	defer restoreProgress()
+	restoreCmd, _ := patchCommands() // no owner recorded
+	defer restoreCmd()
+	fake := &fakeBackend{snapshots: []Snapshot{{Name: "omnienv-a"}}}
+	app := testApp(fake)
+	unlock, err := app.lock(context.Background(), "start")
+	require.Nil(t, err)
+	defer unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = app.Restore(ctx, "a")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, fake.calls)
+}
+
+func TestRestoreNotFound(t *testing.T) {
+	restoreCmd, _ := patchCommands() // no owner recorded
+	defer restoreCmd()
+	// snapshots not taken by omnienv are out of bounds
+	fake := &fakeBackend{snapshots: []Snapshot{{Name: "a"}}}
+	err := testApp(fake).Restore(context.Background(), "a")
+	assert.ErrorIs(t, err, ErrSnapshotNotFound)
+	assert.Equal(t, []string{"list l-s"}, fake.calls)
+}
+
+func TestRestoreFails(t *testing.T) {
+	restoreCmd, _ := patchCommands() // no owner recorded
+	defer restoreCmd()
+	fake := &fakeBackend{
+		snapshots: []Snapshot{{Name: "omnienv-a"}},
+		err:       errors.New("boom"),
+	}
+	err := testApp(fake).Restore(context.Background(), "a")
+	assert.ErrorContains(t, err, "failed to restore snapshot: boom")
+}
+
+func TestDeleteSnapshot(t *testing.T) {
+	restoreCmd, _ := patchCommands() // no owner recorded
+	defer restoreCmd()
+	fake := &fakeBackend{snapshots: []Snapshot{{Name: "omnienv-a"}}}
+	assert.Nil(t, testApp(fake).DeleteSnapshot(context.Background(), "a"))
+	assert.Equal(t, []string{"list l-s", "delete l-s/omnienv-a"}, fake.calls)
+}
+
+func TestDeleteSnapshotNotFound(t *testing.T) {
+	restoreCmd, _ := patchCommands() // no owner recorded
+	defer restoreCmd()
+	fake := &fakeBackend{}
+	err := testApp(fake).DeleteSnapshot(context.Background(), "a")
+	assert.ErrorIs(t, err, ErrSnapshotNotFound)
+}
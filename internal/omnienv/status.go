@@ -0,0 +1,47 @@
+package omnienv
+
+import "context"
+
+// Status summarizes the state of the instance.
+type Status struct {
+	Name  string
+	State string
+	VM    bool
+	// LaunchStep is the step an incomplete launch stopped at, or empty
+	// once launch has finished.
+	LaunchStep string
+	// Idle is the state of the idle watcher, nil if none is running.
+	Idle *IdleState
+}
+
+func (app App) Status(ctx context.Context) (Status, error) {
+	fields, err := app.info(ctx)
+	if err != nil {
+		return Status{}, err
+	}
+
+	step, err := app.getMeta(ctx, launchStepKey)
+	if err != nil {
+		return Status{}, err
+	}
+	if step == launchDone {
+		step = ""
+	}
+
+	status := Status{
+		Name:       app.Name(),
+		State:      fields["Status"],
+		VM:         fields["Type"] == "virtual-machine",
+		LaunchStep: step,
+	}
+	if app.Config.IdleStop > 0 {
+		idle, running, err := app.readIdleState()
+		if err != nil {
+			return Status{}, err
+		}
+		if running {
+			status.Idle = &idle
+		}
+	}
+	return status, nil
+}
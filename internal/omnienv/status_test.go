@@ -0,0 +1,88 @@
+package omnienv
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var statusTests = []struct {
+	summary string
+	info    *exec.Cmd
+	meta    *exec.Cmd
+
+	status Status
+	errMsg string
+}{{
+	summary: "launched container",
+	info:    exec.Command("/bin/printf", "Name: l-s\nStatus: RUNNING\nType: container\n"),
+	meta:    exec.Command("/bin/echo", "done"),
+	status:  Status{Name: "l-s", State: "RUNNING"},
+}, {
+	summary: "incomplete vm",
+	info:    exec.Command("/bin/printf", "Status: STOPPED\nType: virtual-machine\n"),
+	meta:    exec.Command("/bin/echo", "cloud-init"),
+	status:  Status{Name: "l-s", State: "STOPPED", VM: true, LaunchStep: "cloud-init"},
+}, {
+	summary: "info fails",
+	info:    exec.Command("/bin/false"),
+	meta:    exec.Command("/bin/false"), // lxc list
+	errMsg:  "failed to get instance info",
+}, {
+	summary: "meta fails",
+	info:    exec.Command("/bin/echo", "Status: RUNNING"),
+	meta:    exec.Command("/bin/false"),
+	errMsg:  "failed to get launch-step",
+}}
+
+func TestStatus(t *testing.T) {
+	for _, test := range statusTests {
+		restoreCmd, _ := patchCommands(test.info, test.meta)
+		app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+		status, err := app.Status(context.Background())
+		restoreCmd()
+		if test.errMsg != "" {
+			assert.ErrorContains(t, err, test.errMsg, test.summary)
+		} else {
+			assert.Nil(t, err, test.summary)
+			assert.Equal(t, test.status, status, test.summary)
+		}
+	}
+}
+
+func TestInfoSkipsNested(t *testing.T) {
+	restoreCmd, _ := patchCommands(exec.Command(
+		"/bin/printf", "Status: RUNNING\nResources:\n  Status: nested\n",
+	))
+	defer restoreCmd()
+	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+	fields, err := app.info(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"Status": "RUNNING"}, fields)
+}
+
+func TestInfoNotFound(t *testing.T) {
+	restoreCmd, calls := patchCommands(
+		exec.Command("/bin/false"), // lxc info
+		exec.Command("/bin/true"),  // lxc list
+	)
+	defer restoreCmd()
+	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+	_, err := app.info(context.Background())
+	assert.ErrorIs(t, err, ErrInstanceNotFound)
+	assert.Len(t, *calls, 2)
+}
+
+func TestInfoFailsOtherwise(t *testing.T) {
+	restoreCmd, _ := patchCommands(
+		exec.Command("/bin/false"),       // lxc info
+		exec.Command("/bin/echo", "l-s"), // lxc list
+	)
+	defer restoreCmd()
+	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+	_, err := app.info(context.Background())
+	assert.NotErrorIs(t, err, ErrInstanceNotFound)
+	assert.ErrorContains(t, err, "failed to get instance info: exit status 1")
+}
@@ -1,6 +1,9 @@
 package omnienv
 
-import "os"
+import (
+	"fmt"
+	"os"
+)
 
 type UserInfo struct {
 	UID int
@@ -13,3 +16,9 @@ func CurrentUserInfo() UserInfo {
 		GID: os.Getgid(),
 	}
 }
+
+// idmap maps the user to the user account in the instance, in the form of
+// the LXD raw.idmap config.
+func (user UserInfo) idmap() string {
+	return fmt.Sprintf("uid %d 1000\ngid %d 1000", user.UID, user.GID)
+}
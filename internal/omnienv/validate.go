@@ -0,0 +1,371 @@
+package omnienv
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigError is a problem found in the config file, at Line and Column
+// when known.
+type ConfigError struct {
+	Path   string
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (err *ConfigError) Error() string {
+	switch {
+	case err.Path == "" && err.Line == 0:
+		return err.Msg
+	case err.Path == "":
+		// from an unmarshaler, before parseConfig adds the path
+		return fmt.Sprintf("line %d, column %d: %s", err.Line, err.Column, err.Msg)
+	case err.Line == 0:
+		return fmt.Sprintf("%s: %s", err.Path, err.Msg)
+	case err.Column == 0:
+		return fmt.Sprintf("%s:%d: %s", err.Path, err.Line, err.Msg)
+	default:
+		return fmt.Sprintf("%s:%d:%d: %s", err.Path, err.Line, err.Column, err.Msg)
+	}
+}
+
+// nodeError is a ConfigError at the node, for the UnmarshalYAML methods of
+// the config types to report problems at their position.
+func nodeError(node *yaml.Node, format string, args ...any) error {
+	return &ConfigError{
+		Line: node.Line, Column: node.Column, Msg: fmt.Sprintf(format, args...),
+	}
+}
+
+// collectable makes a ConfigError from an UnmarshalYAML method a
+// *yaml.TypeError, which yaml.v3 collects rather than stopping the decoding
+// of the rest of the config at.
+func collectable(err error) error {
+	var cfgErr *ConfigError
+	if errors.As(err, &cfgErr) {
+		return &yaml.TypeError{Errors: []string{cfgErr.Error()}}
+	}
+	return err
+}
+
+// checkFields fails on keys of the map node other than fields, which
+// decoding a node does not do even when the config is decoded strictly.
+func checkFields(node *yaml.Node, fields ...string) error {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		if !slices.Contains(fields, key.Value) {
+			return nodeError(key, "unknown field %q", key.Value)
+		}
+	}
+	return nil
+}
+
+// configEnums are the values allowed for the config keys that take one of
+// a fixed set.  An empty value leaves the default.
+var configEnums = map[string][]string{
+	"auto_launch":    {AutoLaunchTrue, AutoLaunchPrompt, AutoLaunchFalse},
+	"backend":        {"lxd"},
+	"naming":         {NamingPlain, NamingHashed},
+	"virtualization": {"container", "vm"},
+	"worktrees":      {WorktreesShared, WorktreesSeparate},
+}
+
+// yamlLine matches the position yaml.v3 puts in front of its messages.
+var yamlLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// yamlSubject matches the value or field yaml.v3 type errors are about,
+// which may be cut short with "...".
+var yamlSubject = regexp.MustCompile("`([^`]*)`|field (\\S+) ")
+
+// fieldKey is the key of a struct field in YAML.
+func fieldKey(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if name == "" {
+		name = strings.ToLower(field.Name)
+	}
+	return name
+}
+
+// configKeys are the top level keys of the config file.
+func configKeys() []string {
+	var keys []string
+	typ := reflect.TypeFor[Config]()
+	for i := range typ.NumField() {
+		if field := typ.Field(i); field.IsExported() {
+			keys = append(keys, fieldKey(field))
+		}
+	}
+	return keys
+}
+
+// distance is the edit distance between a and b.
+func distance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// suggestKey is the known key closest to key, if it is likely a typo.
+func suggestKey(key string, known []string) string {
+	best, bestDist := "", 3
+	for _, candidate := range known {
+		if dist := distance(key, candidate); dist < bestDist {
+			best, bestDist = candidate, dist
+		}
+	}
+	return best
+}
+
+// configValidator collects the problems found in a config file.
+type configValidator struct {
+	path   string
+	doc    *yaml.Node
+	errors []error
+	// reported are the messages of the errors found by checkNodes, which
+	// decoding reports again
+	reported map[string]bool
+}
+
+func (v *configValidator) at(node *yaml.Node, format string, args ...any) {
+	err := &ConfigError{Path: v.path, Msg: fmt.Sprintf(format, args...)}
+	if node != nil {
+		err.Line, err.Column = node.Line, node.Column
+	}
+	v.errors = append(v.errors, err)
+}
+
+// yamlErr adds an error from yaml.v3, taking the line from its message.
+func (v *configValidator) yamlErr(msg string) *ConfigError {
+	err := &ConfigError{Path: v.path, Msg: msg}
+	if match := yamlLine.FindStringSubmatch(msg); match != nil {
+		err.Line, _ = strconv.Atoi(match[1])
+		err.Msg = match[2]
+	}
+	v.errors = append(v.errors, err)
+	return err
+}
+
+// typeErr adds a type error from yaml.v3, which gives only the line, with
+// the column of the value or field it is about.
+func (v *configValidator) typeErr(msg string) {
+	err := v.yamlErr(msg)
+	subject := ""
+	if match := yamlSubject.FindStringSubmatch(err.Msg); match != nil {
+		subject = match[1] + match[2]
+	}
+	subject, cut := strings.CutSuffix(subject, "...")
+
+	var find func(node *yaml.Node) bool
+	find = func(node *yaml.Node) bool {
+		if node.Line == err.Line && node.Kind == yaml.ScalarNode &&
+			(node.Value == subject || cut && strings.HasPrefix(node.Value, subject)) {
+			err.Column = node.Column
+			return true
+		}
+		return slices.ContainsFunc(node.Content, find)
+	}
+	find(v.doc)
+}
+
+// checkKeys reports the top level keys that are not config fields, and
+// checks the values of those taking one of a fixed set.
+func (v *configValidator) checkKeys(root *yaml.Node) {
+	known := configKeys()
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		if !slices.Contains(known, key.Value) {
+			if suggestion := suggestKey(key.Value, known); suggestion != "" {
+				v.at(key, "unknown field %q, did you mean %q?", key.Value, suggestion)
+			} else {
+				v.at(key, "unknown field %q", key.Value)
+			}
+			continue
+		}
+
+		allowed, isEnum := configEnums[key.Value]
+		if !isEnum || value.Kind != yaml.ScalarNode || value.Value == "" {
+			continue
+		}
+		if !slices.Contains(allowed, value.Value) {
+			last := len(allowed) - 1
+			expected := strings.Join(allowed[:last], ", ")
+			if last > 0 {
+				expected += " or "
+			}
+			expected += allowed[last]
+			v.at(value, "invalid %s %q, expected %s", key.Value, value.Value, expected)
+		}
+	}
+}
+
+// checkNode reports the problem unmarshal finds in the node.  Only
+// ConfigErrors are taken, as decoding reports the others.
+func (v *configValidator) checkNode(node *yaml.Node, unmarshal func(*yaml.Node) error) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	var cfgErr *ConfigError
+	if errors.As(unmarshal(node), &cfgErr) {
+		v.reported[cfgErr.Error()] = true
+		cfgErr.Path = v.path
+		v.errors = append(v.errors, cfgErr)
+	}
+}
+
+// checkNodes checks the values of the types with their own UnmarshalYAML
+// from the node tree, where their position is known.
+func (v *configValidator) checkNodes(root *yaml.Node) {
+	if node := value(root, "system"); node != nil {
+		v.checkNode(node, new(System).unmarshal)
+	}
+	if node := value(root, "ports"); node != nil && node.Kind == yaml.SequenceNode {
+		for _, port := range node.Content {
+			v.checkNode(port, new(Port).unmarshal)
+		}
+	}
+	ready := value(root, "ready")
+	if ready == nil || ready.Kind != yaml.MappingNode {
+		return
+	}
+	if node := value(ready, "probes"); node != nil && node.Kind == yaml.SequenceNode {
+		for _, probe := range node.Content {
+			v.checkNode(probe, new(Probe).unmarshal)
+		}
+	}
+}
+
+// value is the node of the key in the map node, or nil if it is not set.
+func value(root *yaml.Node, key string) *yaml.Node {
+	var node *yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == key {
+			node = root.Content[i+1]
+		}
+	}
+	return node
+}
+
+// checkBaseDir resolves a relative basedir against the directory of the
+// config, and checks that it is a directory.
+func (v *configValidator) checkBaseDir(root *yaml.Node, cfg *Config) {
+	if cfg.RootDir == "" {
+		return
+	}
+	node := value(root, "basedir")
+	if !filepath.IsAbs(cfg.RootDir) {
+		cfg.RootDir = filepath.Join(filepath.Dir(v.path), cfg.RootDir)
+	}
+	cfg.RootDir = filepath.Clean(cfg.RootDir)
+	info, err := os.Stat(cfg.RootDir)
+	switch {
+	case err != nil:
+		v.at(node, "invalid basedir: %v", err)
+	case !info.IsDir():
+		v.at(node, "invalid basedir: %s is not a directory", cfg.RootDir)
+	}
+}
+
+// parseConfig decodes the config file strictly, rejecting unknown fields
+// and invalid values, and reports every problem found with its position.
+func parseConfig(path string, data []byte) (Config, error) {
+	v := &configValidator{path: path, reported: map[string]bool{}}
+	cfg := Config{}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		v.yamlErr(err.Error())
+		return Config{}, errors.Join(v.errors...)
+	}
+	v.doc = &doc
+	var root *yaml.Node
+	if len(doc.Content) > 0 {
+		root = doc.Content[0]
+	}
+	if root != nil && root.Kind != yaml.MappingNode {
+		v.at(root, "expected a map of config fields")
+		return Config{}, errors.Join(v.errors...)
+	}
+	if root != nil {
+		v.checkKeys(root)
+		v.checkNodes(root)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(&cfg)
+	var typeErr *yaml.TypeError
+	switch {
+	case err == nil, errors.Is(err, io.EOF):
+	case errors.As(err, &typeErr):
+		for _, msg := range typeErr.Errors {
+			// unknown top level fields are reported by checkKeys
+			if !strings.HasSuffix(msg, "not found in type omnienv.Config") &&
+				!v.reported[msg] {
+				v.typeErr(msg)
+			}
+		}
+	default:
+		v.yamlErr(err.Error())
+	}
+
+	if root != nil {
+		v.checkBaseDir(root, &cfg)
+		if cfg.isVM() && len(cfg.Ports) > 0 {
+			v.at(value(root, "ports"), "invalid ports: %v", ErrPortsVM)
+		}
+	}
+	if len(v.errors) > 0 {
+		// in the order of the file, as checkNodes reports ahead of decoding
+		slices.SortStableFunc(v.errors, func(a, b error) int {
+			var errA, errB *ConfigError
+			errors.As(a, &errA)
+			errors.As(b, &errB)
+			return cmp.Or(cmp.Compare(errA.Line, errB.Line), cmp.Compare(errA.Column, errB.Column))
+		})
+		return Config{}, errors.Join(v.errors...)
+	}
+	return cfg, nil
+}
+
+// ValidateConfig checks the config file at path, or the one found from the
+// current directory if path is empty, and returns the path checked.
+func ValidateConfig(path string) (string, error) {
+	if path == "" {
+		dir, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+		if path, err = findConfig(dir); err != nil {
+			return "", err
+		}
+	}
+	_, err := loadConfig(path)
+	return path, err
+}
@@ -0,0 +1,166 @@
+package omnienv
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var parseConfigTests = []struct {
+	summary string
+	data    string
+
+	errMsgs []string
+}{{
+	summary: "empty",
+	data:    "",
+}, {
+	summary: "valid",
+	data: `system: noble
+virtualization: container
+backend: lxd
+naming: hashed
+auto_launch: true
+ports: [8080]
+ready:
+  timeout: 5m
+`,
+}, {
+	summary: "typo",
+	data:    "system: noble\nvirtualisation: vm\n",
+	errMsgs: []string{`CFG:2:1: unknown field "virtualisation", did you mean "virtualization"?`},
+}, {
+	summary: "unknown",
+	data:    "sytem: noble\ncolour: blue\n",
+	errMsgs: []string{
+		`CFG:1:1: unknown field "sytem", did you mean "system"?`,
+		`CFG:2:1: unknown field "colour"`,
+	},
+}, {
+	summary: "enums",
+	data:    "virtualization: VM\nbackend: docker\nworktrees: mixed\n",
+	errMsgs: []string{
+		`CFG:1:17: invalid virtualization "VM", expected container or vm`,
+		`CFG:2:10: invalid backend "docker", expected lxd`,
+		`CFG:3:12: invalid worktrees "mixed", expected shared or separate`,
+	},
+}, {
+	summary: "ports for a VM",
+	data:    "virtualization: vm\nports:\n  - 8080\n",
+	errMsgs: []string{"CFG:3:3: invalid ports: port forwarding is not supported for VMs"},
+}, {
+	summary: "nested unknown field",
+	data:    "ready:\n  timeot: 5m\n",
+	errMsgs: []string{`CFG:2:3: field timeot not found in type omnienv.Ready`},
+}, {
+	summary: "wrong type",
+	data:    "stale_image_days: soon\n",
+	errMsgs: []string{"CFG:1:19: cannot unmarshal !!str `soon` into int"},
+}, {
+	summary: "wrong type, long value",
+	data:    "ready:\n  timeout: 5m\nstale_image_days: a-long-value\n",
+	errMsgs: []string{"CFG:3:19: cannot unmarshal !!str `a-long-...` into int"},
+}, {
+	summary: "invalid port",
+	data:    "ports:\n  - 8080\n  - 70000\n",
+	errMsgs: []string{"CFG:3:5: invalid port 70000"},
+}, {
+	summary: "invalid port map",
+	data:    "ports:\n  - {host: 53, proto: sctp}\n",
+	errMsgs: []string{`CFG:2:5: invalid port proto "sctp", expected tcp or udp`},
+}, {
+	summary: "unknown port field",
+	data:    "ports:\n  - {host: 53, gust: 80}\n",
+	errMsgs: []string{`CFG:2:16: unknown field "gust"`},
+}, {
+	summary: "problems after an invalid port",
+	data:    "ports: [70000]\nready:\n  timeout: soon\n  probes: [bogus]\nsystem: {}\n",
+	errMsgs: []string{
+		"CFG:1:9: invalid port 70000",
+		"CFG:3:12: cannot unmarshal !!str `soon` into time.Duration",
+		`CFG:4:12: unknown probe "bogus"`,
+		"CFG:5:9: empty system map",
+	},
+}, {
+	summary: "unknown probe",
+	data:    "ready: {probes: [user, bogus]}\n",
+	errMsgs: []string{`CFG:1:24: unknown probe "bogus"`},
+}, {
+	summary: "empty system map",
+	data:    "system: {}\n",
+	errMsgs: []string{"CFG:1:9: empty system map"},
+}, {
+	summary: "unknown system field",
+	data:    "system:\n  noble:\n    imag: ubuntu:noble\n",
+	errMsgs: []string{`CFG:3:5: unknown field "imag"`},
+}, {
+	summary: "syntax",
+	data:    "system: [noble\n",
+	errMsgs: []string{"CFG:1: did not find expected ',' or ']'"},
+}, {
+	summary: "not a map",
+	data:    "- noble\n",
+	errMsgs: []string{"CFG:1:1: expected a map of config fields"},
+}, {
+	summary: "basedir missing",
+	data:    "basedir: /nonexistent/omnienv\n",
+	errMsgs: []string{"CFG:1:10: invalid basedir: stat /nonexistent/omnienv: no such file or directory"},
+}, {
+	summary: "basedir not a directory",
+	data:    "basedir: " + cfgName + "\n",
+	errMsgs: []string{"CFG:1:10: invalid basedir: DIR/" + cfgName + " is not a directory"},
+}}
+
+func TestParseConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, cfgName)
+	assert.Nil(t, os.WriteFile(path, nil, 0o644))
+	for _, test := range parseConfigTests {
+		_, err := parseConfig(path, []byte(test.data))
+		if len(test.errMsgs) == 0 {
+			assert.Nil(t, err, test.summary)
+			continue
+		}
+		var msgs []string
+		for _, msg := range test.errMsgs {
+			msg = strings.ReplaceAll(msg, "CFG", path)
+			msgs = append(msgs, strings.ReplaceAll(msg, "DIR", dir))
+		}
+		assert.EqualError(t, err, strings.Join(msgs, "\n"), test.summary)
+	}
+}
+
+func TestParseConfigRelativeBaseDir(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "src"), 0o755))
+	cfg, err := parseConfig(filepath.Join(dir, cfgName), []byte("basedir: ./src/\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "src"), cfg.RootDir)
+}
+
+func TestConfigKeys(t *testing.T) {
+	keys := configKeys()
+	for _, key := range []string{"system", "basedir", "auto_launch", "pass_env", "ready"} {
+		assert.Contains(t, keys, key)
+	}
+	assert.NotContains(t, keys, "maindir")
+	assert.NotContains(t, keys, "rootdir")
+}
+
+func TestValidateConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, cfgName)
+	assert.Nil(t, os.WriteFile(path, []byte("system: noble\nnaming: short\n"), 0o644))
+	checked, err := ValidateConfig(path)
+	assert.Equal(t, path, checked)
+	assert.EqualError(t, err, path+`:2:9: invalid naming "short", expected plain or hashed`)
+
+	t.Chdir(dir)
+	assert.Nil(t, os.WriteFile(path, []byte("system: noble\n"), 0o644))
+	checked, err = ValidateConfig("")
+	assert.Nil(t, err)
+	assert.Equal(t, path, checked)
+}
@@ -0,0 +1,117 @@
+package omnienv
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Values for Config.Worktrees.
+const (
+	WorktreesShared   = "shared"
+	WorktreesSeparate = "separate"
+)
+
+// worktree describes a linked git worktree.
+type worktree struct {
+	// Name is the name git gave the worktree, unique within the repository.
+	Name string
+	// MainDir is the root of the main worktree.
+	MainDir string
+}
+
+// findWorktree inspects dir/.git to find if dir is a linked git worktree,
+// returning nil if not.  In a linked worktree .git is a file pointing at
+// <main>/.git/worktrees/<name>, which in turn has a commondir file
+// pointing back at <main>/.git.
+func findWorktree(dir string) (*worktree, error) {
+	dotgit := filepath.Join(dir, ".git")
+	info, err := os.Stat(dotgit)
+	if err != nil || info.IsDir() {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(dotgit) //gosec:disable G304
+	if err != nil {
+		return nil, err
+	}
+	gitdir, found := strings.CutPrefix(strings.TrimSpace(string(data)), "gitdir: ")
+	if !found {
+		return nil, fmt.Errorf("unexpected contents of %s", dotgit)
+	}
+	if !filepath.IsAbs(gitdir) {
+		gitdir = filepath.Join(dir, gitdir)
+	}
+
+	data, err = os.ReadFile(filepath.Join(gitdir, "commondir")) //gosec:disable G304
+	if err != nil {
+		// a submodule rather than a worktree
+		return nil, nil
+	}
+	common := strings.TrimSpace(string(data))
+	if !filepath.IsAbs(common) {
+		common = filepath.Join(gitdir, common)
+	}
+
+	return &worktree{
+		Name:    filepath.Base(gitdir),
+		MainDir: filepath.Dir(filepath.Clean(common)),
+	}, nil
+}
+
+// applyWorktrees adjusts the Label for the Worktrees mode, when RootDir is
+// a linked git worktree.  Both modes name the instance after the main
+// worktree, and separate adds the name of the linked worktree.
+func (cfg *Config) applyWorktrees(labelSet bool) error {
+	wt, err := findWorktree(cfg.RootDir)
+	if err != nil || wt == nil {
+		return err
+	}
+	slog.Debug("worktree", "name", wt.Name, "main", wt.MainDir)
+
+	if !labelSet {
+		cfg.Label = filepath.Base(wt.MainDir)
+	}
+	if cfg.Worktrees == WorktreesSeparate {
+		cfg.Label = cfg.Label + "-" + wt.Name
+	} else {
+		cfg.mainDir = wt.MainDir
+	}
+	return nil
+}
+
+// ensureWorkdir points the workdir mount at RootDir, for instances shared
+// between worktrees.
+func (app App) ensureWorkdir(ctx context.Context) error {
+	if app.Config.Worktrees != WorktreesShared {
+		return nil
+	}
+
+	cmd := commandContext(
+		ctx, "lxc", "config", "device", "get", app.Name(), "workdir", "source",
+	)
+	slog.Debug("run", "command", cmd.Args)
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("failed to get workdir: %w", err)
+	}
+	if strings.TrimSpace(string(out)) == app.Config.RootDir {
+		return nil
+	}
+
+	slog.Warn(
+		"moving /project to this worktree, for all shells of the instance",
+		"instance", app.Name(), "source", app.Config.RootDir,
+	)
+	err = runQuiet(
+		ctx, "lxc", "config", "device", "set", app.Name(), "workdir",
+		"source="+app.Config.RootDir,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update workdir: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package omnienv
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// makeWorktree lays out a main checkout at base/main and a linked worktree
+// of it named name at base/wt, returning the worktree directory.
+func makeWorktree(t *testing.T, base, name string, relative bool) string {
+	main := filepath.Join(base, "main")
+	gitdir := filepath.Join(main, ".git", "worktrees", name)
+	wt := filepath.Join(base, "wt")
+	assert.Nil(t, os.MkdirAll(gitdir, 0750))
+	assert.Nil(t, os.MkdirAll(wt, 0750))
+	assert.Nil(t, os.WriteFile(filepath.Join(gitdir, "commondir"), []byte("../..\n"), 0644))
+
+	pointer := gitdir
+	if relative {
+		pointer = "../main/.git/worktrees/" + name
+	}
+	data := []byte("gitdir: " + pointer + "\n")
+	assert.Nil(t, os.WriteFile(filepath.Join(wt, ".git"), data, 0644))
+	return wt
+}
+
+func TestFindWorktree(t *testing.T) {
+	for _, relative := range []bool{false, true} {
+		base := t.TempDir()
+		wt, err := findWorktree(makeWorktree(t, base, "feature", relative))
+		assert.Nil(t, err)
+		assert.Equal(t, &worktree{Name: "feature", MainDir: filepath.Join(base, "main")}, wt)
+	}
+}
+
+func TestFindWorktreeMain(t *testing.T) {
+	base := t.TempDir()
+	makeWorktree(t, base, "feature", false)
+	wt, err := findWorktree(filepath.Join(base, "main"))
+	assert.Nil(t, err)
+	assert.Nil(t, wt)
+}
+
+func TestFindWorktreeNotGit(t *testing.T) {
+	wt, err := findWorktree(t.TempDir())
+	assert.Nil(t, err)
+	assert.Nil(t, wt)
+}
+
+func TestFindWorktreeSubmodule(t *testing.T) {
+	base := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(base, "super/.git/modules/sub"), 0750))
+	sub := filepath.Join(base, "super/sub")
+	assert.Nil(t, os.MkdirAll(sub, 0750))
+	data := []byte("gitdir: ../.git/modules/sub\n")
+	assert.Nil(t, os.WriteFile(filepath.Join(sub, ".git"), data, 0644))
+
+	wt, err := findWorktree(sub)
+	assert.Nil(t, err)
+	assert.Nil(t, wt)
+}
+
+func TestFindWorktreeGarbage(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, ".git"), []byte("junk"), 0644))
+	_, err := findWorktree(dir)
+	assert.ErrorContains(t, err, "unexpected contents")
+}
+
+var worktreeCfgTests = []struct {
+	summary string
+	data    string
+
+	label  string
+	errMsg string
+}{{
+	summary: "unset",
+	data:    "system: s",
+	label:   "wt",
+}, {
+	summary: "shared",
+	data:    "worktrees: shared",
+	label:   "main",
+}, {
+	summary: "separate",
+	data:    "worktrees: separate",
+	label:   "main-feature",
+}, {
+	summary: "separate with label",
+	data:    "{worktrees: separate, label: proj}",
+	label:   "proj-feature",
+}, {
+	summary: "invalid",
+	data:    "worktrees: both",
+	errMsg:  `invalid worktrees "both"`,
+}}
+
+func TestLoadCfgWorktrees(t *testing.T) {
+	for _, test := range worktreeCfgTests {
+		wt := makeWorktree(t, t.TempDir(), "feature", true)
+		filename := filepath.Join(wt, cfgName)
+		assert.Nil(t, os.WriteFile(filename, []byte(test.data), 0644))
+		cfg, err := loadConfig(filename)
+		if test.errMsg != "" {
+			assert.ErrorContains(t, err, test.errMsg, test.summary)
+			continue
+		}
+		assert.Nil(t, err, test.summary)
+		assert.Equal(t, test.label, cfg.Label, test.summary)
+		assert.Equal(t, wt, cfg.RootDir, test.summary)
+	}
+}
+
+func TestEnsureWorkdirNotShared(t *testing.T) {
+	restoreCmd, calls := patchCommands()
+	defer restoreCmd()
+	app := App{Config: Config{Label: "l", System: NewSystem("s")}}
+	assert.Nil(t, app.ensureWorkdir(context.Background()))
+	assert.Empty(t, *calls)
+}
+
+var ensureWorkdirTests = []struct {
+	summary string
+	cmds    []*exec.Cmd
+
+	calls  int
+	errMsg string
+}{{
+	summary: "already mounted",
+	cmds:    []*exec.Cmd{exec.Command("/bin/echo", "/src/wt")},
+	calls:   1,
+}, {
+	summary: "moved",
+	cmds: []*exec.Cmd{
+		exec.Command("/bin/echo", "/src/main"),
+		exec.Command("/bin/true"),
+	},
+	calls: 2,
+}, {
+	summary: "get fails",
+	cmds:    []*exec.Cmd{exec.Command("/bin/false")},
+	errMsg:  "failed to get workdir",
+}, {
+	summary: "set fails",
+	cmds: []*exec.Cmd{
+		exec.Command("/bin/echo", "/src/main"),
+		exec.Command("/bin/false"),
+	},
+	errMsg: "failed to update workdir",
+}}
+
+func TestEnsureWorkdir(t *testing.T) {
+	for _, test := range ensureWorkdirTests {
+		restoreCmd, calls := patchCommands(test.cmds...)
+		app := App{Config: Config{
+			Label: "l", System: NewSystem("s"), RootDir: "/src/wt",
+			Worktrees: WorktreesShared,
+		}}
+		err := app.ensureWorkdir(context.Background())
+		restoreCmd()
+		if test.errMsg != "" {
+			assert.ErrorContains(t, err, test.errMsg, test.summary)
+			continue
+		}
+		assert.Nil(t, err, test.summary)
+		require.Len(t, *calls, test.calls, test.summary)
+		if test.calls == 2 {
+			assert.Equal(t, []string{
+				"lxc", "config", "device", "set", "l-s", "workdir", "source=/src/wt",
+			}, (*calls)[1], test.summary)
+		}
+	}
+}